@@ -0,0 +1,375 @@
+package alarmman
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+//EnumPriority is an IEC 60601-1-8 alarm priority
+type EnumPriority int
+
+func (e EnumPriority) String() string {
+	switch int(e) {
+	case 0:
+		return "Low"
+	case 1:
+		return "Medium"
+	case 2:
+		return "High"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//PriorityLow ..
+	PriorityLow EnumPriority = iota
+	//PriorityMedium ..
+	PriorityMedium
+	//PriorityHigh ..
+	PriorityHigh
+)
+
+//EnumAlarm identifies an alarm condition
+type EnumAlarm int
+
+func (e EnumAlarm) String() string {
+	switch int(e) {
+	case 0:
+		return "High Pressure"
+	case 1:
+		return "Low Pressure"
+	case 2:
+		return "Low Tidal Volume"
+	case 3:
+		return "Apnea"
+	case 4:
+		return "High Rate"
+	case 5:
+		return "Sensor Failure"
+	case 6:
+		return "Disconnection"
+	case 7:
+		return "Device Fault"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//AlarmHighPressure ..
+	AlarmHighPressure EnumAlarm = iota
+	//AlarmLowPressure ..
+	AlarmLowPressure
+	//AlarmLowTidalVolume ..
+	AlarmLowTidalVolume
+	//AlarmApnea ..
+	AlarmApnea
+	//AlarmHighRate ..
+	AlarmHighRate
+	//AlarmSensorFailure ..
+	AlarmSensorFailure
+	//AlarmDisconnection ..
+	AlarmDisconnection
+	//AlarmDeviceFault is a device that has failed repeatedly and is being recovered
+	AlarmDeviceFault
+	//AlarmCount ..
+	AlarmCount
+)
+
+type definition struct {
+	priority EnumPriority
+	latching bool //alarm remains displayed after the condition clears, until acknowledged
+}
+
+var definitions = [AlarmCount]definition{
+	AlarmHighPressure:   {priority: PriorityHigh, latching: true},
+	AlarmLowPressure:    {priority: PriorityMedium, latching: false},
+	AlarmLowTidalVolume: {priority: PriorityMedium, latching: false},
+	AlarmApnea:          {priority: PriorityHigh, latching: true},
+	AlarmHighRate:       {priority: PriorityMedium, latching: false},
+	AlarmSensorFailure:  {priority: PriorityHigh, latching: true},
+	AlarmDisconnection:  {priority: PriorityHigh, latching: true},
+	AlarmDeviceFault:    {priority: PriorityHigh, latching: true},
+}
+
+//Limits ..
+type Limits struct {
+	HighPressure          float64       //cmH2O airway pressure
+	LowPressure           float64       //cmH2O peak pressure of a breath
+	LowTidalVolume        float64       //Liters expired
+	ApneaTimeout          time.Duration //Time without an inspiration
+	HighRate              float64       //Breaths per minute
+	SensorFailureTime     time.Duration //Time DataPackets have been invalid, or not delivered, independent of their rate
+	DisconnectionPressure float64       //cmH2O airway pressure below which the circuit is considered open
+	DisconnectionTime     time.Duration //Time below DisconnectionPressure
+	AudioPause            time.Duration //Time audio is paused for by Silence
+	Escalation            time.Duration //Time an unacknowledged alarm is active before its priority is raised, 0 to disable
+}
+
+//DefaultLimits ..
+func DefaultLimits() Limits {
+	return Limits{
+		HighPressure:          40,
+		LowPressure:           8,
+		LowTidalVolume:        0.2,
+		ApneaTimeout:          20 * time.Second,
+		HighRate:              40,
+		SensorFailureTime:     500 * time.Millisecond,
+		DisconnectionPressure: 2,
+		DisconnectionTime:     5 * time.Second,
+		AudioPause:            2 * time.Minute,
+		Escalation:            time.Minute,
+	}
+}
+
+//Alarm ..
+type Alarm struct {
+	ID           EnumAlarm
+	Priority     EnumPriority //Current priority, including escalation
+	Active       bool         //Condition is present
+	Latched      bool         //Condition has cleared, but the alarm has not been acknowledged
+	Acknowledged bool
+	Raised       time.Time
+	Message      string
+}
+
+//AlarmMan evaluates alarm conditions from DataPackets
+type AlarmMan struct {
+	limits Limits
+
+	malarms     sync.Mutex
+	alarms      [AlarmCount]Alarm
+	now         time.Time //Timestamp of the last DataPacket
+	pausedUntil time.Time
+
+	invalidSince      time.Time
+	lastInspiration   time.Time
+	lowPressureSince  time.Time
+	pressureAvailable bool
+}
+
+//NewAlarmMan ..
+func NewAlarmMan(limits Limits) (*AlarmMan, error) {
+	if limits.SensorFailureTime <= 0 {
+		return nil, fmt.Errorf("Sensor failure time must be positive, got %v", limits.SensorFailureTime)
+	}
+	if limits.ApneaTimeout <= 0 {
+		return nil, fmt.Errorf("Apnea timeout must be positive, got %v", limits.ApneaTimeout)
+	}
+	if limits.LowPressure >= limits.HighPressure {
+		return nil, fmt.Errorf("Low pressure limit %v must be below high pressure limit %v", limits.LowPressure, limits.HighPressure)
+	}
+
+	am := AlarmMan{
+		limits: limits,
+	}
+	for i := range am.alarms {
+		am.alarms[i].ID = EnumAlarm(i)
+	}
+
+	return &am, nil
+}
+
+//Update evaluates all alarm conditions against a DataPacket
+func (a *AlarmMan) Update(dp ioman.DataPacket) {
+	a.malarms.Lock()
+	defer a.malarms.Unlock()
+
+	now := dp.Timestamp
+	a.now = now
+	if a.lastInspiration.IsZero() {
+		a.lastInspiration = now
+	}
+
+	// Sensor failure
+	if dp.Valid {
+		a.invalidSince = time.Time{}
+	} else if a.invalidSince.IsZero() {
+		a.invalidSince = now
+	}
+	failed := !a.invalidSince.IsZero() && now.Sub(a.invalidSince) >= a.limits.SensorFailureTime
+	a.set(AlarmSensorFailure, failed, fmt.Sprintf("No valid reads for %v", now.Sub(a.invalidSince)))
+
+	// Device recovery
+	devices := append([]ioman.DeviceHealth{}, dp.Health.Flows...)
+	if len(devices) == 0 {
+		devices = append(devices, dp.Health.Flow)
+	}
+	devices = append(devices, dp.Health.ADC, dp.Health.DAC)
+
+	faults := []string{}
+	for _, h := range devices {
+		if h.State != ioman.HealthOK {
+			faults = append(faults, fmt.Sprintf("%v %v", h.Label, h.State))
+		}
+	}
+	a.set(AlarmDeviceFault, dp.Health.Degraded(), strings.Join(faults, ", "))
+
+	if !dp.Valid {
+		a.escalate()
+		return
+	}
+
+	// Apnea
+	if dp.State == ioman.StateBreathingIn {
+		a.lastInspiration = now
+	}
+	apnea := now.Sub(a.lastInspiration)
+	a.set(AlarmApnea, apnea > a.limits.ApneaTimeout, fmt.Sprintf("No breath for %.0fs", apnea.Seconds()))
+
+	// Pressure
+	pressure := dp.Sensors.AirwayPressure
+	if pressure.Valid {
+		a.pressureAvailable = true
+
+		a.set(AlarmHighPressure, pressure.Val > a.limits.HighPressure, fmt.Sprintf("Pressure %.1f cmH2O", pressure.Val))
+
+		if pressure.Val < a.limits.DisconnectionPressure {
+			if a.lowPressureSince.IsZero() {
+				a.lowPressureSince = now
+			}
+		} else {
+			a.lowPressureSince = time.Time{}
+		}
+		disconnected := !a.lowPressureSince.IsZero() && now.Sub(a.lowPressureSince) >= a.limits.DisconnectionTime
+		a.set(AlarmDisconnection, disconnected, fmt.Sprintf("Pressure %.1f cmH2O", pressure.Val))
+	}
+
+	// Per breath
+	breath := dp.Calculated.Breath
+	if breath.Number != 0 {
+		if a.pressureAvailable {
+			a.set(AlarmLowPressure, breath.PeakPressure < a.limits.LowPressure, fmt.Sprintf("Peak %.1f cmH2O", breath.PeakPressure))
+		}
+		a.set(AlarmLowTidalVolume, breath.ExpiredVolume < a.limits.LowTidalVolume, fmt.Sprintf("Vte %.0f mL", breath.ExpiredVolume*1000))
+		a.set(AlarmHighRate, breath.Rate > a.limits.HighRate, fmt.Sprintf("Rate %.0f bpm", breath.Rate))
+	}
+
+	a.escalate()
+}
+
+func (a *AlarmMan) set(id EnumAlarm, condition bool, message string) {
+	alarm := &a.alarms[id]
+
+	switch {
+	case condition && !alarm.Active:
+		*alarm = Alarm{
+			ID:       id,
+			Priority: definitions[id].priority,
+			Active:   true,
+			Raised:   a.now,
+			Message:  message,
+		}
+		logman.Warnf("alarmman", "%v priority alarm raised: %v, %v", alarm.Priority, id, message)
+
+	case condition:
+		alarm.Message = message
+
+	case !condition && alarm.Active:
+		alarm.Active = false
+		alarm.Latched = definitions[id].latching && !alarm.Acknowledged
+		logman.Infof("alarmman", "alarm condition cleared: %v, latched %v", id, alarm.Latched)
+	}
+}
+
+func (a *AlarmMan) escalate() {
+	if a.limits.Escalation <= 0 {
+		return
+	}
+
+	for i := range a.alarms {
+		alarm := &a.alarms[i]
+		if !alarm.Active || alarm.Acknowledged || alarm.Priority == PriorityHigh {
+			continue
+		}
+
+		// Escalate one level for every Escalation period the alarm has been active
+		levels := EnumPriority(a.now.Sub(alarm.Raised) / a.limits.Escalation)
+		priority := definitions[alarm.ID].priority + levels
+		if priority > PriorityHigh {
+			priority = PriorityHigh
+		}
+		if priority != alarm.Priority {
+			alarm.Priority = priority
+			logman.Warnf("alarmman", "alarm escalated to %v priority: %v", priority, alarm.ID)
+		}
+	}
+}
+
+//Acknowledge acknowledges all displayed alarms, clearing latched alarms whose condition has passed
+func (a *AlarmMan) Acknowledge() {
+	a.malarms.Lock()
+	defer a.malarms.Unlock()
+
+	for i := range a.alarms {
+		alarm := &a.alarms[i]
+		if alarm.Latched {
+			*alarm = Alarm{ID: alarm.ID}
+			continue
+		}
+		if alarm.Active {
+			alarm.Acknowledged = true
+		}
+	}
+	logman.Infof("alarmman", "alarms acknowledged")
+}
+
+//Silence pauses audio for all current alarms for the AudioPause limit
+func (a *AlarmMan) Silence() {
+	a.malarms.Lock()
+	defer a.malarms.Unlock()
+
+	a.pausedUntil = a.now.Add(a.limits.AudioPause)
+	logman.Infof("alarmman", "audio paused until %v", a.pausedUntil)
+}
+
+//Alarms returns displayed alarms, active or latched, highest priority and oldest first
+func (a *AlarmMan) Alarms() []Alarm {
+	a.malarms.Lock()
+	defer a.malarms.Unlock()
+
+	alarms := []Alarm{}
+	for _, alarm := range a.alarms {
+		if alarm.Active || alarm.Latched {
+			alarms = append(alarms, alarm)
+		}
+	}
+
+	sort.SliceStable(alarms, func(i, j int) bool {
+		if alarms[i].Priority != alarms[j].Priority {
+			return alarms[i].Priority > alarms[j].Priority
+		}
+		return alarms[i].Raised.Before(alarms[j].Raised)
+	})
+
+	return alarms
+}
+
+//Audible returns the highest priority of unacknowledged alarms that should be sounding, and false if none should
+func (a *AlarmMan) Audible() (EnumPriority, bool) {
+	a.malarms.Lock()
+	defer a.malarms.Unlock()
+
+	if a.now.Before(a.pausedUntil) {
+		return PriorityLow, false
+	}
+
+	highest := PriorityLow
+	audible := false
+	for _, alarm := range a.alarms {
+		if (alarm.Active || alarm.Latched) && !alarm.Acknowledged {
+			if !audible || alarm.Priority > highest {
+				highest = alarm.Priority
+			}
+			audible = true
+		}
+	}
+	return highest, audible
+}
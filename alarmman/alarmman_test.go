@@ -0,0 +1,146 @@
+package alarmman
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/ioman"
+)
+
+func packet(t time.Time, pressure float64) ioman.DataPacket {
+	return ioman.DataPacket{
+		Valid:     true,
+		Timestamp: t,
+		State:     ioman.StateBreathingIn,
+		Sensors: ioman.Sensors{
+			AirwayPressure: ioman.Measurement{Val: pressure, Valid: true},
+		},
+	}
+}
+
+func find(alarms []Alarm, id EnumAlarm) (Alarm, bool) {
+	for _, a := range alarms {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	return Alarm{}, false
+}
+
+func TestLatchingAndAcknowledge(t *testing.T) {
+
+	am, err := NewAlarmMan(DefaultLimits())
+	if err != nil {
+		t.Fatalf("Failed to create alarmman: %v", err)
+	}
+	now := time.Now()
+
+	am.Update(packet(now, 50))
+	a, ok := find(am.Alarms(), AlarmHighPressure)
+	if !ok || !a.Active || a.Priority != PriorityHigh {
+		t.Fatalf("Expected active high priority alarm, got %+v", a)
+	}
+	if p, audible := am.Audible(); !audible || p != PriorityHigh {
+		t.Fatalf("Expected high priority audio")
+	}
+
+	// Condition clears, but alarm latches until acknowledged
+	am.Update(packet(now.Add(time.Second), 20))
+	a, ok = find(am.Alarms(), AlarmHighPressure)
+	if !ok || a.Active || !a.Latched {
+		t.Fatalf("Expected latched alarm, got %+v", a)
+	}
+
+	am.Acknowledge()
+	if _, ok := find(am.Alarms(), AlarmHighPressure); ok {
+		t.Fatalf("Expected latched alarm to clear on acknowledge")
+	}
+
+	// Acknowledging an active alarm silences it, and it does not latch once cleared
+	am.Update(packet(now.Add(2*time.Second), 50))
+	am.Acknowledge()
+	if _, audible := am.Audible(); audible {
+		t.Fatalf("Expected acknowledged alarm to be inaudible")
+	}
+	am.Update(packet(now.Add(3*time.Second), 20))
+	if _, ok := find(am.Alarms(), AlarmHighPressure); ok {
+		t.Fatalf("Expected acknowledged alarm to clear with its condition")
+	}
+}
+
+func TestSilenceAndEscalation(t *testing.T) {
+
+	limits := DefaultLimits()
+	am, err := NewAlarmMan(limits)
+	if err != nil {
+		t.Fatalf("Failed to create alarmman: %v", err)
+	}
+	now := time.Now()
+
+	low := packet(now, 20)
+	low.Calculated.Breath = ioman.Breath{Number: 1, PeakPressure: 20, ExpiredVolume: 0.1, Rate: 15}
+	am.Update(low)
+
+	a, ok := find(am.Alarms(), AlarmLowTidalVolume)
+	if !ok || a.Priority != PriorityMedium {
+		t.Fatalf("Expected medium priority low tidal volume alarm, got %+v", a)
+	}
+
+	am.Silence()
+	if _, audible := am.Audible(); audible {
+		t.Fatalf("Expected audio to be paused")
+	}
+
+	low.Timestamp = now.Add(limits.AudioPause + time.Second)
+	am.Update(low)
+	if _, audible := am.Audible(); !audible {
+		t.Fatalf("Expected audio to resume after pause")
+	}
+
+	a, _ = find(am.Alarms(), AlarmLowTidalVolume)
+	if a.Priority != PriorityHigh {
+		t.Fatalf("Expected unacknowledged alarm to escalate to high priority, got %v", a.Priority)
+	}
+}
+
+func TestApneaAndSensorFailure(t *testing.T) {
+
+	limits := DefaultLimits()
+	am, err := NewAlarmMan(limits)
+	if err != nil {
+		t.Fatalf("Failed to create alarmman: %v", err)
+	}
+	now := time.Now()
+
+	am.Update(packet(now, 10))
+	rest := packet(now.Add(limits.ApneaTimeout+time.Second), 10)
+	rest.State = ioman.StateExpiratoryPause
+	am.Update(rest)
+	if _, ok := find(am.Alarms(), AlarmApnea); !ok {
+		t.Fatalf("Expected apnea alarm")
+	}
+
+	// Sensor failure is raised on the time packets have been invalid, whatever their rate
+	invalid := func(from time.Time, interval time.Duration) time.Time {
+		t.Helper()
+		at := from
+		for ; at.Sub(from) < limits.SensorFailureTime; at = at.Add(interval) {
+			am.Update(ioman.DataPacket{Timestamp: at})
+			if _, ok := find(am.Alarms(), AlarmSensorFailure); ok {
+				t.Fatalf("Expected no sensor failure alarm after %v", at.Sub(from))
+			}
+		}
+		return at
+	}
+	at := invalid(rest.Timestamp, 10*time.Millisecond)
+	am.Update(packet(at, 10))
+	at = invalid(at.Add(time.Millisecond), time.Millisecond)
+	am.Update(ioman.DataPacket{Timestamp: at})
+	alarms := am.Alarms()
+	if _, ok := find(alarms, AlarmSensorFailure); !ok {
+		t.Fatalf("Expected sensor failure alarm")
+	}
+	if alarms[0].Priority != PriorityHigh || alarms[0].ID != AlarmApnea {
+		t.Fatalf("Expected oldest high priority alarm first, got %+v", alarms[0])
+	}
+}
@@ -0,0 +1,376 @@
+package climan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/alarmman"
+	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+const _clearScreen = "\x1b[H\x1b[2J" //Cursor home and erase display
+const _sparkLevels = "_.-~^"         //Lowest to highest
+const _sparkGap = ' '                //No valid samples
+const _logLines = 5                  //Recent log entries shown
+
+//EnumStyle is how the monitor writes to its terminal
+type EnumStyle int
+
+func (e EnumStyle) String() string {
+	switch int(e) {
+	case 0:
+		return "Terminal"
+	case 1:
+		return "Plain"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//StyleTerminal redraws a full screen on every tick
+	StyleTerminal EnumStyle = iota
+	//StylePlain writes a line of key=value fields on every tick, for piping into other tools
+	StylePlain
+)
+
+//ParseStyle parses the name of an EnumStyle, case insensitive
+func ParseStyle(name string) (EnumStyle, error) {
+	for _, s := range []EnumStyle{StyleTerminal, StylePlain} {
+		if strings.EqualFold(name, s.String()) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown monitor style %v, expected terminal or plain", name)
+}
+
+//Source is the data a Monitor displays, implemented by ioman.IOMan
+type Source interface {
+	GetDataPacket() ioman.DataPacket
+	GetStats() ioman.Stats
+	History(from time.Time, to time.Time, decimation int) ([]ioman.HistoryBucket, error)
+}
+
+//Alarms is the alarm list a Monitor displays, implemented by alarmman.AlarmMan
+type Alarms interface {
+	Alarms() []alarmman.Alarm
+}
+
+//Log is the recent log a Monitor displays, implemented by logman.RingSink
+type Log interface {
+	Entries(n int) []logman.Entry
+}
+
+//Config ..
+type Config struct {
+	Style      EnumStyle
+	Window     time.Duration //Duration of flow shown in the sparkline
+	Width      int           //Characters of the sparkline
+	SampleRate time.Duration //Period of the io loop, so that History aggregates each column of the sparkline
+}
+
+//DefaultConfig ..
+func DefaultConfig() Config {
+	return Config{
+		Style:      StyleTerminal,
+		Window:     10 * time.Second,
+		Width:      60,
+		SampleRate: ioman.DefaultHardwareConfig().SampleRate,
+	}
+}
+
+//Validate ..
+func (c Config) Validate() error {
+	if c.Style != StyleTerminal && c.Style != StylePlain {
+		return fmt.Errorf("Unknown monitor style %v", int(c.Style))
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("Sparkline window must be positive, got %v", c.Window)
+	}
+	if c.Width < 1 {
+		return fmt.Errorf("Sparkline width must be at least 1, got %v", c.Width)
+	}
+	if c.SampleRate <= 0 {
+		return fmt.Errorf("Sample rate must be positive, got %v", c.SampleRate)
+	}
+	return nil
+}
+
+//Monitor is a headless live view of the ventilator on a terminal
+type Monitor struct {
+	config Config
+	out    io.Writer
+	source Source
+	alarms Alarms
+	log    Log
+}
+
+//NewMonitor ..
+func NewMonitor(config Config, out io.Writer, source Source, alarms Alarms) (*Monitor, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid monitor config: %w", err)
+	}
+	return &Monitor{
+		config: config,
+		out:    out,
+		source: source,
+		alarms: alarms,
+	}, nil
+}
+
+//SetLog shows the most recent entries of log in the terminal style. Must be called before Run
+func (m *Monitor) SetLog(log Log) {
+	m.log = log
+}
+
+//Run writes the monitor on every tick, until ctx is cancelled, the ticker is closed or a write fails
+func (m *Monitor) Run(ctx context.Context, ticker <-chan time.Time) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-ticker:
+			if !ok {
+				return nil
+			}
+		}
+		_, err := io.WriteString(m.out, m.Frame())
+		if err != nil {
+			return fmt.Errorf("Failed to write monitor: %w", err)
+		}
+	}
+}
+
+//Frame renders the current data in the configured style
+func (m *Monitor) Frame() string {
+	dp := m.source.GetDataPacket()
+	stats := m.source.GetStats()
+	alarms := m.alarms.Alarms()
+
+	if m.config.Style == StylePlain {
+		return plain(dp, stats, alarms)
+	}
+	return _clearScreen + m.terminal(dp, stats, alarms)
+}
+
+func (m *Monitor) terminal(dp ioman.DataPacket, stats ioman.Stats, alarms []alarmman.Alarm) string {
+	b := strings.Builder{}
+	s := dp.Sensors
+	br := dp.Calculated.Breath
+
+	fmt.Fprintf(&b, "gogles %v\n\n", dp.Timestamp.Format("2006-01-02 15:04:05.000"))
+	if !dp.Valid {
+		fmt.Fprintf(&b, "DATA INVALID\n")
+	}
+	fmt.Fprintf(&b, "State   %v\n", dp.State)
+	fmt.Fprintf(&b, "Flow    %.1f SLM   Paw %v cmH2O   O2 %v %%   Supply %v kPa\n",
+		s.Flow.Val, measurement(s.AirwayPressure), measurement(s.Oxygen), measurement(s.SupplyPressure))
+
+	spark, min, max := m.sparkline(dp.Timestamp)
+	fmt.Fprintf(&b, "        [%v] %.1f to %.1f SLM over %v\n\n", spark, min, max, m.config.Window)
+
+	if br.Number == 0 {
+		fmt.Fprintf(&b, "Breath  ---\n")
+	} else {
+		fmt.Fprintf(&b, "Breath  #%v %v   Vti %.3f L   Vte %.3f L   Leak %.3f L\n",
+			br.Number, br.Type, br.InspiredVolume, br.ExpiredVolume, br.Leak)
+		fmt.Fprintf(&b, "        Rate %.1f bpm   I:E 1:%.1f   Ti %v   PIF %.1f SLM   PIP %.1f   PEEP %.1f cmH2O   MV %.2f L/min\n",
+			br.Rate, br.IERatio, br.InspiratoryTime, br.PeakInspiratoryFlow, br.PeakPressure, br.PEEP, br.MinuteVentilation)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	if len(alarms) == 0 {
+		fmt.Fprintf(&b, "Alarms  none\n")
+	}
+	for i, a := range alarms {
+		label := "        "
+		if i == 0 {
+			label = "Alarms  "
+		}
+		fmt.Fprintf(&b, "%v%v\n", label, alarm(a))
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "IO      %.0f Hz   loops %v   failed %v   overruns %v   jitter %v\n",
+		stats.ReadRate, stats.Loops, stats.FailedReads, stats.Overruns, stats.Jitter)
+	type bus struct {
+		name  string
+		stats ioman.BusStats
+	}
+	buses := []bus{}
+	for i, f := range stats.Flows {
+		name := fmt.Sprintf("flow%v", i)
+		if i < len(dp.Sensors.Flows) && dp.Sensors.Flows[i].Label != "" {
+			name = dp.Sensors.Flows[i].Label
+		}
+		buses = append(buses, bus{name, f})
+	}
+	buses = append(buses, bus{"adc", stats.ADC}, bus{"dac", stats.DAC})
+	for _, bus := range buses {
+		fmt.Fprintf(&b, "        %-5v ok %v   failed %v   consecutive %v   %.1f failures/s   max latency %v\n",
+			bus.name, bus.stats.Ok, bus.stats.Failed, bus.stats.Consecutive, bus.stats.FailureRate, bus.stats.MaxLatency)
+	}
+
+	if m.log != nil {
+		fmt.Fprintf(&b, "\n")
+		for _, e := range m.log.Entries(_logLines) {
+			fmt.Fprintf(&b, "%v\n", e.Format(logman.FormatText))
+		}
+	}
+
+	return b.String()
+}
+
+// sparkline renders the mean flow of the window up to now, one character per column, and the range it is scaled to.
+// History is decimated to no more than a column of samples per bucket, so each column is one or two buckets.
+func (m *Monitor) sparkline(now time.Time) (string, float64, float64) {
+	buckets, err := m.source.History(now.Add(-m.config.Window), now, m.decimation())
+	if err != nil {
+		buckets = nil //History is disabled, the sparkline is left empty
+	}
+
+	sums := make([]float64, m.config.Width)
+	counts := make([]int, m.config.Width)
+	start := now.Add(-m.config.Window)
+	for _, b := range buckets {
+		if b.Flow.Count == 0 {
+			continue
+		}
+		column := int(int64(b.Start.Sub(start)) * int64(m.config.Width) / int64(m.config.Window))
+		if column < 0 || column >= m.config.Width {
+			continue
+		}
+		sums[column] += b.Flow.Mean * float64(b.Flow.Count)
+		counts[column] += b.Flow.Count
+	}
+
+	return spark(sums, counts)
+}
+
+// decimation returns the samples of a column of the sparkline, rounded down
+func (m *Monitor) decimation() int {
+	d := int(m.config.Window / (m.config.SampleRate * time.Duration(m.config.Width)))
+	if d < 1 {
+		return 1
+	}
+	return d
+}
+
+// spark renders the means of columns of sums over counts scaled between their minimum and maximum
+func spark(sums []float64, counts []int) (string, float64, float64) {
+	min, max := 0.0, 0.0
+	first := true
+	for i := range sums {
+		if counts[i] == 0 {
+			continue
+		}
+		mean := sums[i] / float64(counts[i])
+		if first || mean < min {
+			min = mean
+		}
+		if first || mean > max {
+			max = mean
+		}
+		first = false
+	}
+
+	line := make([]byte, len(sums))
+	for i := range sums {
+		if counts[i] == 0 {
+			line[i] = _sparkGap
+			continue
+		}
+		level := 0
+		if max > min {
+			level = int((sums[i]/float64(counts[i])-min)/(max-min)*float64(len(_sparkLevels)-1) + 0.5)
+		}
+		line[i] = _sparkLevels[level]
+	}
+	return string(line), min, max
+}
+
+// plain renders a single line of space separated key=value fields, with - for values that are not available
+func plain(dp ioman.DataPacket, stats ioman.Stats, alarms []alarmman.Alarm) string {
+	s := dp.Sensors
+	br := dp.Calculated.Breath
+
+	ids := []string{}
+	for _, a := range alarms {
+		ids = append(ids, token(a.ID.String()))
+	}
+	alarmList := "-"
+	if len(ids) > 0 {
+		alarmList = strings.Join(ids, ",")
+	}
+
+	fields := []string{
+		fmt.Sprintf("time=%v", dp.Timestamp.Format(time.RFC3339Nano)),
+		fmt.Sprintf("valid=%v", dp.Valid),
+		fmt.Sprintf("state=%v", token(dp.State.String())),
+		fmt.Sprintf("flow=%.2f", s.Flow.Val),
+		fmt.Sprintf("paw=%v", plainMeasurement(s.AirwayPressure)),
+		fmt.Sprintf("o2=%v", plainMeasurement(s.Oxygen)),
+		fmt.Sprintf("supply=%v", plainMeasurement(s.SupplyPressure)),
+		fmt.Sprintf("breath=%v", br.Number),
+		fmt.Sprintf("breath_type=%v", token(br.Type.String())),
+		fmt.Sprintf("vti=%.3f", br.InspiredVolume),
+		fmt.Sprintf("vte=%.3f", br.ExpiredVolume),
+		fmt.Sprintf("leak=%.3f", br.Leak),
+		fmt.Sprintf("rate=%.1f", br.Rate),
+		fmt.Sprintf("ie=%.2f", br.IERatio),
+		fmt.Sprintf("pif=%.1f", br.PeakInspiratoryFlow),
+		fmt.Sprintf("pip=%.1f", br.PeakPressure),
+		fmt.Sprintf("peep=%.1f", br.PEEP),
+		fmt.Sprintf("mv=%.2f", br.MinuteVentilation),
+		fmt.Sprintf("alarms=%v", alarmList),
+		fmt.Sprintf("read_rate=%.0f", stats.ReadRate),
+		fmt.Sprintf("loops=%v", stats.Loops),
+		fmt.Sprintf("failed_reads=%v", stats.FailedReads),
+		fmt.Sprintf("overruns=%v", stats.Overruns),
+		fmt.Sprintf("jitter=%v", stats.Jitter),
+	}
+	return strings.Join(fields, " ") + "\n"
+}
+
+// token removes the spaces of a name, so it stays a single field of a plain line
+func token(name string) string {
+	return strings.ReplaceAll(name, " ", "")
+}
+
+func measurement(m ioman.Measurement) string {
+	if !m.Valid {
+		return "---"
+	}
+	return fmt.Sprintf("%.1f", m.Val)
+}
+
+func plainMeasurement(m ioman.Measurement) string {
+	if !m.Valid {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", m.Val)
+}
+
+func alarm(a alarmman.Alarm) string {
+	marker := "!"
+	switch a.Priority {
+	case alarmman.PriorityHigh:
+		marker = "!!!"
+	case alarmman.PriorityMedium:
+		marker = "!!"
+	}
+
+	text := fmt.Sprintf("%-3v %v: %v", marker, a.ID, a.Message)
+	if a.Latched {
+		text = fmt.Sprintf("%-3v %v (latched)", marker, a.ID)
+	}
+	if a.Acknowledged {
+		text += " (ACK)"
+	}
+	return text
+}
@@ -0,0 +1,190 @@
+package climan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/alarmman"
+	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+type fakeSource struct {
+	dp         ioman.DataPacket
+	buckets    []ioman.HistoryBucket
+	err        error
+	decimation int //of the last History query
+}
+
+func (f *fakeSource) GetDataPacket() ioman.DataPacket { return f.dp }
+func (f *fakeSource) GetStats() ioman.Stats           { return f.dp.Stats }
+func (f *fakeSource) History(from time.Time, to time.Time, decimation int) ([]ioman.HistoryBucket, error) {
+	f.decimation = decimation
+	return f.buckets, f.err
+}
+
+type fakeAlarms []alarmman.Alarm
+
+func (f fakeAlarms) Alarms() []alarmman.Alarm { return f }
+
+// source returns a DataPacket at now, with a history of one second of rising flow followed by a gap
+func source(now time.Time) *fakeSource {
+	dp := ioman.DataPacket{
+		Valid:     true,
+		Timestamp: now,
+		State:     ioman.StateBreathingIn,
+	}
+	dp.Sensors.Flow.Val = 12.5
+	dp.Sensors.AirwayPressure = ioman.Measurement{Val: 15, Valid: true}
+	dp.Calculated.Breath = ioman.Breath{Number: 7, Type: ioman.BreathSpontaneous, InspiredVolume: 0.45, ExpiredVolume: 0.44, Rate: 15}
+	dp.Sensors.Flows = []ioman.Flow{{Label: "PROX"}, {Label: "EXP"}}
+	dp.Stats = ioman.Stats{Loops: 1000, ReadRate: 998, Overruns: 2, Flows: []ioman.BusStats{{Ok: 1000}, {Ok: 990, Failed: 10, Consecutive: 10}}}
+
+	buckets := []ioman.HistoryBucket{}
+	for i := 0; i < 5; i++ {
+		b := ioman.HistoryBucket{Start: now.Add(-time.Second + time.Duration(i)*200*time.Millisecond)}
+		b.Flow = ioman.Aggregate{Mean: float64(i * 10), Count: 1}
+		buckets = append(buckets, b)
+	}
+	return &fakeSource{dp: dp, buckets: buckets}
+}
+
+func TestSpark(t *testing.T) {
+	line, min, max := spark([]float64{-10, 0, 20, 0, 30}, []int{1, 0, 2, 1, 1})
+	if line != "_ -.^" || min != -10 || max != 30 {
+		t.Fatalf("Expected _ -.^ between -10 and 30, got %q between %v and %v", line, min, max)
+	}
+
+	line, _, _ = spark([]float64{5, 5}, []int{1, 1})
+	if line != "__" {
+		t.Fatalf("Expected a flat line for constant flow, got %q", line)
+	}
+}
+
+func TestMonitorTerminal(t *testing.T) {
+	now := time.Unix(1000, 0)
+	config := DefaultConfig()
+	config.Window = time.Second
+	config.Width = 5
+	alarms := fakeAlarms{{ID: alarmman.AlarmHighPressure, Priority: alarmman.PriorityHigh, Active: true, Message: "Paw 45 cmH2O"}}
+
+	src := source(now)
+	m, err := NewMonitor(config, &bytes.Buffer{}, src, alarms)
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %v", err)
+	}
+	ring := logman.NewRingSink(10)
+	for i := 0; i < 8; i++ {
+		_ = ring.Write(logman.Entry{Time: now, Level: logman.LevelWarn, Owner: "ioman:recovery", Message: fmt.Sprintf("entry %v", i)})
+	}
+	m.SetLog(ring)
+	frame := m.Frame()
+
+	if !strings.HasPrefix(frame, _clearScreen) {
+		t.Fatalf("Expected the terminal to be cleared before each frame")
+	}
+	for _, expected := range []string{
+		"State   Breathing In",
+		"Flow    12.5 SLM   Paw 15.0 cmH2O   O2 --- %",
+		"[_.-~^] 0.0 to 40.0 SLM over 1s",
+		"Breath  #7 Spontaneous   Vti 0.450 L   Vte 0.440 L",
+		fmt.Sprintf("Alarms  !!! %v: Paw 45 cmH2O", alarmman.AlarmHighPressure),
+		"IO      998 Hz   loops 1000   failed 0   overruns 2",
+		"        PROX  ok 1000   failed 0   consecutive 0",
+		"        EXP   ok 990   failed 10   consecutive 10",
+		"        adc   ok 0",
+		"WARN  [ioman:recovery] entry 7",
+	} {
+		if !strings.Contains(frame, expected) {
+			t.Fatalf("Expected frame to contain %q, got\n%v", expected, frame)
+		}
+	}
+	// Each column of the sparkline is aggregated by History
+	if expected := int(config.Window / config.SampleRate / time.Duration(config.Width)); src.decimation != expected {
+		t.Fatalf("Expected History decimated to %v samples per column, got %v", expected, src.decimation)
+	}
+	if strings.Contains(frame, "entry 2") {
+		t.Fatalf("Expected only the last %v log entries, got\n%v", _logLines, frame)
+	}
+
+	// Without history the sparkline is blank rather than failing
+	s := source(now)
+	s.err = fmt.Errorf("History is disabled")
+	m, _ = NewMonitor(config, &bytes.Buffer{}, s, fakeAlarms{})
+	frame = m.Frame()
+	if !strings.Contains(frame, "[     ]") || !strings.Contains(frame, "Alarms  none") {
+		t.Fatalf("Expected an empty sparkline and no alarms, got\n%v", frame)
+	}
+}
+
+func TestMonitorPlain(t *testing.T) {
+	now := time.Unix(1000, 0)
+	config := DefaultConfig()
+	config.Style = StylePlain
+	alarms := fakeAlarms{{ID: alarmman.AlarmHighPressure}, {ID: alarmman.AlarmApnea}}
+
+	out := &bytes.Buffer{}
+	m, err := NewMonitor(config, out, source(now), alarms)
+	if err != nil {
+		t.Fatalf("Failed to create monitor: %v", err)
+	}
+
+	// A line per tick, until the ticker is closed
+	ticker := make(chan time.Time, 2)
+	ticker <- now
+	ticker <- now
+	close(ticker)
+	err = m.Run(context.Background(), ticker)
+	if err != nil {
+		t.Fatalf("Failed to run monitor: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 || strings.Contains(out.String(), "\x1b") {
+		t.Fatalf("Expected two plain lines, got %q", out.String())
+	}
+	fields := map[string]string{}
+	for _, f := range strings.Fields(lines[0]) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			t.Fatalf("Expected key=value fields, got %q", f)
+		}
+		fields[kv[0]] = kv[1]
+	}
+	for k, v := range map[string]string{
+		"state":  "BreathingIn",
+		"flow":   "12.50",
+		"paw":    "15.00",
+		"o2":     "-",
+		"breath": "7",
+		"vti":    "0.450",
+		"alarms": "HighPressure,Apnea",
+		"loops":  "1000",
+	} {
+		if fields[k] != v {
+			t.Fatalf("Expected %v=%v, got %q in %v", k, v, fields[k], lines[0])
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if DefaultConfig().Validate() != nil {
+		t.Fatalf("Expected default config to be valid")
+	}
+	config := DefaultConfig()
+	config.Width = 0
+	if config.Validate() == nil {
+		t.Fatalf("Expected zero width to be invalid")
+	}
+	style, err := ParseStyle("plain")
+	if err != nil || style != StylePlain {
+		t.Fatalf("Expected plain style, got %v %v", style, err)
+	}
+	if _, err := ParseStyle("fancy"); err == nil {
+		t.Fatalf("Expected unknown style to be rejected")
+	}
+}
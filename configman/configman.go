@@ -0,0 +1,664 @@
+package configman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/alarmman"
+	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
+	"periph.io/x/periph/conn/physic"
+)
+
+//Duration is a time.Duration written in configuration files as a string, such as "100ms"
+type Duration time.Duration
+
+//MarshalJSON ..
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//UnmarshalJSON ..
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("Duration must be a string such as \"100ms\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+//Config is the runtime configuration of a rig. Sections missing from a configuration file keep their defaults.
+type Config struct {
+	Hardware   Hardware  `json:"hardware"`
+	Display    Display   `json:"display"`
+	History    Duration  `json:"history"` //Duration of samples kept for trends and export
+	Breath     Breath    `json:"breath"`
+	FlowFilter string    `json:"flow_filter"` //Filter chain in the form of ioman.ParseFilters
+	Channels   []Channel `json:"channels"`
+	Trigger    Trigger   `json:"trigger"`
+	Mode       Mode      `json:"mode"`
+	Alarms     Alarms    `json:"alarms"`
+	Sim        Sim       `json:"sim"`
+	Record     Record    `json:"record"`
+	Log        Log       `json:"log"`
+}
+
+//Hardware ..
+type Hardware struct {
+	SampleRate Duration     `json:"sample_rate"`
+	Flows      []FlowSensor `json:"flows"`
+	ADCBus     string       `json:"adc_bus"`
+	DACBus     string       `json:"dac_bus"`
+	SPISpeed   int64        `json:"spi_speed_hz"`
+}
+
+//FlowSensor is an SFM3000 on an I2C bus, optionally behind a TCA9548A multiplexer
+type FlowSensor struct {
+	Label      string `json:"label"`
+	Bus        string `json:"bus"`
+	Address    uint8  `json:"address"`
+	Mux        uint8  `json:"mux,omitempty"` //Multiplexer address, omitted if connected directly
+	MuxChannel uint8  `json:"mux_channel,omitempty"`
+	IsAir      bool   `json:"is_air"`
+	Role       string `json:"role"` //Proximal, inspiratory or expiratory
+}
+
+//Display ..
+type Display struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+//Breath ..
+type Breath struct {
+	InFlowThreshold  float64  `json:"in_flow_threshold"`
+	OutFlowThreshold float64  `json:"out_flow_threshold"`
+	Hysteresis       float64  `json:"hysteresis"`
+	MinDwell         Duration `json:"min_dwell"`
+}
+
+//Channel maps an ADC channel to a quantity
+type Channel struct {
+	Channel      int       `json:"channel"`
+	Quantity     string    `json:"quantity"`
+	Coefficients []float64 `json:"coefficients"` //Calibration polynomial, lowest order first
+	Filter       string    `json:"filter,omitempty"`
+}
+
+//Trigger ..
+type Trigger struct {
+	Source      string   `json:"source"`
+	Sensitivity float64  `json:"sensitivity"`
+	Refractory  Duration `json:"refractory"`
+}
+
+//Mode is the ventilation mode started with
+type Mode struct {
+	Name                string   `json:"name"`
+	Rate                float64  `json:"rate"`
+	InspiratoryTime     Duration `json:"inspiratory_time"`
+	InspiratoryPressure float64  `json:"inspiratory_pressure"`
+	TidalVolume         float64  `json:"tidal_volume"`
+	PEEP                float64  `json:"peep"`
+	PressureSupport     float64  `json:"pressure_support"`
+	CycleOff            float64  `json:"cycle_off"`
+	PressureGains       Gains    `json:"pressure_gains"`
+	FlowGains           Gains    `json:"flow_gains"`
+}
+
+//Gains ..
+type Gains struct {
+	Kp float64 `json:"kp"`
+	Ki float64 `json:"ki"`
+	Kd float64 `json:"kd"`
+}
+
+//Alarms ..
+type Alarms struct {
+	HighPressure          float64  `json:"high_pressure"`
+	LowPressure           float64  `json:"low_pressure"`
+	LowTidalVolume        float64  `json:"low_tidal_volume"`
+	ApneaTimeout          Duration `json:"apnea_timeout"`
+	HighRate              float64  `json:"high_rate"`
+	SensorFailureTime     Duration `json:"sensor_failure_time"`
+	DisconnectionPressure float64  `json:"disconnection_pressure"`
+	DisconnectionTime     Duration `json:"disconnection_time"`
+	AudioPause            Duration `json:"audio_pause"`
+	Escalation            Duration `json:"escalation"`
+}
+
+//Sim is the simulated patient used with -sim
+type Sim struct {
+	Compliance     float64 `json:"compliance"`
+	Resistance     float64 `json:"resistance"`
+	Rate           float64 `json:"rate"`
+	IERatio        float64 `json:"ie_ratio"`
+	Effort         float64 `json:"effort"`
+	PEEP           float64 `json:"peep"`
+	SupplyPressure float64 `json:"supply_pressure"`
+	Oxygen         float64 `json:"oxygen"`
+	Supply         float64 `json:"supply"`
+	Noise          float64 `json:"noise"`
+	Seed           int64   `json:"seed"`
+}
+
+//Record configures session recording, disabled while Directory is empty
+type Record struct {
+	Directory string `json:"directory"`
+	MaxSize   int64  `json:"max_size_mb"`
+	MaxFiles  int    `json:"max_files"`
+}
+
+//Log configures logging. Levels are debug, info, warn or error.
+type Log struct {
+	Level      string            `json:"level"`
+	Subsystems map[string]string `json:"subsystems,omitempty"` //Levels by subsystem, such as "ioman:controller": "debug"
+	Format     string            `json:"format"`               //Text or json, of stderr and files
+	RateLimit  Duration          `json:"rate_limit"`           //Minimum interval between entries of hot paths
+	Stderr     bool              `json:"stderr"`
+	Directory  string            `json:"directory"` //Rotating log files, disabled while empty
+	MaxSize    int64             `json:"max_size_mb"`
+	MaxFiles   int               `json:"max_files"`
+	Ring       int               `json:"ring"` //Entries kept for display on screen, 0 to disable
+}
+
+//Default returns the configuration of the Raspberry Pi rig
+func Default() Config {
+	hardware := ioman.DefaultHardwareConfig()
+	breath := ioman.DefaultBreathConfig()
+	trigger := ioman.DefaultTriggerConfig()
+	mode := ioman.DefaultModeConfig()
+	limits := alarmman.DefaultLimits()
+	sim := ioman.DefaultSimConfig()
+	log := logman.DefaultConfig()
+
+	channels := []Channel{}
+	for _, c := range ioman.DefaultChannelMap() {
+		channels = append(channels, Channel{
+			Channel:      c.Channel,
+			Quantity:     strings.ToLower(c.Quantity.String()),
+			Coefficients: c.Calibration.Coefficients,
+			Filter:       ioman.FormatFilters(c.Filters),
+		})
+	}
+
+	flows := []FlowSensor{}
+	for _, f := range hardware.Flows {
+		flows = append(flows, FlowSensor{
+			Label:      f.Label,
+			Bus:        f.Bus,
+			Address:    f.Address,
+			Mux:        f.Mux,
+			MuxChannel: f.MuxChannel,
+			IsAir:      f.IsAir,
+			Role:       strings.ToLower(f.Role.String()),
+		})
+	}
+
+	return Config{
+		Hardware: Hardware{
+			SampleRate: Duration(hardware.SampleRate),
+			Flows:      flows,
+			ADCBus:     hardware.ADCBus,
+			DACBus:     hardware.DACBus,
+			SPISpeed:   int64(hardware.SPISpeed / physic.Hertz),
+		},
+		Display: Display{
+			Width:  800,
+			Height: 480,
+		},
+		History: Duration(ioman.DefaultHistory()),
+		Breath: Breath{
+			InFlowThreshold:  breath.InFlowThreshold,
+			OutFlowThreshold: breath.OutFlowThreshold,
+			Hysteresis:       breath.Hysteresis,
+			MinDwell:         Duration(breath.MinDwell),
+		},
+		FlowFilter: ioman.FormatFilters(ioman.DefaultFlowFilters()),
+		Channels:   channels,
+		Trigger: Trigger{
+			Source:      strings.ToLower(trigger.Source.String()),
+			Sensitivity: trigger.Sensitivity,
+			Refractory:  Duration(trigger.Refractory),
+		},
+		Mode: Mode{
+			Name:                "standby",
+			Rate:                mode.Rate,
+			InspiratoryTime:     Duration(mode.InspiratoryTime),
+			InspiratoryPressure: mode.InspiratoryPressure,
+			TidalVolume:         mode.TidalVolume,
+			PEEP:                mode.PEEP,
+			PressureSupport:     mode.PressureSupport,
+			CycleOff:            mode.CycleOff,
+			PressureGains:       Gains{Kp: mode.PressureGains.Kp, Ki: mode.PressureGains.Ki, Kd: mode.PressureGains.Kd},
+			FlowGains:           Gains{Kp: mode.FlowGains.Kp, Ki: mode.FlowGains.Ki, Kd: mode.FlowGains.Kd},
+		},
+		Alarms: Alarms{
+			HighPressure:          limits.HighPressure,
+			LowPressure:           limits.LowPressure,
+			LowTidalVolume:        limits.LowTidalVolume,
+			ApneaTimeout:          Duration(limits.ApneaTimeout),
+			HighRate:              limits.HighRate,
+			SensorFailureTime:     Duration(limits.SensorFailureTime),
+			DisconnectionPressure: limits.DisconnectionPressure,
+			DisconnectionTime:     Duration(limits.DisconnectionTime),
+			AudioPause:            Duration(limits.AudioPause),
+			Escalation:            Duration(limits.Escalation),
+		},
+		Sim: Sim{
+			Compliance:     sim.Compliance,
+			Resistance:     sim.Resistance,
+			Rate:           sim.Rate,
+			IERatio:        sim.IERatio,
+			Effort:         sim.Effort,
+			PEEP:           sim.PEEP,
+			SupplyPressure: sim.SupplyPressure,
+			Oxygen:         sim.Oxygen,
+			Supply:         sim.Supply,
+			Noise:          sim.Noise,
+			Seed:           sim.Seed,
+		},
+		Record: Record{
+			MaxSize: 64,
+		},
+		Log: Log{
+			Level:     strings.ToLower(log.Level.String()),
+			Format:    strings.ToLower(log.Format.String()),
+			RateLimit: Duration(log.RateLimit),
+			Stderr:    log.Stderr,
+			MaxSize:   log.File.MaxFileSize / 1024 / 1024,
+			MaxFiles:  log.File.MaxFiles,
+			Ring:      log.Ring,
+		},
+	}
+}
+
+//Load reads a JSON configuration file over the defaults. Unknown keys are rejected, the result is not validated.
+func Load(path string) (Config, error) {
+	c := Default()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return c, fmt.Errorf("Failed to open config %v: %w", path, err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&c)
+	if err != nil {
+		return c, fmt.Errorf("Failed to parse config %v: %w", path, err)
+	}
+
+	logman.Infof("configman", "Loaded config from %v", path)
+	return c, nil
+}
+
+//Write writes the configuration as indented JSON, in the form read by Load
+func (c Config) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode config: %w", err)
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+//Set sets the field at key, the dot separated path of JSON names and list indexes such as hardware.flows.0.bus,
+//to value. Values of string fields are taken as is, others are parsed as JSON where valid.
+func (c *Config) Set(key string, value string) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("Failed to encode config: %w", err)
+	}
+	var tree interface{}
+	err = json.Unmarshal(b, &tree)
+	if err != nil {
+		return fmt.Errorf("Failed to decode config: %w", err)
+	}
+
+	tree, err = set(tree, strings.Split(key, "."), value)
+	if err != nil {
+		return fmt.Errorf("Failed to set %v: %w", key, err)
+	}
+
+	b, err = json.Marshal(tree)
+	if err != nil {
+		return fmt.Errorf("Failed to encode config: %w", err)
+	}
+	updated := Config{}
+	decoder := json.NewDecoder(strings.NewReader(string(b)))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&updated)
+	if err != nil {
+		return fmt.Errorf("Failed to set %v to %v: %w", key, value, err)
+	}
+	*c = updated
+	return nil
+}
+
+// set returns node with the field at path set to value
+func set(node interface{}, path []string, value string) (interface{}, error) {
+	if len(path) == 0 {
+		if _, ok := node.(string); ok {
+			return value, nil
+		}
+		var v interface{}
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			//Fields omitted when empty may be strings, others fail to decode
+			return value, nil
+		}
+		return v, nil
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		//Fields omitted when empty are created, unknown fields are rejected when decoded
+		child, err := set(n[path[0]], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = child
+		return n, nil
+	case []interface{}:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, fmt.Errorf("No index %v in list of %v", path[0], len(n))
+		}
+		n[i], err = set(n[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case nil:
+		//A section omitted when empty, such as a map
+		return set(map[string]interface{}{}, path, value)
+	default:
+		return nil, fmt.Errorf("%v is not a section", path[0])
+	}
+}
+
+//Validate checks every section of the configuration
+func (c Config) Validate() error {
+	hardware, err := c.HardwareConfig()
+	if err != nil {
+		return err
+	}
+	err = hardware.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid hardware: %w", err)
+	}
+
+	if c.Display.Width <= 0 || c.Display.Height <= 0 {
+		return fmt.Errorf("Invalid display: size must be positive, got %vx%v", c.Display.Width, c.Display.Height)
+	}
+
+	err = ioman.ValidateHistory(time.Duration(c.History), hardware.SampleRate)
+	if err != nil {
+		return fmt.Errorf("Invalid history: %w", err)
+	}
+
+	err = c.BreathConfig().Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid breath detection: %w", err)
+	}
+
+	filters, err := c.FlowFilters()
+	if err != nil {
+		return err
+	}
+	err = ioman.ValidateFilters(filters, hardware.SampleRate)
+	if err != nil {
+		return fmt.Errorf("Invalid flow filter: %w", err)
+	}
+
+	channels, err := c.ChannelMap()
+	if err != nil {
+		return err
+	}
+	err = ioman.ValidateChannelMap(channels, hardware.SampleRate)
+	if err != nil {
+		return fmt.Errorf("Invalid channel map: %w", err)
+	}
+
+	trigger, err := c.TriggerConfig()
+	if err != nil {
+		return err
+	}
+	err = trigger.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid trigger: %w", err)
+	}
+
+	_, err = ioman.NewMode(c.Mode.Name, c.ModeConfig())
+	if err != nil {
+		return fmt.Errorf("Invalid mode: %w", err)
+	}
+
+	_, err = alarmman.NewAlarmMan(c.Limits())
+	if err != nil {
+		return fmt.Errorf("Invalid alarms: %w", err)
+	}
+
+	err = c.SimConfig().Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid sim: %w", err)
+	}
+
+	if c.Record.MaxSize <= 0 || c.Record.MaxFiles < 0 {
+		return fmt.Errorf("Invalid record: max size must be positive and max files not negative, got %v and %v", c.Record.MaxSize, c.Record.MaxFiles)
+	}
+
+	log, err := c.LogConfig()
+	if err != nil {
+		return err
+	}
+	err = log.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid log: %w", err)
+	}
+
+	return nil
+}
+
+//HardwareConfig ..
+func (c Config) HardwareConfig() (ioman.HardwareConfig, error) {
+	flows := []ioman.FlowSensorConfig{}
+	for _, f := range c.Hardware.Flows {
+		role, err := ioman.ParseFlowRole(f.Role)
+		if err != nil {
+			return ioman.HardwareConfig{}, fmt.Errorf("Invalid hardware: %w", err)
+		}
+		flows = append(flows, ioman.FlowSensorConfig{
+			Label:      f.Label,
+			Bus:        f.Bus,
+			Address:    f.Address,
+			Mux:        f.Mux,
+			MuxChannel: f.MuxChannel,
+			IsAir:      f.IsAir,
+			Role:       role,
+		})
+	}
+
+	return ioman.HardwareConfig{
+		SampleRate: time.Duration(c.Hardware.SampleRate),
+		Flows:      flows,
+		ADCBus:     c.Hardware.ADCBus,
+		DACBus:     c.Hardware.DACBus,
+		SPISpeed:   physic.Frequency(c.Hardware.SPISpeed) * physic.Hertz,
+	}, nil
+}
+
+//BreathConfig ..
+func (c Config) BreathConfig() ioman.BreathConfig {
+	return ioman.BreathConfig{
+		InFlowThreshold:  c.Breath.InFlowThreshold,
+		OutFlowThreshold: c.Breath.OutFlowThreshold,
+		Hysteresis:       c.Breath.Hysteresis,
+		MinDwell:         time.Duration(c.Breath.MinDwell),
+	}
+}
+
+//FlowFilters ..
+func (c Config) FlowFilters() ([]ioman.FilterConfig, error) {
+	filters, err := ioman.ParseFilters(c.FlowFilter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid flow filter: %w", err)
+	}
+	return filters, nil
+}
+
+//ChannelMap ..
+func (c Config) ChannelMap() ([]ioman.ChannelConfig, error) {
+	channels := []ioman.ChannelConfig{}
+	for _, ch := range c.Channels {
+		quantity, err := ioman.ParseQuantity(ch.Quantity)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid channel %v: %w", ch.Channel, err)
+		}
+		var filters []ioman.FilterConfig
+		if ch.Filter != "" {
+			filters, err = ioman.ParseFilters(ch.Filter)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid channel %v filter: %w", ch.Channel, err)
+			}
+		}
+		channels = append(channels, ioman.ChannelConfig{
+			Channel:     ch.Channel,
+			Quantity:    quantity,
+			Calibration: ioman.Calibration{Coefficients: ch.Coefficients},
+			Filters:     filters,
+		})
+	}
+	return channels, nil
+}
+
+//TriggerConfig ..
+func (c Config) TriggerConfig() (ioman.TriggerConfig, error) {
+	source, err := ioman.ParseTriggerSource(c.Trigger.Source)
+	if err != nil {
+		return ioman.TriggerConfig{}, fmt.Errorf("Invalid trigger: %w", err)
+	}
+	return ioman.TriggerConfig{
+		Source:      source,
+		Sensitivity: c.Trigger.Sensitivity,
+		Refractory:  time.Duration(c.Trigger.Refractory),
+	}, nil
+}
+
+//ModeConfig ..
+func (c Config) ModeConfig() ioman.ModeConfig {
+	m := c.Mode
+	return ioman.ModeConfig{
+		Rate:                m.Rate,
+		InspiratoryTime:     time.Duration(m.InspiratoryTime),
+		InspiratoryPressure: m.InspiratoryPressure,
+		TidalVolume:         m.TidalVolume,
+		PEEP:                m.PEEP,
+		PressureSupport:     m.PressureSupport,
+		CycleOff:            m.CycleOff,
+		PressureGains:       ioman.PIDGains{Kp: m.PressureGains.Kp, Ki: m.PressureGains.Ki, Kd: m.PressureGains.Kd},
+		FlowGains:           ioman.PIDGains{Kp: m.FlowGains.Kp, Ki: m.FlowGains.Ki, Kd: m.FlowGains.Kd},
+	}
+}
+
+//Limits ..
+func (c Config) Limits() alarmman.Limits {
+	a := c.Alarms
+	return alarmman.Limits{
+		HighPressure:          a.HighPressure,
+		LowPressure:           a.LowPressure,
+		LowTidalVolume:        a.LowTidalVolume,
+		ApneaTimeout:          time.Duration(a.ApneaTimeout),
+		HighRate:              a.HighRate,
+		SensorFailureTime:     time.Duration(a.SensorFailureTime),
+		DisconnectionPressure: a.DisconnectionPressure,
+		DisconnectionTime:     time.Duration(a.DisconnectionTime),
+		AudioPause:            time.Duration(a.AudioPause),
+		Escalation:            time.Duration(a.Escalation),
+	}
+}
+
+//SimConfig returns the simulated patient, encoding flow for the gas of the configured flow sensor
+func (c Config) SimConfig() ioman.SimConfig {
+	s := c.Sim
+	return ioman.SimConfig{
+		Compliance:     s.Compliance,
+		Resistance:     s.Resistance,
+		Rate:           s.Rate,
+		IERatio:        s.IERatio,
+		Effort:         s.Effort,
+		PEEP:           s.PEEP,
+		SupplyPressure: s.SupplyPressure,
+		Oxygen:         s.Oxygen,
+		Supply:         s.Supply,
+		Noise:          s.Noise,
+		Seed:           s.Seed,
+		FlowIsAir:      c.proximalIsAir(),
+	}
+}
+
+// proximalIsAir returns the gas of the proximal flow sensor, which the sim and replay backends stand in for
+func (c Config) proximalIsAir() bool {
+	for _, f := range c.Hardware.Flows {
+		if strings.EqualFold(f.Role, ioman.RoleProximal.String()) {
+			return f.IsAir
+		}
+	}
+	return false
+}
+
+//RecorderConfig ..
+func (c Config) RecorderConfig() ioman.RecorderConfig {
+	return ioman.RecorderConfig{
+		Directory:   c.Record.Directory,
+		MaxFileSize: c.Record.MaxSize * 1024 * 1024,
+		MaxFiles:    c.Record.MaxFiles,
+	}
+}
+
+//LogConfig ..
+func (c Config) LogConfig() (logman.Config, error) {
+	l := c.Log
+	level, err := logman.ParseLevel(l.Level)
+	if err != nil {
+		return logman.Config{}, fmt.Errorf("Invalid log: %w", err)
+	}
+	format, err := logman.ParseFormat(l.Format)
+	if err != nil {
+		return logman.Config{}, fmt.Errorf("Invalid log: %w", err)
+	}
+	subsystems := map[string]logman.EnumLevel{}
+	for name, s := range l.Subsystems {
+		subsystems[name], err = logman.ParseLevel(s)
+		if err != nil {
+			return logman.Config{}, fmt.Errorf("Invalid log subsystem %v: %w", name, err)
+		}
+	}
+
+	return logman.Config{
+		Level:      level,
+		Subsystems: subsystems,
+		Format:     format,
+		RateLimit:  time.Duration(l.RateLimit),
+		Stderr:     l.Stderr,
+		File: logman.FileConfig{
+			Directory:   l.Directory,
+			MaxFileSize: l.MaxSize * 1024 * 1024,
+			MaxFiles:    l.MaxFiles,
+		},
+		Ring: l.Ring,
+	}, nil
+}
@@ -0,0 +1,206 @@
+package configman
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+// writeConfig writes contents to a config file in a temporary directory
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "configman")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestDefault(t *testing.T) {
+	c := Default()
+	err := c.Validate()
+	if err != nil {
+		t.Fatalf("Expected defaults to be valid, got %v", err)
+	}
+
+	// Defaults convert back to the ioman defaults
+	hardware, _ := c.HardwareConfig()
+	if !reflect.DeepEqual(hardware, ioman.DefaultHardwareConfig()) {
+		t.Fatalf("Expected default hardware %+v, got %+v", ioman.DefaultHardwareConfig(), hardware)
+	}
+	if c.BreathConfig() != ioman.DefaultBreathConfig() {
+		t.Fatalf("Expected default breath detection %+v, got %+v", ioman.DefaultBreathConfig(), c.BreathConfig())
+	}
+	channels, _ := c.ChannelMap()
+	if !reflect.DeepEqual(channels, ioman.DefaultChannelMap()) {
+		t.Fatalf("Expected default channel map %+v, got %+v", ioman.DefaultChannelMap(), channels)
+	}
+	filters, _ := c.FlowFilters()
+	if !reflect.DeepEqual(filters, ioman.DefaultFlowFilters()) {
+		t.Fatalf("Expected default flow filters %+v, got %+v", ioman.DefaultFlowFilters(), filters)
+	}
+	trigger, _ := c.TriggerConfig()
+	if trigger != ioman.DefaultTriggerConfig() {
+		t.Fatalf("Expected default trigger %+v, got %+v", ioman.DefaultTriggerConfig(), trigger)
+	}
+	log, _ := c.LogConfig()
+	expected := logman.DefaultConfig()
+	expected.Subsystems = map[string]logman.EnumLevel{}
+	if !reflect.DeepEqual(log, expected) {
+		t.Fatalf("Expected default log %+v, got %+v", expected, log)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	// Keys that are not set keep their defaults
+	c, err := Load(writeConfig(t, `{
+		"hardware": {"sample_rate": "2ms", "adc_bus": "/dev/spidev1.0"},
+		"flow_filter": "median:5ms,butterworth:20",
+		"alarms": {"apnea_timeout": "30s"},
+		"log": {"format": "json", "subsystems": {"ioman:controller": "debug"}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	err = c.Validate()
+	if err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	hardware, _ := c.HardwareConfig()
+	if hardware.SampleRate != 2*time.Millisecond || hardware.ADCBus != "/dev/spidev1.0" || hardware.DACBus != ioman.DefaultHardwareConfig().DACBus {
+		t.Fatalf("Unexpected hardware: %+v", hardware)
+	}
+	if c.Limits().ApneaTimeout != 30*time.Second || c.Limits().HighPressure != Default().Alarms.HighPressure {
+		t.Fatalf("Unexpected alarm limits: %+v", c.Limits())
+	}
+	log, _ := c.LogConfig()
+	if log.Format != logman.FormatJSON || log.Level != logman.LevelInfo || log.Subsystems["ioman:controller"] != logman.LevelDebug {
+		t.Fatalf("Unexpected log: %+v", log)
+	}
+	filters, _ := c.FlowFilters()
+	if len(filters) != 2 || filters[1].Type != ioman.FilterButterworth {
+		t.Fatalf("Unexpected flow filters: %+v", filters)
+	}
+
+	// Written configs load back unchanged
+	buf := bytes.Buffer{}
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	reloaded, err := Load(writeConfig(t, buf.String()))
+	if err != nil {
+		t.Fatalf("Failed to load written config: %v", err)
+	}
+	if !reflect.DeepEqual(c, reloaded) {
+		t.Fatalf("Expected written config to load back unchanged, got %+v", reloaded)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, contents := range []string{
+		`{"hardware": {"sample_rate": 1000}}`,
+		`{"hardware": {"sampel_rate": "1ms"}}`,
+		`{"hardware": `,
+	} {
+		if _, err := Load(writeConfig(t, contents)); err == nil {
+			t.Fatalf("Expected %v to fail to load", contents)
+		}
+	}
+
+	for _, contents := range []string{
+		`{"hardware": {"sample_rate": "0s"}}`,
+		`{"hardware": {"dac_bus": "/dev/spidev0.1"}}`,
+		`{"hardware": {"flows": [{"label": "FLOW1", "bus": "/dev/i2c-1", "address": 64, "role": "distal"}]}}`,
+		`{"hardware": {"flows": [{"label": "FLOW1", "bus": "/dev/i2c-1", "address": 64, "role": "inspiratory"}]}}`,
+		`{"breath": {"hysteresis": 10}}`,
+		`{"flow_filter": "ema:800"}`,
+		`{"channels": [{"channel": 0, "quantity": "humidity", "coefficients": [0, 1]}]}`,
+		`{"trigger": {"source": "effort"}}`,
+		`{"mode": {"name": "pcv", "rate": 0}}`,
+		`{"alarms": {"low_pressure": 50}}`,
+		`{"sim": {"compliance": 0}}`,
+		`{"display": {"width": 0}}`,
+		`{"log": {"level": "verbose"}}`,
+		`{"log": {"subsystems": {"ioman": "loud"}}}`,
+		`{"log": {"directory": "logs", "max_size_mb": 0}}`,
+	} {
+		c, err := Load(writeConfig(t, contents))
+		if err != nil {
+			t.Fatalf("Failed to load %v: %v", contents, err)
+		}
+		err = c.Validate()
+		if err == nil {
+			t.Fatalf("Expected %v to fail validation", contents)
+		}
+		if !strings.HasPrefix(err.Error(), "Invalid") {
+			t.Fatalf("Expected validation error to name the section, got %v", err)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := Default()
+	for key, value := range map[string]string{
+		"hardware.sample_rate":   "2ms",
+		"hardware.flows.0.bus":   "/dev/i2c-3",
+		"hardware.flows.0.mux":   "112",
+		"display.width":          "1024",
+		"mode.pressure_gains.kp": "2.5",
+		"log.subsystems.ioman":   "debug",
+	} {
+		err := c.Set(key, value)
+		if err != nil {
+			t.Fatalf("Failed to set %v to %v: %v", key, value, err)
+		}
+	}
+	err := c.Validate()
+	if err != nil {
+		t.Fatalf("Expected config to be valid, got %v", err)
+	}
+
+	hardware, _ := c.HardwareConfig()
+	if hardware.SampleRate != 2*time.Millisecond || hardware.Flows[0].Bus != "/dev/i2c-3" || hardware.Flows[0].Mux != 0x70 {
+		t.Fatalf("Unexpected hardware: %+v", hardware)
+	}
+	if c.Display.Width != 1024 || c.Mode.PressureGains.Kp != 2.5 {
+		t.Fatalf("Unexpected config: %+v", c)
+	}
+	log, _ := c.LogConfig()
+	if log.Subsystems["ioman"] != logman.LevelDebug {
+		t.Fatalf("Unexpected log: %+v", log)
+	}
+
+	// Unknown keys and values of the wrong type leave the config unchanged
+	for key, value := range map[string]string{
+		"hardware.sampel_rate": "1ms",
+		"hardware.flows.5.bus": "/dev/i2c-1",
+		"display.width.px":     "10",
+		"display.width":        "wide",
+		"hardware.address":     "64",
+	} {
+		before := c
+		if c.Set(key, value) == nil {
+			t.Fatalf("Expected setting %v to %v to fail", key, value)
+		}
+		if !reflect.DeepEqual(c, before) {
+			t.Fatalf("Expected failing to set %v to leave the config unchanged", key)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package ioman
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/conn/physic"
+
+	"github.com/kaelanfouwels/iodrivers/i2c/sfm3000"
+	"github.com/kaelanfouwels/iodrivers/spi/mcp3208"
+	"github.com/kaelanfouwels/iodrivers/spi/mcp4921"
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/conn/spi/spireg"
+
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+//Reopener is implemented by devices that can close and re-open their bus, to recover from faults a soft reset does not clear
+type Reopener interface {
+	Reopen() error
+}
+
+// closer closes the bus of a device
+type closer func() error
+
+//reopenableFlow is a FlowSensor on a bus that can be re-opened. Recovery swaps the device while the io loop may
+//still label its samples, so the device is guarded by mdevice and the label is fixed when the wrapper is built.
+type reopenableFlow struct {
+	label   string
+	open    func() (FlowSensor, closer, error)
+	mdevice sync.Mutex
+	device  FlowSensor
+	close   closer
+}
+
+func newReopenableFlow(label string, open func() (FlowSensor, closer, error)) *reopenableFlow {
+	return &reopenableFlow{label: label, open: open}
+}
+
+func (d *reopenableFlow) Label() string {
+	return d.label
+}
+
+func (d *reopenableFlow) SoftReset() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	return d.device.SoftReset()
+}
+
+func (d *reopenableFlow) GetSerial() (uint32, error) {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	return d.device.GetSerial()
+}
+
+func (d *reopenableFlow) GetRaw() (uint16, uint8, time.Time, error) {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	return d.device.GetRaw()
+}
+
+func (d *reopenableFlow) Reopen() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	if d.close != nil {
+		_ = d.close() //The bus is being replaced, a failure to close it is of no further consequence
+	}
+	dev, close, err := d.open()
+	if err != nil {
+		d.close = nil
+		return err
+	}
+	d.device, d.close = dev, close
+	return nil
+}
+
+//Close closes the bus of the device
+func (d *reopenableFlow) Close() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	if d.close == nil {
+		return nil
+	}
+	err := d.close()
+	d.close = nil
+	return err
+}
+
+//reopenableADC is an ADCReader on a bus that can be re-opened, guarded as reopenableFlow
+type reopenableADC struct {
+	label   string
+	open    func() (ADCReader, closer, error)
+	mdevice sync.Mutex
+	device  ADCReader
+	close   closer
+}
+
+func newReopenableADC(label string, open func() (ADCReader, closer, error)) *reopenableADC {
+	return &reopenableADC{label: label, open: open}
+}
+
+func (d *reopenableADC) Label() string {
+	return d.label
+}
+
+func (d *reopenableADC) GetValues(start int, count int) ([]uint16, time.Time, error) {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	return d.device.GetValues(start, count)
+}
+
+func (d *reopenableADC) Reopen() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	if d.close != nil {
+		_ = d.close()
+	}
+	dev, close, err := d.open()
+	if err != nil {
+		d.close = nil
+		return err
+	}
+	d.device, d.close = dev, close
+	return nil
+}
+
+//Close closes the bus of the device
+func (d *reopenableADC) Close() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	if d.close == nil {
+		return nil
+	}
+	err := d.close()
+	d.close = nil
+	return err
+}
+
+//reopenableDAC is a DACWriter on a bus that can be re-opened, guarded as reopenableFlow
+type reopenableDAC struct {
+	label   string
+	open    func() (DACWriter, closer, error)
+	mdevice sync.Mutex
+	device  DACWriter
+	close   closer
+}
+
+func newReopenableDAC(label string, open func() (DACWriter, closer, error)) *reopenableDAC {
+	return &reopenableDAC{label: label, open: open}
+}
+
+func (d *reopenableDAC) Label() string {
+	return d.label
+}
+
+func (d *reopenableDAC) Write(value uint16) error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	return d.device.Write(value)
+}
+
+func (d *reopenableDAC) Reopen() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	if d.close != nil {
+		_ = d.close()
+	}
+	dev, close, err := d.open()
+	if err != nil {
+		d.close = nil
+		return err
+	}
+	d.device, d.close = dev, close
+	return nil
+}
+
+//Close closes the bus of the device
+func (d *reopenableDAC) Close() error {
+	d.mdevice.Lock()
+	defer d.mdevice.Unlock()
+	if d.close == nil {
+		return nil
+	}
+	err := d.close()
+	d.close = nil
+	return err
+}
+
+// closeDevices closes the bus of every device that holds one open
+func closeDevices(devices *Devices) error {
+	all := []interface{}{}
+	for _, f := range devices.Flows {
+		all = append(all, f)
+	}
+	all = append(all, devices.ADC, devices.DAC)
+
+	var first error
+	for _, d := range all {
+		c, ok := d.(io.Closer)
+		if !ok {
+			continue
+		}
+		err := c.Close()
+		if err != nil && first == nil {
+			first = fmt.Errorf("Failed to close bus: %w", err)
+		}
+	}
+	return first
+}
+
+// mmux serialises channel selection and transfer on all multiplexers, as every sensor behind one shares its bus
+var mmux sync.Mutex
+
+//muxBus is the bus behind one channel of a TCA9548A multiplexer, selecting the channel before each transfer
+type muxBus struct {
+	i2c.Bus
+	mux     uint16
+	channel uint8
+}
+
+func (b *muxBus) Tx(addr uint16, w []byte, r []byte) error {
+	mmux.Lock()
+	defer mmux.Unlock()
+
+	err := b.Bus.Tx(b.mux, []byte{1 << b.channel}, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to select channel %v of multiplexer 0x%x: %w", b.channel, b.mux, err)
+	}
+	return b.Bus.Tx(addr, w, r)
+}
+
+//sfm3000Reader reads SFM3000 measurements from the bus itself, returning the word and CRC as transferred.
+//Soft reset and serial number are left to the driver, both of which end continuous measurement.
+type sfm3000Reader struct {
+	*sfm3000.SFM3000
+	dev       *i2c.Dev
+	measuring bool //Continuous measurement has been started since the last command
+}
+
+func (s *sfm3000Reader) SoftReset() error {
+	s.measuring = false
+	return s.SFM3000.SoftReset()
+}
+
+func (s *sfm3000Reader) GetSerial() (uint32, error) {
+	s.measuring = false
+	return s.SFM3000.GetSerial()
+}
+
+func (s *sfm3000Reader) GetRaw() (uint16, uint8, time.Time, error) {
+	if !s.measuring {
+		err := s.dev.Tx([]byte{_sfm3000StartMeasurement >> 8, _sfm3000StartMeasurement & 0xFF}, nil)
+		if err != nil {
+			return 0, 0, time.Now(), fmt.Errorf("Failed to start measurement: %w", err)
+		}
+		s.measuring = true
+	}
+
+	read := make([]byte, 3) //Measurement word, most significant byte first, and its CRC
+	err := s.dev.Tx(nil, read)
+	tstamp := time.Now()
+	if err != nil {
+		return 0, 0, tstamp, fmt.Errorf("Failed to read measurement: %w", err)
+	}
+	return uint16(read[0])<<8 | uint16(read[1]), read[2], tstamp, nil
+}
+
+func openFlow(config FlowSensorConfig) (FlowSensor, closer, error) {
+	logman.Infof("ioman:initialize", "Initializing I2C on bus %v", config.Bus)
+	i2cbus, err := i2creg.Open(config.Bus)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create I2C device: %w", err)
+	}
+
+	var bus i2c.Bus = i2cbus
+	if config.Mux != 0 {
+		logman.Infof("ioman:initialize", "Selecting channel %v of TCA9548A on I2C bus %v 0x%x", config.MuxChannel, config.Bus, config.Mux)
+		bus = &muxBus{Bus: i2cbus, mux: uint16(config.Mux), channel: config.MuxChannel}
+	}
+
+	logman.Infof("ioman:initialize", "Initializing SFM3000 on I2C bus %v 0x%x as %v", config.Bus, config.Address, config.Label)
+	dev := i2c.Dev{
+		Bus:  bus,
+		Addr: uint16(config.Address),
+	}
+
+	flow, err := sfm3000.NewSFM3000(&dev, config.Address, config.IsAir, config.Label)
+	if err != nil {
+		_ = i2cbus.Close()
+		return nil, nil, fmt.Errorf("Failed to create SFM3000 %v: %w", config.Label, err)
+	}
+	return &sfm3000Reader{SFM3000: flow, dev: &dev}, i2cbus.Close, nil
+}
+
+func openSPI(bus string, speed physic.Frequency) (spi.Conn, closer, error) {
+	logman.Infof("ioman:initialize", "Initializing SPI on bus %v at %v ", bus, speed)
+	port, err := spireg.Open(bus)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open SPI bus %v: %w", bus, err)
+	}
+
+	conn, err := port.Connect(speed, spi.Mode0, 8)
+	if err != nil {
+		_ = port.Close()
+		return nil, nil, fmt.Errorf("Failed to connect SPI bus %v: %w", bus, err)
+	}
+	return conn, port.Close, nil
+}
+
+func openADC1(config HardwareConfig) (ADCReader, closer, error) {
+	conn, close, err := openSPI(config.ADCBus, config.SPISpeed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logman.Infof("ioman:initialize", "Initializing MCP3208 on SPI bus %v as %v", config.ADCBus, "ADC1")
+	adc1, err := mcp3208.NewMcp3208(conn, "ADC1")
+	if err != nil {
+		_ = close()
+		return nil, nil, fmt.Errorf("Failed to create MCP3208: %w", err)
+	}
+	return adc1, close, nil
+}
+
+func openDAC1(config HardwareConfig) (DACWriter, closer, error) {
+	conn, close, err := openSPI(config.DACBus, config.SPISpeed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logman.Infof("ioman:initialize", "Initializing MCP4921 on SPI bus %v as %v", config.DACBus, "DAC1")
+	dac1, err := mcp4921.NewMcp4921(conn, "DAC1", mcp4921.EnumBufferedTrue, mcp4921.EnumOutputGain1x, mcp4921.EnumShutdownModeActive)
+	if err != nil {
+		_ = close()
+		return nil, nil, fmt.Errorf("Failed to create MCP4921: %w", err)
+	}
+	return dac1, close, nil
+}
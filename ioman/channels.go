@@ -0,0 +1,170 @@
+package ioman
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const _adcChannelCount = 8 //MCP3208 is 8 channel
+const _adcMinChannels = 4  //Channels read even when unmapped, for logging and recording
+
+//Default calibrations, for ratiometric 0.5V-4.5V of 5V sensors on a 12 bit ADC
+const _defaultPressureOffset = 410 //ADC counts at 0 cmH2O
+const _defaultPressureGain = 32.76 //ADC counts per cmH2O, 0-100 cmH2O
+const _defaultOxygenOffset = 0     //ADC counts at 0%, galvanic cell
+const _defaultOxygenGain = 18.5    //ADC counts per percent O2
+const _defaultSupplyOffset = 410   //ADC counts at 0 kPa
+const _defaultSupplyGain = 3.276   //ADC counts per kPa, 0-1000 kPa
+
+//EnumQuantity is a physical quantity measured through an ADC channel
+type EnumQuantity int
+
+func (e EnumQuantity) String() string {
+	switch int(e) {
+	case 0:
+		return "None"
+	case 1:
+		return "Airway Pressure"
+	case 2:
+		return "Oxygen"
+	case 3:
+		return "Supply Pressure"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//QuantityNone ..
+	QuantityNone EnumQuantity = iota
+	//QuantityAirwayPressure in cmH2O
+	QuantityAirwayPressure
+	//QuantityOxygen in percent O2
+	QuantityOxygen
+	//QuantitySupplyPressure in kPa
+	QuantitySupplyPressure
+)
+
+//ParseQuantity parses a quantity by name, case insensitive
+func ParseQuantity(name string) (EnumQuantity, error) {
+	for _, q := range []EnumQuantity{QuantityNone, QuantityAirwayPressure, QuantityOxygen, QuantitySupplyPressure} {
+		if strings.EqualFold(name, q.String()) {
+			return q, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown quantity %v, expected none, airway pressure, oxygen or supply pressure", name)
+}
+
+//Calibration converts raw ADC counts to a physical value as the polynomial
+//Coefficients[0] + Coefficients[1]*counts + Coefficients[2]*counts^2 ...
+type Calibration struct {
+	Coefficients []float64
+}
+
+//LinearCalibration returns a calibration from the ADC counts at zero and the ADC counts per unit
+func LinearCalibration(offset float64, gain float64) Calibration {
+	return Calibration{
+		Coefficients: []float64{-offset / gain, 1 / gain},
+	}
+}
+
+//Apply ..
+func (c Calibration) Apply(counts uint16) float64 {
+	val := float64(0)
+	for i := len(c.Coefficients) - 1; i >= 0; i-- {
+		val = val*float64(counts) + c.Coefficients[i]
+	}
+	return val
+}
+
+//ChannelConfig maps an ADC channel to a physical quantity
+type ChannelConfig struct {
+	Channel     int
+	Quantity    EnumQuantity
+	Calibration Calibration
+	Filters     []FilterConfig //Applied in order to the calibrated value
+}
+
+//DefaultChannelMap ..
+func DefaultChannelMap() []ChannelConfig {
+	return []ChannelConfig{
+		{Channel: 0, Quantity: QuantityAirwayPressure, Calibration: LinearCalibration(_defaultPressureOffset, _defaultPressureGain)},
+		{Channel: 1, Quantity: QuantityOxygen, Calibration: LinearCalibration(_defaultOxygenOffset, _defaultOxygenGain)},
+		{Channel: 2, Quantity: QuantitySupplyPressure, Calibration: LinearCalibration(_defaultSupplyOffset, _defaultSupplyGain)},
+	}
+}
+
+//ValidateChannelMap checks channels are in range, quantities are mapped once, and channel filters are valid at sampleRate
+func ValidateChannelMap(channels []ChannelConfig, sampleRate time.Duration) error {
+	quantities := map[EnumQuantity]bool{}
+	for _, c := range channels {
+		if c.Channel < 0 || c.Channel >= _adcChannelCount {
+			return fmt.Errorf("Channel %v for %v is out of range 0-%v", c.Channel, c.Quantity, _adcChannelCount-1)
+		}
+		if c.Quantity == QuantityNone {
+			continue
+		}
+		if quantities[c.Quantity] {
+			return fmt.Errorf("%v is mapped to more than one channel", c.Quantity)
+		}
+		quantities[c.Quantity] = true
+		if len(c.Calibration.Coefficients) == 0 {
+			return fmt.Errorf("Channel %v for %v has no calibration coefficients", c.Channel, c.Quantity)
+		}
+		err := ValidateFilters(c.Filters, sampleRate)
+		if err != nil {
+			return fmt.Errorf("Channel %v for %v has an invalid filter: %w", c.Channel, c.Quantity, err)
+		}
+	}
+	return nil
+}
+
+// channelCount returns the number of ADC channels that must be read to cover the channel map
+func channelCount(channels []ChannelConfig) int {
+	count := _adcMinChannels
+	for _, c := range channels {
+		if c.Channel+1 > count {
+			count = c.Channel + 1
+		}
+	}
+	return count
+}
+
+// channelFilters creates the filter chain of each channel in the channel map
+func channelFilters(channels []ChannelConfig, sampleRate time.Duration) []Filter {
+	filters := []Filter{}
+	for _, c := range channels {
+		filters = append(filters, newFilterChain(c.Filters, sampleRate))
+	}
+	return filters
+}
+
+// measure converts ADC values to physical quantities on sensors, filters are indexed as channels and may be nil
+func measure(sensors *Sensors, channels []ChannelConfig, filters []Filter) {
+	if sensors.ADC.Err != nil {
+		return
+	}
+
+	for i, c := range channels {
+		if c.Channel >= len(sensors.ADC.Vals) {
+			continue
+		}
+		m := Measurement{
+			Val:   c.Calibration.Apply(sensors.ADC.Vals[c.Channel]),
+			Valid: true,
+		}
+		if i < len(filters) {
+			m.Val = filters[i].Apply(m.Val)
+		}
+
+		switch c.Quantity {
+		case QuantityAirwayPressure:
+			sensors.AirwayPressure = m
+		case QuantityOxygen:
+			sensors.Oxygen = m
+		case QuantitySupplyPressure:
+			sensors.SupplyPressure = m
+		}
+	}
+}
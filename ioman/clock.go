@@ -0,0 +1,184 @@
+package ioman
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock is the source of time of the io loop and the devices it samples, so that captures can be run faster than real time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	Sleep(d time.Duration) //Waits for hardware to settle, such as in self test and recovery
+}
+
+//Ticker delivers the ticks of a Clock
+type Ticker interface {
+	C() <-chan time.Time //Channel the next tick is delivered on, must be called again for each tick
+	Stop()
+}
+
+//SystemClock returns the wall clock
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{ticker: time.NewTicker(d)}
+}
+
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t *systemTicker) C() <-chan time.Time { return t.ticker.C }
+func (t *systemTicker) Stop()               { t.ticker.Stop() }
+
+//VirtualClock is a Clock that only moves when advanced. Every tick is delivered in order, and the clock is held
+//at each tick until its receiver is waiting for the next, so runs on a VirtualClock are exactly reproducible.
+type VirtualClock struct {
+	mclock  sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	tickers []*virtualTicker
+}
+
+//NewVirtualClock creates a VirtualClock stopped at start
+func NewVirtualClock(start time.Time) *VirtualClock {
+	c := VirtualClock{now: start}
+	c.cond = sync.NewCond(&c.mclock)
+	return &c
+}
+
+//Now ..
+func (c *VirtualClock) Now() time.Time {
+	c.mclock.Lock()
+	defer c.mclock.Unlock()
+	return c.now
+}
+
+//NewTicker creates a Ticker with its first tick one period from now
+func (c *VirtualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	c.mclock.Lock()
+	defer c.mclock.Unlock()
+
+	t := &virtualTicker{
+		clock:  c,
+		period: d,
+		next:   c.now.Add(d),
+		c:      make(chan time.Time, 1),
+	}
+	c.tickers = append(c.tickers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+//Sleep returns immediately. Devices sampled on a VirtualClock are simulated and settle at once, and the clock
+//only moves when advanced, so a settling wait neither blocks nor moves the io loop.
+func (c *VirtualClock) Sleep(d time.Duration) {}
+
+//Advance moves the clock forward by d, delivering every tick on the way. Returns once the receiver of each tick
+//is waiting for the next, so everything driven by the ticks up to the new time has run.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mclock.Lock()
+	defer c.mclock.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		for !c.idle() {
+			c.cond.Wait()
+		}
+
+		t := c.earliest(target)
+		if t == nil {
+			break
+		}
+		c.now = t.next
+		t.next = t.next.Add(t.period)
+		t.waiting = false
+		select {
+		case t.c <- c.now:
+		default: //Receiver has stopped reading, the tick is dropped as by time.Ticker
+		}
+	}
+	c.now = target
+}
+
+//WaitForTickers blocks until n tickers are waiting for a tick, such as the io loop once started
+func (c *VirtualClock) WaitForTickers(n int) {
+	c.mclock.Lock()
+	defer c.mclock.Unlock()
+
+	for {
+		waiting := 0
+		for _, t := range c.tickers {
+			if t.waiting && !t.stopped {
+				waiting++
+			}
+		}
+		if waiting >= n {
+			return
+		}
+		c.cond.Wait()
+	}
+}
+
+// idle returns true if every ticker is waiting for a tick or stopped
+func (c *VirtualClock) idle() bool {
+	for _, t := range c.tickers {
+		if !t.waiting && !t.stopped {
+			return false
+		}
+	}
+	return true
+}
+
+// earliest returns the running ticker with the earliest tick at or before target, nil if there is none
+func (c *VirtualClock) earliest(target time.Time) *virtualTicker {
+	var earliest *virtualTicker
+	for _, t := range c.tickers {
+		if t.stopped || t.next.After(target) {
+			continue
+		}
+		if earliest == nil || t.next.Before(earliest.next) {
+			earliest = t
+		}
+	}
+	return earliest
+}
+
+type virtualTicker struct {
+	clock   *VirtualClock
+	period  time.Duration
+	next    time.Time
+	c       chan time.Time
+	waiting bool //C has been called, and no tick delivered since
+	stopped bool
+}
+
+func (t *virtualTicker) C() <-chan time.Time {
+	t.clock.mclock.Lock()
+	defer t.clock.mclock.Unlock()
+
+	t.waiting = true
+	t.clock.cond.Broadcast()
+	return t.c
+}
+
+func (t *virtualTicker) Stop() {
+	t.clock.mclock.Lock()
+	defer t.clock.mclock.Unlock()
+
+	t.stopped = true
+	t.clock.cond.Broadcast()
+}
@@ -0,0 +1,109 @@
+package ioman
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewVirtualClock(start)
+	ticker := clock.NewTicker(time.Millisecond)
+	slow := clock.NewTicker(3 * time.Millisecond)
+	slow.Stop()
+
+	ticks := []time.Time{}
+	go func() {
+		for {
+			tick := <-ticker.C()
+			if !tick.Equal(clock.Now()) {
+				t.Errorf("Expected the clock to be held at tick %v, got %v", tick, clock.Now())
+			}
+			ticks = append(ticks, tick)
+		}
+	}()
+	clock.WaitForTickers(1)
+
+	// Every tick is received before Advance returns, at exactly the tick time
+	clock.Advance(10*time.Millisecond + time.Microsecond)
+	if len(ticks) != 10 {
+		t.Fatalf("Expected 10 ticks, got %v", len(ticks))
+	}
+	for i, tick := range ticks {
+		if !tick.Equal(start.Add(time.Duration(i+1) * time.Millisecond)) {
+			t.Fatalf("Expected tick %v at %vms, got %v", i, i+1, tick.Sub(start))
+		}
+	}
+	if !clock.Now().Equal(start.Add(10*time.Millisecond + time.Microsecond)) {
+		t.Fatalf("Expected the clock to stop at the advanced time, got %v", clock.Now().Sub(start))
+	}
+}
+
+// runReplay runs IOMan on a virtual clock over a replay of records, returning the last DataPacket
+func runReplay(t *testing.T, records []FlowRecord, duration time.Duration) DataPacket {
+	t.Helper()
+
+	replay, err := NewReplayFromRecords(records, nil, 1, false)
+	if err != nil {
+		t.Fatalf("Failed to create replay: %v", err)
+	}
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	replay.SetClock(clock)
+
+	iom, err := NewIOManWithDevices(replay.Devices(), DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+
+	startIOMan(t, iom)
+	clock.WaitForTickers(1)
+	clock.Advance(duration)
+
+	return iom.GetDataPacket()
+}
+
+func TestVirtualClockSelfTest(t *testing.T) {
+	lung := NewSimLung(DefaultSimConfig())
+	lung.SetClock(NewVirtualClock(time.Unix(1000, 0)))
+
+	// Self test waits for the devices to settle on their clock, not in real time
+	begin := time.Now()
+	_, err := NewIOManWithDevices(lung.Devices(), DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+	if time.Since(begin) > 50*time.Millisecond {
+		t.Fatalf("Expected self test not to wait in real time, took %v", time.Since(begin))
+	}
+}
+
+func TestVirtualClockReplay(t *testing.T) {
+	const breaths = 30
+	period := 4 * time.Second
+	flows := syntheticBreaths(breaths, period, 30, 1)
+
+	records := []FlowRecord{}
+	for _, f := range flows {
+		records = append(records, FlowRecord{Offset: f.Timestamp.Sub(flows[0].Timestamp), Val: f.Val})
+	}
+	duration := records[len(records)-1].Offset
+
+	// Two minutes of breathing runs without waiting in real time, and reproduces exactly
+	begin := time.Now()
+	first := runReplay(t, records, duration)
+	if time.Since(begin) > duration/2 {
+		t.Fatalf("Expected replay to run faster than real time, took %v for %v", time.Since(begin), duration)
+	}
+	second := runReplay(t, records, duration)
+
+	if !first.Timestamp.Equal(time.Unix(1000, 0).Add(duration)) {
+		t.Fatalf("Expected the last DataPacket at the end of the replay, got %v", first.Timestamp)
+	}
+	if first.Calculated.Breath.Number != breaths-1 {
+		t.Fatalf("Expected %v completed breaths, got %v", breaths-1, first.Calculated.Breath.Number)
+	}
+	if !reflect.DeepEqual(first.Calculated, second.Calculated) || first.Stats.Loops != second.Stats.Loops {
+		t.Fatalf("Expected identical runs, got %+v and %+v", first.Calculated, second.Calculated)
+	}
+}
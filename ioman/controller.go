@@ -1,91 +1,186 @@
 package ioman
 
 import (
-	"container/ring"
+	"fmt"
 	"time"
+
+	"github.com/kaelanfouwels/gogles/logman"
 )
 
-const _boxcarRatio float64 = 0.1 //division of of sample rate
-const _breathInFlowThreshold = 5
-const _breathOutFlowThreshold = 0
+const _flowMaxGap = 20 * time.Millisecond //longest run of bad flow samples held at the last good sample
+
+//BreathConfig configures detection of the breath cycle from filtered flow
+type BreathConfig struct {
+	InFlowThreshold  float64       //SLM above which breathing in is detected
+	OutFlowThreshold float64       //SLM below which breathing out is detected, negative
+	Hysteresis       float64       //SLM by which a threshold must be recrossed before a phase ends
+	MinDwell         time.Duration //Minimum time in a breathing phase before it can end
+}
+
+//DefaultBreathConfig ..
+func DefaultBreathConfig() BreathConfig {
+	return BreathConfig{
+		InFlowThreshold:  5,
+		OutFlowThreshold: -5,
+		Hysteresis:       2,
+		MinDwell:         100 * time.Millisecond,
+	}
+}
+
+//Validate ..
+func (b BreathConfig) Validate() error {
+	if b.InFlowThreshold <= 0 || b.OutFlowThreshold >= 0 {
+		return fmt.Errorf("Breath in threshold must be positive and breath out threshold negative, got %v and %v", b.InFlowThreshold, b.OutFlowThreshold)
+	}
+	if b.Hysteresis < 0 || b.Hysteresis >= b.InFlowThreshold || b.Hysteresis >= -b.OutFlowThreshold {
+		return fmt.Errorf("Breath hysteresis must not be negative, and less than both thresholds, got %v", b.Hysteresis)
+	}
+	if b.MinDwell < 0 {
+		return fmt.Errorf("Breath minimum dwell must not be negative, got %v", b.MinDwell)
+	}
+	return nil
+}
 
 type calcStore struct {
-	flowAverageTotal float64
-	flowAverageN     uint64
+	flowIntegral integrator //flow integrated over the current breathing in state
+	breath       breathStore
+}
+
+type breathStore struct {
+	number        uint64
+	kind          EnumBreathType
+	start         time.Time  //start of inspiration
+	expiration    time.Time  //start of expiration
+	volume        integrator //flow integrated over the whole breath
+	inspired      float64    //volume at start of expiration
+	inspiredError float64
+	peak          float64
+	peakPressure  float64
+	lastPressure  float64 //airway pressure of the previous sample
+	limbs         []limbStore
+	last          Breath //last completed breath
+}
+
+type limbStore struct {
+	role   EnumFlowRole
+	volume integrator //limb flow integrated over the whole breath
 }
 
 type bufferStore struct {
-	flowMovingAverage float64
-	flowRing          *ring.Ring //N size circular buffer of previous flow measurements
+	flowFiltered float64
+	flowFilter   Filter
+	flowGood     Flow //last flow sample of good quality
 }
 type stateStore struct {
+	config          BreathConfig
 	state           EnumState
 	stateChange     time.Time
 	lastState       EnumState //state n-1
 	lastStateChange time.Time
+	breath          uint64         //number of breaths started
+	breathType      EnumBreathType //type of the current breath
 }
 
 type controller struct {
 	state       stateStore
 	buffer      bufferStore
 	calc        calcStore
+	trigger     triggerStore
 	sampledRate time.Duration
+	clock       Clock
 }
 
-func newController(sampledRate time.Duration) *controller {
-
-	blen := int(1/sampledRate.Seconds()) * 1
-	logf("controller", "Creating a new buffer of len %v", blen)
-
-	fr := ring.New(blen)
-	for i := 0; i < fr.Len()+1; i++ {
-		fr.Value = float64(0)
-		fr = fr.Next()
-	}
+func newController(sampledRate time.Duration, clock Clock) *controller {
 	return &controller{
-
 		buffer: bufferStore{
-			flowRing: fr,
+			flowFilter: newFilterChain(DefaultFlowFilters(), sampledRate),
+		},
+		state: stateStore{
+			config: DefaultBreathConfig(),
+		},
+		trigger: triggerStore{
+			config: DefaultTriggerConfig(),
 		},
 
 		sampledRate: sampledRate,
+		clock:       clock,
 	}
 }
 
-var counter int = 0
-
-var ticks int = 0
-
-func (c *controller) buffers(sensors Sensors) {
-	c.buffer.flowRing = c.buffer.flowRing.Next()
-	c.buffer.flowRing.Value = float64(sensors.Flow.Val)
+// setFlowFilters replaces the flow filter chain, filters must have been validated
+func (c *controller) setFlowFilters(filters []FilterConfig) {
+	logman.Infof("ioman:controller", "Filtering flow with %+v", filters)
+	c.buffer.flowFilter = newFilterChain(filters, c.sampledRate)
+}
 
-	//Calculate current trailing moving average
-	boxcar := int(1 / (c.sampledRate.Seconds()) * _boxcarRatio) //Calculate boxcar width as ratio _boxcarRatio of sample rate
-	sum := float64(0)
+// bridge holds flow at the last good sample across short runs of bad samples, stamping samples without a timestamp with the clock.
+// Returns false if there is no good sample within _flowMaxGap, and sensors must not be used.
+func (c *controller) bridge(sensors *Sensors) bool {
+	f := &sensors.Flow
+	if f.Quality == QualityGood {
+		c.buffer.flowGood = *f
+		return true
+	}
 
-	c.buffer.flowRing = c.buffer.flowRing.Move(-(boxcar)) //Index to [N - boxcar]
-	for s := 0; s < boxcar; s++ {                         //Advance from [N - boxcar] to N
-		val := c.buffer.flowRing.Value.(float64)
-		sum = sum + val
-		c.buffer.flowRing = c.buffer.flowRing.Next()
+	if f.Timestamp.IsZero() {
+		f.Timestamp = c.clock.Now()
 	}
+	good := c.buffer.flowGood
+	if good.Timestamp.IsZero() || f.Timestamp.Sub(good.Timestamp) > _flowMaxGap {
+		return false
+	}
+	f.Val = good.Val
+	return true
+}
 
-	c.buffer.flowMovingAverage = sum / float64(boxcar)
+func (c *controller) buffers(sensors Sensors) {
+	c.buffer.flowFiltered = c.buffer.flowFilter.Apply(sensors.Flow.Val)
 }
 
 func (c *controller) states(sensors Sensors) EnumState {
 
-	newstate := StateRest
+	config := c.state.config
+	flow := c.buffer.flowFiltered
+	dwell := sensors.Flow.Timestamp.Sub(c.state.stateChange)
+	newstate := c.state.state
+
+	switch c.state.state {
+	case StateBreathingIn:
+		if dwell >= config.MinDwell && flow < config.InFlowThreshold-config.Hysteresis {
+			newstate = StateInspiratoryPause
+		}
+	case StateInspiratoryPause:
+		if flow < config.OutFlowThreshold {
+			newstate = StateBreathingOut
+		} else if flow > config.InFlowThreshold {
+			newstate = StateBreathingIn
+		}
+	case StateBreathingOut:
+		if dwell >= config.MinDwell && flow > config.OutFlowThreshold+config.Hysteresis {
+			newstate = StateExpiratoryPause
+		}
+	case StateExpiratoryPause:
+		if flow > config.InFlowThreshold {
+			newstate = StateBreathingIn
+		} else if flow < config.OutFlowThreshold {
+			newstate = StateBreathingOut
+		}
+	default: // Before the first breath, wait for inspiration
+		newstate = StateRest
+		if flow > config.InFlowThreshold {
+			newstate = StateBreathingIn
+		}
+	}
 
-	if c.buffer.flowMovingAverage > _breathInFlowThreshold {
-		newstate = StateBreathingIn
+	if newstate == StateBreathingIn && c.state.state != StateBreathingIn && c.state.state != StateInspiratoryPause {
+		c.state.breath++
+		c.state.breathType = c.claimTrigger()
 	}
 
 	if newstate != c.state.state {
 		c.state.lastStateChange = c.state.stateChange
 		c.state.stateChange = sensors.Flow.Timestamp
-		logf("controller", "state changed from %v to %v. ADC1-0 = %v", c.state.lastState, newstate, sensors.ADC.Vals[0])
+		logman.Limitf(logman.LevelDebug, "ioman:controller", "state changed from %v to %v. ADC1 = %v", c.state.state, newstate, sensors.ADC.Vals)
 	}
 
 	c.state.lastState = c.state.state
@@ -100,27 +195,147 @@ func (c *controller) calculate(sensors Sensors) Calculated {
 
 	// If moving into breathing state, reset counters
 	if c.state.state == StateBreathingIn && c.state.lastState != StateBreathingIn {
-		c.calc.flowAverageTotal = 0
-		c.calc.flowAverageN = 0
+		c.calc.flowIntegral.reset()
 	}
 
-	// If in breathing state, increment counters
+	// If in breathing state, integrate flow
 	if c.state.state == StateBreathingIn {
-		c.calc.flowAverageTotal += float64(sensors.Flow.Val)
-		c.calc.flowAverageN++
+		c.calc.flowIntegral.add(sensors.Flow.Timestamp, sensors.Flow.Val)
 	}
 
-	// If leaving breathing state, calculate integrated flow.
-	if c.state.state == StateRest && c.state.lastState == StateBreathingIn {
-		duration := c.state.stateChange.Sub(c.state.lastStateChange)
+	// If leaving breathing state, publish integrated flow.
+	if c.state.state != StateBreathingIn && c.state.lastState == StateBreathingIn {
+		c.calc.flowIntegral.add(sensors.Flow.Timestamp, sensors.Flow.Val)
 
-		flow := (c.calc.flowAverageTotal / float64(c.calc.flowAverageN)) * duration.Minutes()
-
-		calc.FlowIntegrated = flow
+		calc.FlowIntegrated = c.calc.flowIntegral.total
+		calc.FlowIntegratedError = c.calc.flowIntegral.error
 		calc.FlowIntegratedTimestamp = c.state.stateChange
 
-		logf("controller", "breath calculated as %v liters at %v ", calc.FlowIntegrated, calc.FlowIntegratedTimestamp)
+		logman.Limitf(logman.LevelDebug, "ioman:controller", "breath calculated as %v liters at %v ", calc.FlowIntegrated, calc.FlowIntegratedTimestamp)
 	}
 
+	c.breaths(sensors)
+	calc.Volume = c.calc.breath.volume.total
+	calc.Breath = c.calc.breath.last
+
 	return calc
 }
+
+func (c *controller) breaths(sensors Sensors) {
+	b := &c.calc.breath
+
+	// If a new breath has started, complete the previous breath up to this sample and reset counters
+	if c.state.breath != b.number {
+		if b.number != 0 && !b.expiration.IsZero() {
+			b.volume.add(sensors.Flow.Timestamp, sensors.Flow.Val)
+			c.integrateLimbs(sensors)
+			b.last = c.completeBreath(c.state.stateChange)
+			logman.Debugf("ioman:controller", "breath %v completed: %+v", b.last.Number, b.last)
+		}
+
+		*b = breathStore{
+			number: c.state.breath,
+			kind:   c.state.breathType,
+			start:  c.state.stateChange,
+			last:   b.last,
+		}
+		for _, f := range sensors.Flows {
+			if f.Role != RoleProximal {
+				b.limbs = append(b.limbs, limbStore{role: f.Role})
+			}
+		}
+	}
+
+	if b.number == 0 {
+		return
+	}
+
+	b.volume.add(sensors.Flow.Timestamp, sensors.Flow.Val)
+	c.integrateLimbs(sensors)
+
+	if sensors.AirwayPressure.Valid {
+		if sensors.AirwayPressure.Val > b.peakPressure {
+			b.peakPressure = sensors.AirwayPressure.Val
+		}
+		b.lastPressure = sensors.AirwayPressure.Val
+	}
+
+	switch c.state.state {
+	case StateBreathingIn, StateInspiratoryPause:
+		if sensors.Flow.Val > b.peak {
+			b.peak = sensors.Flow.Val
+		}
+	case StateBreathingOut, StateExpiratoryPause:
+		if b.expiration.IsZero() {
+			b.expiration = c.state.stateChange
+			b.inspired = b.volume.total
+			b.inspiredError = b.volume.error
+		}
+	}
+}
+
+// integrateLimbs integrates the good samples of the inspiratory and expiratory limb sensors, in HardwareConfig order
+func (c *controller) integrateLimbs(sensors Sensors) {
+	i := 0
+	for _, f := range sensors.Flows {
+		if f.Role == RoleProximal {
+			continue
+		}
+		if i < len(c.calc.breath.limbs) && f.Quality == QualityGood {
+			c.calc.breath.limbs[i].volume.add(f.Timestamp, f.Val)
+		}
+		i++
+	}
+}
+
+// leak returns the inspiratory less expiratory limb volume of the current breath and its error, false without both limb sensors
+func (c *controller) leak() (float64, float64, bool) {
+	inspired, expired := false, false
+	leak, leakError := 0.0, 0.0
+	for _, l := range c.calc.breath.limbs {
+		switch l.role {
+		case RoleInspiratory:
+			inspired = true
+			leak += l.volume.total
+		case RoleExpiratory:
+			expired = true
+			leak -= l.volume.total
+		}
+		leakError += l.volume.error
+	}
+	return leak, leakError, inspired && expired
+}
+
+func (c *controller) completeBreath(end time.Time) Breath {
+	b := &c.calc.breath
+
+	br := Breath{
+		Number:              b.number,
+		Type:                b.kind,
+		Start:               b.start,
+		End:                 end,
+		InspiredVolume:      b.inspired,
+		InspiredVolumeError: b.inspiredError,
+		ExpiredVolume:       b.inspired - b.volume.total,
+		ExpiredVolumeError:  b.volume.error - b.inspiredError,
+		PeakInspiratoryFlow: b.peak,
+		PeakPressure:        b.peakPressure,
+		PEEP:                b.lastPressure,
+		InspiratoryTime:     b.expiration.Sub(b.start),
+		ExpiratoryTime:      end.Sub(b.expiration),
+	}
+
+	if leak, leakError, ok := c.leak(); ok {
+		br.Leak, br.LeakError = leak, leakError
+	}
+
+	if br.InspiratoryTime > 0 {
+		br.IERatio = br.ExpiratoryTime.Seconds() / br.InspiratoryTime.Seconds()
+	}
+	if total := end.Sub(b.start); total > 0 {
+		br.Rate = 60 / total.Seconds()
+		br.MinuteVentilation = br.ExpiredVolume * br.Rate
+	}
+
+	return br
+}
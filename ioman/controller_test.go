@@ -1,81 +1,142 @@
 package ioman
 
 import (
-	"encoding/csv"
-	"fmt"
-	"os"
-	"strconv"
+	"math"
+	"math/rand"
 	"testing"
 	"time"
 )
 
 const _testSampleRate = (1 * time.Second) / 1000
 
-var _cont *controller
+func TestStateCycle(t *testing.T) {
 
-func TestMain(m *testing.M) {
-	_cont = newController(_testSampleRate)
+	const breaths = 5
+	flows := syntheticBreaths(breaths, 4*time.Second, 30, 3)
 
-	result := m.Run()
-	os.Exit(result)
-}
+	cont := newController(_testSampleRate, SystemClock())
+	transitions := []EnumState{}
+	last := StateError
 
-func TestStates(t *testing.T) {
+	for _, f := range flows {
+		sensors := Sensors{
+			Flow: f,
+		}
+		cont.buffers(sensors)
+		state := cont.states(sensors)
+		if state != last {
+			transitions = append(transitions, state)
+			last = state
+		}
+	}
 
-	flows, err := loadDebug()
-	if err != nil {
-		t.Fatalf("Failed to load debug files: %v", err)
+	expected := []EnumState{StateRest}
+	for i := 0; i < breaths; i++ {
+		expected = append(expected, StateBreathingIn, StateInspiratoryPause, StateBreathingOut, StateExpiratoryPause)
 	}
-	t.Logf("Loaded %v flows", len(flows))
 
-	for _, f := range flows {
+	if len(transitions) != len(expected) {
+		t.Fatalf("Expected %v transitions, got %v: %v", len(expected), len(transitions), transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("Expected transition %v to be %v, got %v", i, expected[i], transitions[i])
+		}
+	}
+	if cont.state.breath != breaths {
+		t.Fatalf("Expected %v breaths, got %v", breaths, cont.state.breath)
+	}
+}
+
+func TestBreathMetrics(t *testing.T) {
+
+	const breaths = 4
+	const peak = 30.0
+	period := 4 * time.Second
+	flows := syntheticBreaths(breaths, period, peak, 1)
+
+	cont := newController(_testSampleRate, SystemClock())
+	var last Breath
 
+	for _, f := range flows {
 		sensors := Sensors{
 			Flow: f,
 		}
+		cont.buffers(sensors)
+		cont.states(sensors)
+		last = cont.calculate(sensors).Breath
+	}
+
+	// The final breath is completed by the next inspiration, so one fewer breath completes than was started
+	if last.Number != breaths-1 {
+		t.Fatalf("Expected last completed breath to be %v, got %v", breaths-1, last.Number)
+	}
 
-		time.Sleep(_testSampleRate)
-		_cont.buffers(sensors)
-		_cont.states(sensors)
-		_cont.calculate(sensors)
+	volume := peak * (period.Seconds() / math.Pi) / 60 //Integral of a half sine, SLM to liters
+	within := func(name string, got float64, expected float64, tolerance float64) {
+		if math.Abs(got-expected) > tolerance*math.Abs(expected) {
+			t.Errorf("Expected %v of %v, got %v", name, expected, got)
+		}
 	}
 
+	within("inspired volume", last.InspiredVolume, volume, 0.05)
+	within("expired volume", last.ExpiredVolume, volume, 0.05)
+	within("peak inspiratory flow", last.PeakInspiratoryFlow, peak, 0.05)
+	within("inspiratory time", last.InspiratoryTime.Seconds(), period.Seconds()/2, 0.05)
+	within("expiratory time", last.ExpiratoryTime.Seconds(), period.Seconds()/2, 0.05)
+	within("I:E ratio", last.IERatio, 1, 0.05)
+	within("rate", last.Rate, 60/period.Seconds(), 0.01)
+	within("minute ventilation", last.MinuteVentilation, volume*60/period.Seconds(), 0.05)
 }
 
-func loadDebug() ([]Flow, error) {
-	datafile := "../../iodrivers/i2c/sfm3000/capture_datalog_2.csv"
+func TestBreathLeak(t *testing.T) {
+
+	const leak = 2.0 //SLM lost between the limbs
+	period := 4 * time.Second
+	flows := syntheticBreaths(4, period, 30, 1)
 
-	f, err := os.Open(datafile)
-	defer f.Close()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open test data at %v: %v", datafile, err)
+	cont := newController(_testSampleRate, SystemClock())
+	var last Breath
+
+	for _, f := range flows {
+		inspiratory := Flow{Val: math.Max(f.Val, 0) + leak, Timestamp: f.Timestamp, Role: RoleInspiratory}
+		expiratory := Flow{Val: math.Max(-f.Val, 0), Timestamp: f.Timestamp, Role: RoleExpiratory}
+		sensors := Sensors{
+			Flow:  f,
+			Flows: []Flow{f, inspiratory, expiratory},
+		}
+		cont.buffers(sensors)
+		cont.states(sensors)
+		last = cont.calculate(sensors).Breath
 	}
 
-	cs := csv.NewReader(f)
-	records, err := cs.ReadAll()
-	if err != nil {
-		return nil, fmt.Errorf("Failed to read csv: %v", err)
+	expected := leak * (last.End.Sub(last.Start)).Minutes()
+	if math.Abs(last.Leak-expected) > 0.05*expected {
+		t.Fatalf("Expected leak of %v liters, got %v", expected, last.Leak)
 	}
+	if last.LeakError < 0 || last.LeakError > 0.05*expected {
+		t.Fatalf("Expected a small leak error, got %v", last.LeakError)
+	}
+}
 
+// syntheticBreaths generates sinusoidal breaths of peak flow in slm, with uniform noise and a trailing rest
+func syntheticBreaths(n int, period time.Duration, peak float64, noise float64) []Flow {
+	r := rand.New(rand.NewSource(1))
+	start := time.Now()
 	flows := []Flow{}
 
-	timenow := time.Now()
-
-	for _, v := range records[:(len(records) - 1)] {
-
-		offset, err := time.ParseDuration(v[0])
-		if err != nil {
-			return nil, fmt.Errorf("Failed to parse duration: %v", v[0])
-		}
-		val, err := strconv.ParseFloat(v[1], 64)
-		if err != nil {
-			return nil, fmt.Errorf("Failed to parse value: %v", v[1])
+	total := time.Duration(n)*period + period/2
+	for t := time.Duration(0); t < total; t += _testSampleRate {
+		val := 0.0
+		if t < time.Duration(n)*period {
+			val = peak * math.Sin(2*math.Pi*t.Seconds()/period.Seconds())
 		}
+		val += (r.Float64()*2 - 1) * noise
 
 		flows = append(flows, Flow{
-			Timestamp: timenow.Add(offset),
+			Timestamp: start.Add(t),
 			Val:       val,
 		})
 	}
-	return flows, nil
+	return flows
 }
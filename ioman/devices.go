@@ -0,0 +1,32 @@
+package ioman
+
+import "time"
+
+//FlowSensor is implemented by flow sensors such as the SFM3000. Measurements are returned as read from the bus,
+//so that their CRC is checked against the bytes transferred, and are scaled to flow by IOMan.
+type FlowSensor interface {
+	Label() string
+	SoftReset() error
+	GetSerial() (uint32, error)
+	GetRaw() (uint16, uint8, time.Time, error) // measurement word, crc, timestamp, error
+}
+
+//ADCReader is implemented by multi-channel ADCs such as the MCP3208
+type ADCReader interface {
+	Label() string
+	GetValues(start int, count int) ([]uint16, time.Time, error)
+}
+
+//DACWriter is implemented by DACs such as the MCP4921
+type DACWriter interface {
+	Label() string
+	Write(value uint16) error
+}
+
+//Devices holds the sensor and actuator implementations used by IOMan
+type Devices struct {
+	Flows []FlowSensor //One per flow sensor of HardwareConfig, in the same order
+	ADC   ADCReader
+	DAC   DACWriter
+	Clock Clock //Time the devices are sampled in, the system clock if nil
+}
@@ -0,0 +1,324 @@
+package ioman
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const _defaultFlowWindow = 100 * time.Millisecond //running mean applied to flow before breath detection
+
+//EnumFilter is a signal filter type
+type EnumFilter int
+
+func (e EnumFilter) String() string {
+	switch int(e) {
+	case 0:
+		return "Mean"
+	case 1:
+		return "Median"
+	case 2:
+		return "EMA"
+	case 3:
+		return "Butterworth"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//FilterMean is a running mean over Window
+	FilterMean EnumFilter = iota
+	//FilterMedian is a running median over Window, rejecting spikes shorter than half the window
+	FilterMedian
+	//FilterEMA is a first order exponential moving average with a -3dB point at Cutoff
+	FilterEMA
+	//FilterButterworth is a second order Butterworth low-pass with a -3dB point at Cutoff
+	FilterButterworth
+)
+
+//FilterConfig configures one stage of a filter chain
+type FilterConfig struct {
+	Type   EnumFilter
+	Window time.Duration //For mean and median
+	Cutoff float64       //Hz, for EMA and Butterworth
+}
+
+//DefaultFlowFilters ..
+func DefaultFlowFilters() []FilterConfig {
+	return []FilterConfig{
+		{Type: FilterMean, Window: _defaultFlowWindow},
+	}
+}
+
+//ParseFilters parses a comma separated filter chain of type:parameter stages, where the parameter is a
+//window duration for mean and median, and a cutoff in Hz for ema and butterworth. e.g. median:5ms,butterworth:20
+func ParseFilters(spec string) ([]FilterConfig, error) {
+	filters := []FilterConfig{}
+	if strings.TrimSpace(spec) == "" {
+		return filters, nil
+	}
+
+	for _, stage := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(stage), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Filter %v must be of the form type:parameter", stage)
+		}
+
+		f := FilterConfig{}
+		switch strings.ToLower(parts[0]) {
+		case "mean":
+			f.Type = FilterMean
+		case "median":
+			f.Type = FilterMedian
+		case "ema":
+			f.Type = FilterEMA
+		case "butterworth":
+			f.Type = FilterButterworth
+		default:
+			return nil, fmt.Errorf("Unknown filter %v, expected mean, median, ema or butterworth", parts[0])
+		}
+
+		var err error
+		switch f.Type {
+		case FilterMean, FilterMedian:
+			f.Window, err = time.ParseDuration(parts[1])
+		default:
+			f.Cutoff, err = strconv.ParseFloat(parts[1], 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %v parameter %v: %w", f.Type, parts[1], err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+//FormatFilters formats a filter chain in the form parsed by ParseFilters
+func FormatFilters(filters []FilterConfig) string {
+	stages := []string{}
+	for _, f := range filters {
+		switch f.Type {
+		case FilterMean, FilterMedian:
+			stages = append(stages, fmt.Sprintf("%v:%v", strings.ToLower(f.Type.String()), f.Window))
+		default:
+			stages = append(stages, fmt.Sprintf("%v:%v", strings.ToLower(f.Type.String()), strconv.FormatFloat(f.Cutoff, 'f', -1, 64)))
+		}
+	}
+	return strings.Join(stages, ",")
+}
+
+//ValidateFilters checks filters are realisable at sampleRate
+func ValidateFilters(filters []FilterConfig, sampleRate time.Duration) error {
+	nyquist := 0.5 / sampleRate.Seconds()
+	for _, f := range filters {
+		switch f.Type {
+		case FilterMean, FilterMedian:
+			if f.Window < sampleRate {
+				return fmt.Errorf("%v window %v must be at least one sample of %v", f.Type, f.Window, sampleRate)
+			}
+		case FilterEMA, FilterButterworth:
+			if f.Cutoff <= 0 || f.Cutoff >= nyquist {
+				return fmt.Errorf("%v cutoff %vHz must be between 0 and the Nyquist frequency %vHz", f.Type, f.Cutoff, nyquist)
+			}
+		default:
+			return fmt.Errorf("Unknown filter %v", f.Type)
+		}
+	}
+	return nil
+}
+
+//Filter processes a stream of samples taken at a fixed rate
+type Filter interface {
+	Apply(x float64) float64
+	Reset()
+}
+
+// newFilter creates a filter stage, config must have been validated
+func newFilter(config FilterConfig, sampleRate time.Duration) Filter {
+	samples := int(config.Window / sampleRate)
+	if samples < 1 {
+		samples = 1
+	}
+
+	switch config.Type {
+	case FilterMean:
+		return newMeanFilter(samples)
+	case FilterMedian:
+		return newMedianFilter(samples)
+	case FilterEMA:
+		return newEMAFilter(config.Cutoff, sampleRate)
+	case FilterButterworth:
+		return newButterworthFilter(config.Cutoff, sampleRate)
+	}
+	return &filterChain{}
+}
+
+//filterChain applies stages in order, and passes samples through unchanged if empty
+type filterChain struct {
+	stages []Filter
+}
+
+// newFilterChain creates a chain of filters, configs must have been validated
+func newFilterChain(configs []FilterConfig, sampleRate time.Duration) *filterChain {
+	c := filterChain{}
+	for _, f := range configs {
+		c.stages = append(c.stages, newFilter(f, sampleRate))
+	}
+	return &c
+}
+
+func (c *filterChain) Apply(x float64) float64 {
+	for _, s := range c.stages {
+		x = s.Apply(x)
+	}
+	return x
+}
+
+func (c *filterChain) Reset() {
+	for _, s := range c.stages {
+		s.Reset()
+	}
+}
+
+//meanFilter is a running mean, updating its sum in O(1) per sample
+type meanFilter struct {
+	window []float64
+	next   int
+	sum    float64
+}
+
+func newMeanFilter(samples int) *meanFilter {
+	return &meanFilter{
+		window: make([]float64, samples),
+	}
+}
+
+func (f *meanFilter) Apply(x float64) float64 {
+	f.sum += x - f.window[f.next]
+	f.window[f.next] = x
+	f.next++
+
+	// Resum once per window, so rounding error in the running sum cannot accumulate
+	if f.next == len(f.window) {
+		f.next = 0
+		f.sum = 0
+		for _, v := range f.window {
+			f.sum += v
+		}
+	}
+	return f.sum / float64(len(f.window))
+}
+
+func (f *meanFilter) Reset() {
+	for i := range f.window {
+		f.window[i] = 0
+	}
+	f.next = 0
+	f.sum = 0
+}
+
+//medianFilter is a running median, keeping the window both in arrival order and sorted
+type medianFilter struct {
+	window []float64
+	sorted []float64
+	next   int
+}
+
+func newMedianFilter(samples int) *medianFilter {
+	return &medianFilter{
+		window: make([]float64, samples),
+		sorted: make([]float64, samples),
+	}
+}
+
+func (f *medianFilter) Apply(x float64) float64 {
+	// Replace the oldest sample in the sorted window, and shift it into order
+	old := f.window[f.next]
+	f.window[f.next] = x
+	f.next = (f.next + 1) % len(f.window)
+
+	i := sort.SearchFloat64s(f.sorted, old)
+	f.sorted[i] = x
+	for i > 0 && f.sorted[i-1] > f.sorted[i] {
+		f.sorted[i-1], f.sorted[i] = f.sorted[i], f.sorted[i-1]
+		i--
+	}
+	for i < len(f.sorted)-1 && f.sorted[i+1] < f.sorted[i] {
+		f.sorted[i+1], f.sorted[i] = f.sorted[i], f.sorted[i+1]
+		i++
+	}
+
+	n := len(f.sorted)
+	if n%2 == 1 {
+		return f.sorted[n/2]
+	}
+	return (f.sorted[n/2-1] + f.sorted[n/2]) / 2
+}
+
+func (f *medianFilter) Reset() {
+	for i := range f.window {
+		f.window[i] = 0
+		f.sorted[i] = 0
+	}
+	f.next = 0
+}
+
+//emaFilter is a first order low-pass, y += alpha * (x - y)
+type emaFilter struct {
+	alpha float64
+	y     float64
+}
+
+func newEMAFilter(cutoff float64, sampleRate time.Duration) *emaFilter {
+	rc := 1 / (2 * math.Pi * cutoff)
+	dt := sampleRate.Seconds()
+	return &emaFilter{
+		alpha: dt / (rc + dt),
+	}
+}
+
+func (f *emaFilter) Apply(x float64) float64 {
+	f.y += f.alpha * (x - f.y)
+	return f.y
+}
+
+func (f *emaFilter) Reset() {
+	f.y = 0
+}
+
+//butterworthFilter is a second order Butterworth low-pass biquad, designed by the bilinear transform
+type butterworthFilter struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	x1, x2     float64
+	y1, y2     float64
+}
+
+func newButterworthFilter(cutoff float64, sampleRate time.Duration) *butterworthFilter {
+	k := math.Tan(math.Pi * cutoff * sampleRate.Seconds()) //Prewarped cutoff
+	norm := 1 / (1 + math.Sqrt2*k + k*k)
+	b0 := k * k * norm
+
+	return &butterworthFilter{
+		b0: b0,
+		b1: 2 * b0,
+		b2: b0,
+		a1: 2 * (k*k - 1) * norm,
+		a2: (1 - math.Sqrt2*k + k*k) * norm,
+	}
+}
+
+func (f *butterworthFilter) Apply(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+func (f *butterworthFilter) Reset() {
+	f.x1, f.x2, f.y1, f.y2 = 0, 0, 0, 0
+}
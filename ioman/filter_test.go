@@ -0,0 +1,199 @@
+package ioman
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// response returns the output of a freshly reset filter to n samples of a step or an impulse
+func response(f Filter, n int, impulse bool) []float64 {
+	f.Reset()
+	out := make([]float64, n)
+	for i := range out {
+		x := 1.0
+		if impulse && i > 0 {
+			x = 0
+		}
+		out[i] = f.Apply(x)
+	}
+	return out
+}
+
+func TestFilterMean(t *testing.T) {
+	f := newFilter(FilterConfig{Type: FilterMean, Window: 10 * time.Millisecond}, _testSampleRate)
+
+	step := response(f, 20, false)
+	for i, y := range step {
+		expected := math.Min(float64(i+1)/10, 1)
+		if math.Abs(y-expected) > 1e-12 {
+			t.Fatalf("Expected step response %v at sample %v, got %v", expected, i, y)
+		}
+	}
+
+	impulse := response(f, 20, true)
+	for i, y := range impulse {
+		expected := 0.1
+		if i >= 10 {
+			expected = 0
+		}
+		if math.Abs(y-expected) > 1e-12 {
+			t.Fatalf("Expected impulse response %v at sample %v, got %v", expected, i, y)
+		}
+	}
+
+	// Running sum must not drift from the true mean
+	r := rand.New(rand.NewSource(1))
+	window := make([]float64, 10)
+	for i := 0; i < 100000; i++ {
+		x := r.NormFloat64() * 1e6
+		window[i%10] = x
+		y := f.Apply(x)
+		if i > 99990 {
+			sum := 0.0
+			for _, v := range window {
+				sum += v
+			}
+			if math.Abs(y-sum/10) > 1e-6 {
+				t.Fatalf("Expected mean %v, got %v", sum/10, y)
+			}
+		}
+	}
+}
+
+func TestFilterMedian(t *testing.T) {
+	f := newFilter(FilterConfig{Type: FilterMedian, Window: 5 * time.Millisecond}, _testSampleRate)
+
+	step := response(f, 10, false)
+	for i, y := range step {
+		expected := 0.0
+		if i >= 2 {
+			expected = 1
+		}
+		if y != expected {
+			t.Fatalf("Expected step response %v at sample %v, got %v", expected, i, y)
+		}
+	}
+
+	// Spikes are rejected entirely
+	impulse := response(f, 10, true)
+	for i, y := range impulse {
+		if y != 0 {
+			t.Fatalf("Expected impulse to be rejected at sample %v, got %v", i, y)
+		}
+	}
+
+	// Median of an unordered window, with repeated values
+	f.Reset()
+	var y float64
+	for _, x := range []float64{3, -1, 7, 3, 2, 9, 3} {
+		y = f.Apply(x)
+	}
+	if y != 3 {
+		t.Fatalf("Expected median of 3, got %v", y)
+	}
+}
+
+func TestFilterEMA(t *testing.T) {
+	cutoff := 10.0
+	f := newFilter(FilterConfig{Type: FilterEMA, Cutoff: cutoff}, _testSampleRate)
+	tau := int(math.Round(1 / (2 * math.Pi * cutoff) / _testSampleRate.Seconds()))
+
+	// After one time constant the step response reaches 1-1/e, less discretisation error
+	step := response(f, 10*tau, false)
+	if math.Abs(step[tau-1]-(1-1/math.E)) > 0.02 {
+		t.Fatalf("Expected step response of %v after one time constant, got %v", 1-1/math.E, step[tau-1])
+	}
+	if math.Abs(step[len(step)-1]-1) > 1e-3 {
+		t.Fatalf("Expected step response to settle at 1, got %v", step[len(step)-1])
+	}
+
+	// Impulse response decays geometrically, summing to unity gain
+	impulse := response(f, 100*tau, true)
+	sum := 0.0
+	for i, y := range impulse {
+		if i > 0 && y >= impulse[i-1] {
+			t.Fatalf("Expected impulse response to decay at sample %v, got %v after %v", i, y, impulse[i-1])
+		}
+		sum += y
+	}
+	if math.Abs(sum-1) > 1e-6 {
+		t.Fatalf("Expected unity DC gain, got %v", sum)
+	}
+}
+
+func TestFilterButterworth(t *testing.T) {
+	cutoff := 20.0
+	f := newFilter(FilterConfig{Type: FilterButterworth, Cutoff: cutoff}, _testSampleRate)
+
+	// A second order Butterworth overshoots its step response by 4.3%, and settles at unity gain
+	step := response(f, 1000, false)
+	peak := 0.0
+	for _, y := range step {
+		peak = math.Max(peak, y)
+	}
+	if math.Abs(peak-1.043) > 0.005 {
+		t.Fatalf("Expected step overshoot to 1.043, got %v", peak)
+	}
+	if math.Abs(step[len(step)-1]-1) > 1e-6 {
+		t.Fatalf("Expected step response to settle at 1, got %v", step[len(step)-1])
+	}
+
+	impulse := response(f, 1000, true)
+	sum := 0.0
+	for _, y := range impulse {
+		sum += y
+	}
+	if math.Abs(sum-1) > 1e-6 || math.Abs(impulse[len(impulse)-1]) > 1e-9 {
+		t.Fatalf("Expected impulse response with unity gain decaying to 0, got sum %v last %v", sum, impulse[len(impulse)-1])
+	}
+
+	// Attenuates by 3dB at the cutoff
+	f.Reset()
+	amplitude := 0.0
+	for i := 0; i < 2000; i++ {
+		y := f.Apply(math.Sin(2 * math.Pi * cutoff * float64(i) * _testSampleRate.Seconds()))
+		if i > 1000 {
+			amplitude = math.Max(amplitude, y)
+		}
+	}
+	if math.Abs(amplitude-math.Sqrt(0.5)) > 0.01 {
+		t.Fatalf("Expected amplitude of %v at cutoff, got %v", math.Sqrt(0.5), amplitude)
+	}
+}
+
+func TestFilterChain(t *testing.T) {
+	filters, err := ParseFilters("median:3ms, mean:2ms")
+	if err != nil {
+		t.Fatalf("Failed to parse filters: %v", err)
+	}
+	err = ValidateFilters(filters, _testSampleRate)
+	if err != nil {
+		t.Fatalf("Failed to validate filters: %v", err)
+	}
+
+	// The median removes the spike before the mean can smear it
+	c := newFilterChain(filters, _testSampleRate)
+	for i, x := range []float64{0, 0, 10, 0, 0} {
+		y := c.Apply(x)
+		if y != 0 {
+			t.Fatalf("Expected spike to be removed at sample %v, got %v", i, y)
+		}
+	}
+
+	// An empty chain passes samples through
+	if y := newFilterChain(nil, _testSampleRate).Apply(4); y != 4 {
+		t.Fatalf("Expected pass through, got %v", y)
+	}
+
+	for _, spec := range []string{"mean", "mode:5ms", "mean:0.1ms", "butterworth:600", "ema:-1"} {
+		filters, err := ParseFilters(spec)
+		if err == nil {
+			err = ValidateFilters(filters, _testSampleRate)
+		}
+		if err == nil {
+			t.Fatalf("Expected error for filter %v", spec)
+		}
+	}
+}
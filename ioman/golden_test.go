@@ -0,0 +1,238 @@
+package ioman
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Captures in testdata/captures, each with its breaths annotated in <name>.breaths.csv, and the worst detection
+// each must score. Tolerances sit just above the scores at the time of writing, so any regression shows,
+// and no breath may be missed or spurious. Volumes of small breaths are underestimated, as flow below the
+// thresholds of the state machine is not integrated.
+var _goldenCaptures = []struct {
+	name      string
+	tolerance goldenScore
+}{
+	{"spontaneous", goldenScore{StartError: 120 * time.Millisecond, ExpirationError: 170 * time.Millisecond, EndError: 160 * time.Millisecond, InspiredError: 0.1, ExpiredError: 0.1}},
+	{"noisy", goldenScore{StartError: 100 * time.Millisecond, ExpirationError: 120 * time.Millisecond, EndError: 160 * time.Millisecond, InspiredError: 0.1, ExpiredError: 0.1}},
+	{"pressure_control", goldenScore{StartError: 30 * time.Millisecond, ExpirationError: 50 * time.Millisecond, EndError: 160 * time.Millisecond, InspiredError: 0.1, ExpiredError: 0.1}},
+	{"fast_shallow", goldenScore{StartError: 110 * time.Millisecond, ExpirationError: 130 * time.Millisecond, EndError: 160 * time.Millisecond, InspiredError: 0.3, ExpiredError: 0.3}},
+}
+
+// goldenBreath is an annotated breath, as offsets from the start of its capture
+type goldenBreath struct {
+	start      time.Duration
+	expiration time.Duration //Start of expiration
+	end        time.Duration
+	inspired   float64 //Liters
+	expired    float64 //Liters
+}
+
+// goldenScore is how well detected breaths match the annotated breaths of a capture. Errors are the worst of all
+// matched breaths, timing as absolute error and volume as relative error.
+type goldenScore struct {
+	Expected        int
+	Matched         int
+	Missed          int //Annotated breaths with no detected breath
+	Spurious        int //Detected breaths with no annotated breath
+	StartError      time.Duration
+	ExpirationError time.Duration
+	EndError        time.Duration
+	InspiredError   float64
+	ExpiredError    float64
+}
+
+func (s goldenScore) String() string {
+	return fmt.Sprintf("matched %v/%v, missed %v, spurious %v, timing error start %v expiration %v end %v, volume error inspired %.1f%% expired %.1f%%",
+		s.Matched, s.Expected, s.Missed, s.Spurious, s.StartError, s.ExpirationError, s.EndError, s.InspiredError*100, s.ExpiredError*100)
+}
+
+// exceeds returns the measures of s worse than tolerance
+func (s goldenScore) exceeds(tolerance goldenScore) []string {
+	failed := []string{}
+	if s.Missed > tolerance.Missed {
+		failed = append(failed, "missed")
+	}
+	if s.Spurious > tolerance.Spurious {
+		failed = append(failed, "spurious")
+	}
+	if s.StartError > tolerance.StartError {
+		failed = append(failed, "start error")
+	}
+	if s.ExpirationError > tolerance.ExpirationError {
+		failed = append(failed, "expiration error")
+	}
+	if s.EndError > tolerance.EndError {
+		failed = append(failed, "end error")
+	}
+	if s.InspiredError > tolerance.InspiredError {
+		failed = append(failed, "inspired volume error")
+	}
+	if s.ExpiredError > tolerance.ExpiredError {
+		failed = append(failed, "expired volume error")
+	}
+	return failed
+}
+
+func TestGoldenBreaths(t *testing.T) {
+	for _, g := range _goldenCaptures {
+		g := g
+		t.Run(g.name, func(t *testing.T) {
+			records, expected, err := loadGolden(g.name)
+			if err != nil {
+				t.Fatalf("Failed to load capture: %v", err)
+			}
+
+			score := scoreBreaths(expected, detectBreaths(records))
+			t.Logf("%v", score)
+			if failed := score.exceeds(g.tolerance); len(failed) != 0 {
+				t.Fatalf("Detection regressed on %v, tolerance %v", failed, g.tolerance)
+			}
+		})
+	}
+}
+
+// loadGolden loads a capture and its annotated breaths from testdata/captures
+func loadGolden(name string) ([]FlowRecord, []goldenBreath, error) {
+	dir := filepath.Join("testdata", "captures")
+
+	f, err := os.Open(filepath.Join(dir, name+".csv"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open capture: %w", err)
+	}
+	defer f.Close()
+	records, err := ParseFlowCSV(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) < 2 {
+		return nil, nil, fmt.Errorf("Capture %v is too short", name)
+	}
+
+	a, err := os.Open(filepath.Join(dir, name+".breaths.csv"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to open annotations: %w", err)
+	}
+	defer a.Close()
+	cs := csv.NewReader(a)
+	cs.Comment = '#'
+	cs.FieldsPerRecord = 5
+	rows, err := cs.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read annotations: %w", err)
+	}
+
+	breaths := []goldenBreath{}
+	for _, row := range rows {
+		durations := [3]time.Duration{}
+		for i := range durations {
+			durations[i], err = time.ParseDuration(row[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("Failed to parse duration: %v", row[i])
+			}
+		}
+		volumes := [2]float64{}
+		for i := range volumes {
+			volumes[i], err = strconv.ParseFloat(row[3+i], 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Failed to parse volume: %v", row[3+i])
+			}
+		}
+		breaths = append(breaths, goldenBreath{durations[0], durations[1], durations[2], volumes[0], volumes[1]})
+	}
+
+	return records, breaths, nil
+}
+
+// detectBreaths runs the controller over a capture, returning every breath it completes
+func detectBreaths(records []FlowRecord) []goldenBreath {
+	epoch := time.Unix(1000, 0)
+	period := records[1].Offset - records[0].Offset //Filters are designed for the rate of the capture
+	cont := newController(period, NewVirtualClock(epoch))
+
+	detected := []goldenBreath{}
+	last := uint64(0)
+	for _, r := range records {
+		sensors := Sensors{
+			Flow: Flow{
+				Timestamp: epoch.Add(r.Offset),
+				Val:       r.Val,
+			},
+		}
+		cont.buffers(sensors)
+		cont.states(sensors)
+		b := cont.calculate(sensors).Breath
+
+		if b.Number != last {
+			last = b.Number
+			detected = append(detected, goldenBreath{
+				start:      b.Start.Sub(epoch),
+				expiration: b.Start.Add(b.InspiratoryTime).Sub(epoch),
+				end:        b.End.Sub(epoch),
+				inspired:   b.InspiredVolume,
+				expired:    b.ExpiredVolume,
+			})
+		}
+	}
+	return detected
+}
+
+// scoreBreaths matches each annotated breath to the detected breath starting nearest it, within its inspiration
+func scoreBreaths(expected []goldenBreath, detected []goldenBreath) goldenScore {
+	score := goldenScore{Expected: len(expected)}
+	used := make([]bool, len(detected))
+
+	for _, e := range expected {
+		match := -1
+		for i, d := range detected {
+			if used[i] || absDuration(d.start-e.start) > e.expiration-e.start {
+				continue
+			}
+			if match < 0 || absDuration(d.start-e.start) < absDuration(detected[match].start-e.start) {
+				match = i
+			}
+		}
+		if match < 0 {
+			score.Missed++
+			continue
+		}
+		used[match] = true
+		d := detected[match]
+
+		score.Matched++
+		score.StartError = maxDuration(score.StartError, absDuration(d.start-e.start))
+		score.ExpirationError = maxDuration(score.ExpirationError, absDuration(d.expiration-e.expiration))
+		score.EndError = maxDuration(score.EndError, absDuration(d.end-e.end))
+		score.InspiredError = math.Max(score.InspiredError, math.Abs(d.inspired-e.inspired)/e.inspired)
+		score.ExpiredError = math.Max(score.ExpiredError, math.Abs(d.expired-e.expired)/e.expired)
+	}
+
+	// Detected breaths beginning before the first or after the last annotation are cut off by the capture,
+	// and are not counted as spurious
+	for i, d := range detected {
+		if !used[i] && len(expected) > 0 && d.start > expected[0].start && d.start < expected[len(expected)-1].end {
+			score.Spurious++
+		}
+	}
+	return score
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,180 @@
+package ioman
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"periph.io/x/periph/conn/physic"
+)
+
+const _defaultSampleRate = (1 * time.Second) / 1000 //1KHz
+const _minSampleRate = 100 * time.Microsecond       //fastest io loop the SPI and I2C transactions fit into
+const _maxSampleRate = 100 * time.Millisecond       //slowest io loop breath detection and control remain usable at
+const _maxSPISpeed = 2 * physic.MegaHertz           //MCP3208 maximum clock at 5V
+
+//TCA9548A I2C multiplexer
+const _muxAddressMin = 0x70
+const _muxAddressMax = 0x77
+const _muxChannels = 8
+
+//EnumFlowRole is where in the breathing circuit a flow sensor is placed
+type EnumFlowRole int
+
+func (e EnumFlowRole) String() string {
+	switch int(e) {
+	case 0:
+		return "Proximal"
+	case 1:
+		return "Inspiratory"
+	case 2:
+		return "Expiratory"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//RoleProximal is a sensor at the patient wye, measuring flow into the patient as positive. Drives breath detection and control.
+	RoleProximal EnumFlowRole = iota
+	//RoleInspiratory is a sensor in the inspiratory limb, measuring flow towards the patient as positive
+	RoleInspiratory
+	//RoleExpiratory is a sensor in the expiratory limb, measuring flow away from the patient as positive
+	RoleExpiratory
+)
+
+//ParseFlowRole parses the name of a flow sensor role, case insensitive
+func ParseFlowRole(name string) (EnumFlowRole, error) {
+	for _, r := range []EnumFlowRole{RoleProximal, RoleInspiratory, RoleExpiratory} {
+		if strings.EqualFold(name, r.String()) {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown flow sensor role %v, expected proximal, inspiratory or expiratory", name)
+}
+
+//FlowSensorConfig describes one SFM3000 flow sensor
+type FlowSensorConfig struct {
+	Label      string       //Name of the sensor in logs, health and recordings
+	Bus        string       //I2C bus
+	Address    uint8        //I2C address
+	Mux        uint8        //I2C address of a TCA9548A multiplexer the sensor is behind, 0 if connected directly
+	MuxChannel uint8        //Multiplexer channel, 0 to 7
+	IsAir      bool         //Calibrated for air rather than O2
+	Role       EnumFlowRole //Placement in the breathing circuit
+}
+
+//HardwareConfig describes the buses and devices of a rig
+type HardwareConfig struct {
+	SampleRate time.Duration      //Period of the io loop
+	Flows      []FlowSensorConfig //Flow sensors, exactly one of which must be proximal
+	ADCBus     string             //SPI bus of the ADC
+	DACBus     string             //SPI bus of the DAC
+	SPISpeed   physic.Frequency
+}
+
+//DefaultHardwareConfig is the Raspberry Pi rig
+func DefaultHardwareConfig() HardwareConfig {
+	return HardwareConfig{
+		SampleRate: _defaultSampleRate,
+		Flows: []FlowSensorConfig{
+			{Label: "FLOW1", Bus: "/dev/i2c-1", Address: 0x40, IsAir: false, Role: RoleProximal},
+		},
+		ADCBus:   "/dev/spidev0.1",
+		DACBus:   "/dev/spidev0.0",
+		SPISpeed: 1 * physic.MegaHertz,
+	}
+}
+
+//Validate ..
+func (h HardwareConfig) Validate() error {
+	if h.SampleRate < _minSampleRate || h.SampleRate > _maxSampleRate {
+		return fmt.Errorf("Sample rate must be between %v and %v, got %v", _minSampleRate, _maxSampleRate, h.SampleRate)
+	}
+	if h.ADCBus == "" || h.DACBus == "" {
+		return fmt.Errorf("ADC and DAC buses must be set")
+	}
+	if h.ADCBus == h.DACBus {
+		return fmt.Errorf("ADC and DAC must be on different SPI buses, both are %v", h.ADCBus)
+	}
+	if h.SPISpeed <= 0 || h.SPISpeed > _maxSPISpeed {
+		return fmt.Errorf("SPI speed must be positive and at most %v, got %v", _maxSPISpeed, h.SPISpeed)
+	}
+	return validateFlows(h.Flows)
+}
+
+func validateFlows(flows []FlowSensorConfig) error {
+	labels := map[string]bool{}
+	locations := map[FlowSensorConfig]string{}
+	proximal := 0
+
+	for _, f := range flows {
+		if f.Label == "" || labels[f.Label] {
+			return fmt.Errorf("Flow sensor labels must be set and unique, got %q", f.Label)
+		}
+		labels[f.Label] = true
+
+		if f.Bus == "" {
+			return fmt.Errorf("Flow sensor %v I2C bus must be set", f.Label)
+		}
+		if f.Address < 0x08 || f.Address > 0x77 {
+			return fmt.Errorf("Flow sensor %v address 0x%x is outside the 7 bit I2C range 0x08 to 0x77", f.Label, f.Address)
+		}
+		if f.Mux != 0 {
+			if f.Mux < _muxAddressMin || f.Mux > _muxAddressMax {
+				return fmt.Errorf("Flow sensor %v multiplexer address 0x%x is outside the TCA9548A range 0x%x to 0x%x", f.Label, f.Mux, _muxAddressMin, _muxAddressMax)
+			}
+			if f.MuxChannel >= _muxChannels {
+				return fmt.Errorf("Flow sensor %v multiplexer channel must be less than %v, got %v", f.Label, _muxChannels, f.MuxChannel)
+			}
+			if f.Address == f.Mux {
+				return fmt.Errorf("Flow sensor %v address 0x%x is that of its multiplexer", f.Label, f.Address)
+			}
+		} else if f.MuxChannel != 0 {
+			return fmt.Errorf("Flow sensor %v has a multiplexer channel but no multiplexer", f.Label)
+		}
+
+		location := FlowSensorConfig{Bus: f.Bus, Address: f.Address, Mux: f.Mux, MuxChannel: f.MuxChannel}
+		if other, ok := locations[location]; ok {
+			return fmt.Errorf("Flow sensors %v and %v are at the same bus, multiplexer channel and address", other, f.Label)
+		}
+		locations[location] = f.Label
+
+		switch f.Role {
+		case RoleProximal:
+			proximal++
+		case RoleInspiratory, RoleExpiratory:
+		default:
+			return fmt.Errorf("Flow sensor %v has unknown role %v", f.Label, f.Role)
+		}
+	}
+
+	// A multiplexer channel stays selected after a transfer, so sensors behind it share the address space of the bus
+	for _, f := range flows {
+		for _, g := range flows {
+			if f.Mux == 0 && g.Mux != 0 && f.Bus == g.Bus && (f.Address == g.Address || f.Address == g.Mux) {
+				return fmt.Errorf("Flow sensor %v address 0x%x conflicts with multiplexed flow sensor %v on bus %v", f.Label, f.Address, g.Label, f.Bus)
+			}
+		}
+	}
+
+	if proximal != 1 {
+		return fmt.Errorf("Exactly one flow sensor must be proximal, got %v", proximal)
+	}
+	return nil
+}
+
+//Proximal returns the proximal flow sensor, h must have been validated
+func (h HardwareConfig) Proximal() FlowSensorConfig {
+	return h.Flows[proximalFlow(h.Flows)]
+}
+
+// proximalFlow returns the index of the proximal flow sensor of validated flows
+func proximalFlow(flows []FlowSensorConfig) int {
+	for i, f := range flows {
+		if f.Role == RoleProximal {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+package ioman
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/physic"
+)
+
+// flowArray returns a config with a proximal sensor, and inspiratory and expiratory sensors behind a multiplexer
+func flowArray() HardwareConfig {
+	h := DefaultHardwareConfig()
+	h.Flows = []FlowSensorConfig{
+		{Label: "PROX", Bus: "/dev/i2c-0", Address: 0x40, Role: RoleProximal}, //Same address as those behind the multiplexer, so on another bus
+		{Label: "INSP", Bus: "/dev/i2c-1", Address: 0x40, Mux: 0x70, MuxChannel: 0, IsAir: true, Role: RoleInspiratory},
+		{Label: "EXP", Bus: "/dev/i2c-1", Address: 0x40, Mux: 0x70, MuxChannel: 1, Role: RoleExpiratory},
+	}
+	return h
+}
+
+func TestHardwareValidate(t *testing.T) {
+	err := flowArray().Validate()
+	if err != nil {
+		t.Fatalf("Expected flow array to be valid, got %v", err)
+	}
+
+	for name, modify := range map[string]func(h *HardwareConfig){
+		"no flow sensors":     func(h *HardwareConfig) { h.Flows = nil },
+		"no proximal sensor":  func(h *HardwareConfig) { h.Flows[0].Role = RoleInspiratory },
+		"two proximal":        func(h *HardwareConfig) { h.Flows[1].Role = RoleProximal },
+		"duplicate label":     func(h *HardwareConfig) { h.Flows[1].Label = "PROX" },
+		"same location":       func(h *HardwareConfig) { h.Flows[2].MuxChannel = 0 },
+		"mux address":         func(h *HardwareConfig) { h.Flows[1].Mux = 0x60 },
+		"mux channel":         func(h *HardwareConfig) { h.Flows[1].MuxChannel = 8 },
+		"channel without mux": func(h *HardwareConfig) { h.Flows[0].MuxChannel = 1 },
+		"shared address":      func(h *HardwareConfig) { h.Flows[0].Bus = "/dev/i2c-1" },
+		"unknown role":        func(h *HardwareConfig) { h.Flows[2].Role = EnumFlowRole(5) },
+	} {
+		h := flowArray()
+		modify(&h)
+		if h.Validate() == nil {
+			t.Fatalf("Expected %v to be invalid", name)
+		}
+	}
+
+	if flowArray().Proximal().Label != "PROX" {
+		t.Fatalf("Expected PROX to be proximal, got %+v", flowArray().Proximal())
+	}
+	role, err := ParseFlowRole("Expiratory")
+	if err != nil || role != RoleExpiratory {
+		t.Fatalf("Expected expiratory role, got %v %v", role, err)
+	}
+}
+
+type fakeBus struct {
+	tx [][2]uint16 //address and first byte written of each transfer
+}
+
+func (b *fakeBus) String() string                    { return "FAKEBUS" }
+func (b *fakeBus) SetSpeed(f physic.Frequency) error { return nil }
+func (b *fakeBus) Tx(addr uint16, w []byte, r []byte) error {
+	first := uint16(0)
+	if len(w) > 0 {
+		first = uint16(w[0])
+	}
+	b.tx = append(b.tx, [2]uint16{addr, first})
+	return nil
+}
+
+func TestMuxBus(t *testing.T) {
+	bus := &fakeBus{}
+	a := &muxBus{Bus: bus, mux: 0x70, channel: 0}
+	b := &muxBus{Bus: bus, mux: 0x70, channel: 5}
+
+	_ = a.Tx(0x40, []byte{0x10}, nil)
+	_ = b.Tx(0x40, []byte{0x20}, nil)
+	_ = a.Tx(0x40, nil, make([]byte, 3))
+
+	// Every transfer is preceded by selecting its channel
+	expected := [][2]uint16{{0x70, 0x01}, {0x40, 0x10}, {0x70, 0x20}, {0x40, 0x20}, {0x70, 0x01}, {0x40, 0}}
+	if len(bus.tx) != len(expected) {
+		t.Fatalf("Expected %v transfers, got %v", len(expected), bus.tx)
+	}
+	for i := range expected {
+		if bus.tx[i] != expected[i] {
+			t.Fatalf("Expected transfer %v to be %x, got %x", i, expected[i], bus.tx[i])
+		}
+	}
+}
+
+func TestIOManFlowArray(t *testing.T) {
+	if _, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   &fakeDAC{},
+	}, flowArray()); err == nil {
+		t.Fatalf("Expected fewer devices than configured flow sensors to be rejected")
+	}
+
+	// The inspiratory sensor is configured for air, fakeFlow encodes for O2
+	config := flowArray()
+	config.Flows[1].IsAir = false
+	config.Flows[0], config.Flows[2] = config.Flows[2], config.Flows[0]
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 2}, &fakeFlow{val: 12}, &fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   &fakeDAC{},
+	}, config)
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+
+	startIOMan(t, iom)
+	time.Sleep(200 * time.Millisecond)
+
+	dp := iom.GetDataPacket()
+	if !dp.Valid || dp.Sensors.Flow.Val != 10 || dp.Sensors.Flow.Role != RoleProximal {
+		t.Fatalf("Expected the proximal sensor to drive breath detection, got %+v", dp.Sensors.Flow)
+	}
+	if len(dp.Sensors.Flows) != 3 || dp.Sensors.Flows[0].Role != RoleExpiratory || math.Abs(dp.Sensors.Flows[1].Val-12) > 0.01 {
+		t.Fatalf("Expected every flow sensor in config order, got %+v", dp.Sensors.Flows)
+	}
+	if len(dp.Health.Flows) != 3 || dp.Health.Degraded() {
+		t.Fatalf("Expected three healthy flow sensors, got %+v", dp.Health)
+	}
+}
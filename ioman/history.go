@@ -0,0 +1,270 @@
+package ioman
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const _historyDuration = 5 * time.Minute //default duration of samples kept
+const _historyShardSize = 1024           //samples per shard, the unit of locking between the io loop and readers
+const _historyBreaths = 1024             //breaths kept, regardless of duration
+
+//DefaultHistory is the duration of samples kept unless set by SetHistory
+func DefaultHistory() time.Duration {
+	return _historyDuration
+}
+
+//HistoryBucket aggregates consecutive samples of the history
+type HistoryBucket struct {
+	Start          time.Time //Timestamp of the first sample
+	End            time.Time //Timestamp of the last sample
+	Samples        int       //Samples in the bucket, valid or not
+	Flow           Aggregate //SLM
+	Volume         Aggregate //Liters of flow integrated since the start of each sample's breath
+	AirwayPressure Aggregate //cmH2O
+	Oxygen         Aggregate //Percent O2
+	SupplyPressure Aggregate //kPa
+}
+
+//Aggregate is the minimum, maximum and mean of the valid samples of a quantity in a HistoryBucket
+type Aggregate struct {
+	Min   float64
+	Max   float64
+	Mean  float64
+	Count int //Valid samples, all values are 0 where none were valid
+}
+
+func (a *Aggregate) add(v float64) {
+	if a.Count == 0 {
+		a.Min, a.Max = v, v
+	}
+	a.Min = math.Min(a.Min, v)
+	a.Max = math.Max(a.Max, v)
+	a.Mean += v //Sum until finished
+	a.Count++
+}
+
+func (a *Aggregate) addMeasurement(m Measurement) {
+	if m.Valid {
+		a.add(m.Val)
+	}
+}
+
+func (a *Aggregate) finish() {
+	if a.Count > 0 {
+		a.Mean /= float64(a.Count)
+	}
+}
+
+//historySample is the part of a DataPacket kept in the history
+type historySample struct {
+	t              int64 //unix nanoseconds
+	valid          bool
+	flow           float64
+	volume         float64
+	airwayPressure Measurement
+	oxygen         Measurement
+	supplyPressure Measurement
+}
+
+type historyShard struct {
+	mshard  sync.RWMutex
+	samples [_historyShardSize]historySample
+}
+
+//history keeps the last samples and breaths in rings. The sample ring is split into shards with their own lock,
+//so the io loop only ever waits on a reader of the one shard it is writing to.
+type history struct {
+	shards []historyShard
+	length uint64 //samples readable, the ring holds one more shard that is being overwritten
+
+	mhead sync.Mutex
+	head  uint64 //samples written
+
+	mbreaths sync.Mutex
+	breaths  [_historyBreaths]Breath
+	nbreaths uint64 //breaths written
+	last     uint64 //number of the last breath written
+}
+
+func newHistory(duration time.Duration, sampleRate time.Duration) *history {
+	length := uint64(duration / sampleRate)
+	return &history{
+		shards: make([]historyShard, (length+_historyShardSize-1)/_historyShardSize+1),
+		length: length,
+	}
+}
+
+//ValidateHistory ..
+func ValidateHistory(duration time.Duration, sampleRate time.Duration) error {
+	if duration < sampleRate {
+		return fmt.Errorf("History duration must be at least one sample of %v, got %v", sampleRate, duration)
+	}
+	return nil
+}
+
+// add appends a DataPacket to the history. Must only be called from the io loop.
+func (h *history) add(d DataPacket) {
+	pos := h.head % uint64(len(h.shards)*_historyShardSize)
+	shard := &h.shards[pos/_historyShardSize]
+
+	shard.mshard.Lock()
+	shard.samples[pos%_historyShardSize] = historySample{
+		t:              d.Timestamp.UnixNano(),
+		valid:          d.Valid,
+		flow:           d.Sensors.Flow.Val,
+		volume:         d.Calculated.Volume,
+		airwayPressure: d.Sensors.AirwayPressure,
+		oxygen:         d.Sensors.Oxygen,
+		supplyPressure: d.Sensors.SupplyPressure,
+	}
+	shard.mshard.Unlock()
+
+	h.mhead.Lock()
+	h.head++
+	h.mhead.Unlock()
+
+	breath := d.Calculated.Breath
+	if breath.Number != 0 && breath.Number != h.last {
+		h.mbreaths.Lock()
+		h.breaths[h.nbreaths%_historyBreaths] = breath
+		h.nbreaths++
+		h.last = breath.Number
+		h.mbreaths.Unlock()
+	}
+}
+
+// bounds returns the index of the oldest readable sample, and the number of samples written
+func (h *history) bounds() (uint64, uint64) {
+	h.mhead.Lock()
+	defer h.mhead.Unlock()
+
+	if h.head <= h.length {
+		return 0, h.head
+	}
+	return h.head - h.length, h.head
+}
+
+// each calls fn with the samples from index first up to but excluding end, holding each shard's lock once
+func (h *history) each(first uint64, end uint64, fn func(s historySample)) {
+	capacity := uint64(len(h.shards) * _historyShardSize)
+	for i := first; i < end; {
+		pos := i % capacity
+		shard := &h.shards[pos/_historyShardSize]
+		n := _historyShardSize - pos%_historyShardSize
+		if i+n > end {
+			n = end - i
+		}
+
+		shard.mshard.RLock()
+		for _, s := range shard.samples[pos%_historyShardSize : pos%_historyShardSize+n] {
+			fn(s)
+		}
+		shard.mshard.RUnlock()
+		i += n
+	}
+}
+
+// search returns the index of the first sample at or after t, between first and end
+func (h *history) search(t int64, first uint64, end uint64) uint64 {
+	for first < end {
+		mid := first + (end-first)/2
+		var st int64
+		h.each(mid, mid+1, func(s historySample) { st = s.t })
+		if st < t {
+			first = mid + 1
+		} else {
+			end = mid
+		}
+	}
+	return first
+}
+
+// query aggregates the samples between from and to inclusive into buckets of decimation samples
+func (h *history) query(from time.Time, to time.Time, decimation int) ([]HistoryBucket, error) {
+	if decimation < 1 {
+		return nil, fmt.Errorf("Decimation must be at least 1, got %v", decimation)
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("History end %v is before start %v", to, from)
+	}
+
+	oldest, head := h.bounds()
+	if head == oldest {
+		return []HistoryBucket{}, nil
+	}
+	tfrom, tto := from.UnixNano(), to.UnixNano()
+
+	// Samples the io loop writes from here on overwrite the oldest, and are excluded by being newer than the last
+	var tlast int64
+	h.each(head-1, head, func(s historySample) { tlast = s.t })
+	if tlast < tto {
+		tto = tlast
+	}
+
+	first := h.search(tfrom, oldest, head)
+	end := h.search(tto+1, first, head)
+
+	buckets := make([]HistoryBucket, 0, (end-first+uint64(decimation)-1)/uint64(decimation))
+	var b HistoryBucket
+	h.each(first, end, func(s historySample) {
+		// Overwritten since the search
+		if s.t < tfrom || s.t > tto {
+			return
+		}
+
+		if b.Samples == 0 {
+			b.Start = time.Unix(0, s.t)
+		}
+		b.End = time.Unix(0, s.t)
+		b.Samples++
+		if s.valid {
+			b.Flow.add(s.flow)
+			b.Volume.add(s.volume)
+		}
+		b.AirwayPressure.addMeasurement(s.airwayPressure)
+		b.Oxygen.addMeasurement(s.oxygen)
+		b.SupplyPressure.addMeasurement(s.supplyPressure)
+
+		if b.Samples == decimation {
+			buckets = append(buckets, b.finish())
+			b = HistoryBucket{}
+		}
+	})
+	if b.Samples > 0 {
+		buckets = append(buckets, b.finish())
+	}
+
+	return buckets, nil
+}
+
+func (b HistoryBucket) finish() HistoryBucket {
+	b.Flow.finish()
+	b.Volume.finish()
+	b.AirwayPressure.finish()
+	b.Oxygen.finish()
+	b.SupplyPressure.finish()
+	return b
+}
+
+// breathsBetween returns the kept breaths that ended between from and to inclusive, oldest first
+func (h *history) breathsBetween(from time.Time, to time.Time) []Breath {
+	h.mbreaths.Lock()
+	defer h.mbreaths.Unlock()
+
+	first := uint64(0)
+	if h.nbreaths > _historyBreaths {
+		first = h.nbreaths - _historyBreaths
+	}
+
+	breaths := []Breath{}
+	for i := first; i < h.nbreaths; i++ {
+		b := h.breaths[i%_historyBreaths]
+		if !b.End.Before(from) && !b.End.After(to) {
+			breaths = append(breaths, b)
+		}
+	}
+	return breaths
+}
@@ -0,0 +1,178 @@
+package ioman
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// historyPacket returns a DataPacket at ms milliseconds with flow equal to ms
+func historyPacket(start time.Time, ms int) DataPacket {
+	d := DataPacket{
+		Valid:     true,
+		Timestamp: start.Add(time.Duration(ms) * time.Millisecond),
+	}
+	d.Sensors.Flow.Val = float64(ms)
+	d.Sensors.AirwayPressure = Measurement{Val: float64(ms % 10), Valid: ms%2 == 0}
+	return d
+}
+
+func TestHistoryQuery(t *testing.T) {
+	start := time.Unix(1000, 0)
+	h := newHistory(time.Second, _defaultSampleRate)
+	for ms := 0; ms < 100; ms++ {
+		h.add(historyPacket(start, ms))
+	}
+
+	ms := func(n int) time.Time { return start.Add(time.Duration(n) * time.Millisecond) }
+	buckets, err := h.query(ms(10), ms(29), 10)
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("Expected 2 buckets of 10 samples, got %v", len(buckets))
+	}
+
+	b := buckets[0]
+	if b.Samples != 10 || !b.Start.Equal(ms(10)) || !b.End.Equal(ms(19)) {
+		t.Fatalf("Unexpected bucket bounds: %+v", b)
+	}
+	if b.Flow.Min != 10 || b.Flow.Max != 19 || b.Flow.Mean != 14.5 || b.Flow.Count != 10 {
+		t.Fatalf("Unexpected flow aggregate: %+v", b.Flow)
+	}
+	if b.AirwayPressure.Count != 5 || b.AirwayPressure.Min != 0 || b.AirwayPressure.Max != 8 || b.AirwayPressure.Mean != 4 {
+		t.Fatalf("Expected pressure to aggregate only valid samples, got %+v", b.AirwayPressure)
+	}
+	if b.Oxygen.Count != 0 || b.Oxygen.Mean != 0 {
+		t.Fatalf("Expected no oxygen samples, got %+v", b.Oxygen)
+	}
+
+	// A partial last bucket, and a range beyond the samples written
+	buckets, _ = h.query(ms(95), ms(200), 3)
+	if len(buckets) != 2 || buckets[1].Samples != 2 || buckets[1].Flow.Max != 99 {
+		t.Fatalf("Expected a partial bucket ending at the last sample, got %+v", buckets)
+	}
+	buckets, _ = h.query(ms(200), ms(300), 1)
+	if len(buckets) != 0 {
+		t.Fatalf("Expected no samples after the last, got %v", len(buckets))
+	}
+
+	if _, err := h.query(ms(0), ms(10), 0); err == nil {
+		t.Fatalf("Expected decimation of 0 to be rejected")
+	}
+	if _, err := h.query(ms(10), ms(0), 1); err == nil {
+		t.Fatalf("Expected a reversed range to be rejected")
+	}
+}
+
+func TestHistoryWrap(t *testing.T) {
+	start := time.Unix(1000, 0)
+	duration := 3 * _historyShardSize * _defaultSampleRate / 2
+	h := newHistory(duration, _defaultSampleRate)
+
+	total := 5 * _historyShardSize
+	for ms := 0; ms < total; ms++ {
+		h.add(historyPacket(start, ms))
+	}
+
+	// Only the last duration is kept, in order
+	buckets, _ := h.query(start, start.Add(time.Duration(total)*time.Millisecond), 1)
+	if len(buckets) != int(duration/_defaultSampleRate) {
+		t.Fatalf("Expected %v samples kept, got %v", int(duration/_defaultSampleRate), len(buckets))
+	}
+	for i, b := range buckets {
+		expected := float64(total - len(buckets) + i)
+		if b.Flow.Mean != expected {
+			t.Fatalf("Expected sample %v to be %v, got %v", i, expected, b.Flow.Mean)
+		}
+	}
+}
+
+func TestHistoryBreaths(t *testing.T) {
+	start := time.Unix(1000, 0)
+	h := newHistory(time.Second, _defaultSampleRate)
+
+	for ms := 0; ms < 3*_historyBreaths; ms++ {
+		d := historyPacket(start, ms)
+		d.Calculated.Breath.Number = uint64(ms/2 + 1) // Each breath is seen on two packets
+		d.Calculated.Breath.End = d.Timestamp
+		h.add(d)
+	}
+
+	breaths := h.breathsBetween(start, start.Add(time.Hour))
+	if len(breaths) != _historyBreaths {
+		t.Fatalf("Expected %v breaths kept, got %v", _historyBreaths, len(breaths))
+	}
+	last := uint64(3 * _historyBreaths / 2)
+	if breaths[0].Number != last-_historyBreaths+1 || breaths[len(breaths)-1].Number != last {
+		t.Fatalf("Expected the last %v breaths oldest first, got %v to %v", _historyBreaths, breaths[0].Number, breaths[len(breaths)-1].Number)
+	}
+
+	end := start.Add(time.Duration(3*_historyBreaths-1) * time.Millisecond)
+	breaths = h.breathsBetween(end.Add(-9*time.Millisecond), end)
+	if len(breaths) != 5 {
+		t.Fatalf("Expected 5 breaths in the last 10ms, got %v", len(breaths))
+	}
+}
+
+func TestHistoryVolume(t *testing.T) {
+	period := 4 * time.Second
+	flows := syntheticBreaths(3, period, 30, 1)
+	h := newHistory(time.Minute, _testSampleRate)
+
+	cont := newController(_testSampleRate, SystemClock())
+	var last Breath
+	for _, f := range flows {
+		sensors := Sensors{Flow: f}
+		cont.buffers(sensors)
+		cont.states(sensors)
+		d := DataPacket{Valid: true, Timestamp: f.Timestamp, Sensors: sensors, Calculated: cont.calculate(sensors)}
+		last = d.Calculated.Breath
+		h.add(d)
+	}
+
+	// Over a breath the volume rises from 0 to the inspired volume, and falls back as it is expired
+	buckets, err := h.query(last.Start, last.End.Add(-_testSampleRate), int(period/_testSampleRate))
+	if err != nil || len(buckets) != 1 {
+		t.Fatalf("Expected one bucket over breath %v, got %v %v", last.Number, buckets, err)
+	}
+	volume := buckets[0].Volume
+	if math.Abs(volume.Max-last.InspiredVolume) > 0.02*last.InspiredVolume {
+		t.Fatalf("Expected a maximum volume of the inspired %v, got %+v", last.InspiredVolume, volume)
+	}
+	if math.Abs(volume.Min) > 0.02*last.InspiredVolume {
+		t.Fatalf("Expected a minimum volume of around 0, got %+v", volume)
+	}
+	if volume.Mean < 0.3*last.InspiredVolume || volume.Mean > 0.7*last.InspiredVolume {
+		t.Fatalf("Expected a mean volume of around half the inspired %v, got %+v", last.InspiredVolume, volume)
+	}
+}
+
+func TestHistoryConcurrent(t *testing.T) {
+	start := time.Unix(1000, 0)
+	h := newHistory(2*_historyShardSize*_defaultSampleRate, _defaultSampleRate)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ms := 0; ms < 20*_historyShardSize; ms++ {
+			h.add(historyPacket(start, ms))
+		}
+	}()
+
+	// Readers see ordered samples within the range while the ring is overwritten
+	for i := 0; i < 100; i++ {
+		buckets, err := h.query(start, start.Add(time.Hour), 1)
+		if err != nil {
+			t.Fatalf("Failed to query: %v", err)
+		}
+		for j := 1; j < len(buckets); j++ {
+			if !buckets[j].Start.After(buckets[j-1].Start) {
+				t.Fatalf("Expected samples in order, got %v after %v", buckets[j].Start, buckets[j-1].Start)
+			}
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,51 @@
+package ioman
+
+import (
+	"math"
+	"time"
+)
+
+//integrator integrates flow in SLM to liters with the trapezoidal rule over the sample timestamps,
+//so that irregular and dropped samples are integrated over the time they actually span
+type integrator struct {
+	total     float64 //liters
+	error     float64 //estimated truncation error in liters, an estimate rather than a bound
+	n         uint64
+	lastTime  time.Time
+	lastVal   float64
+	lastSlope float64 //SLM per minute
+	lastDt    float64 //minutes
+}
+
+func (i *integrator) reset() {
+	*i = integrator{}
+}
+
+func (i *integrator) add(t time.Time, val float64) {
+
+	if i.n > 0 {
+		dt := t.Sub(i.lastTime).Minutes()
+		if dt <= 0 { // Duplicate or out of order sample, cannot be integrated
+			return
+		}
+
+		i.total += (i.lastVal + val) / 2 * dt
+
+		// Trapezoidal truncation error over a segment is dt^3/12 * f'', with f'' estimated from adjacent segment slopes
+		slope := (val - i.lastVal) / dt
+		if i.n > 1 {
+			curvature := math.Abs(slope-i.lastSlope) / ((dt + i.lastDt) / 2)
+			i.error += curvature * dt * dt * dt / 12
+			if i.n == 2 { // First segment had no neighbour to estimate curvature from
+				i.error += curvature * i.lastDt * i.lastDt * i.lastDt / 12
+			}
+		}
+
+		i.lastSlope = slope
+		i.lastDt = dt
+	}
+
+	i.lastTime = t
+	i.lastVal = val
+	i.n++
+}
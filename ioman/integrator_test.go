@@ -0,0 +1,74 @@
+package ioman
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// integrate samples f at 1KHz over duration, skipping samples where drop returns true
+func integrate(f func(t float64) float64, duration time.Duration, drop func(i int) bool) integrator {
+	start := time.Now()
+	i := integrator{}
+
+	n := int(duration / _testSampleRate)
+	for s := 0; s <= n; s++ {
+		if s != 0 && s != n && drop(s) {
+			continue
+		}
+		offset := time.Duration(s) * _testSampleRate
+		i.add(start.Add(offset), f(offset.Minutes()))
+	}
+	return i
+}
+
+func TestIntegratorAnalytic(t *testing.T) {
+
+	none := func(int) bool { return false }
+	r := rand.New(rand.NewSource(1))
+	dropped := func(int) bool { return r.Float64() < 0.3 }  // 30% of samples missing
+	burst := func(i int) bool { return i > 200 && i < 400 } // 200ms gap
+
+	cases := []struct {
+		name     string
+		f        func(t float64) float64 //SLM at t minutes
+		duration time.Duration
+		expected float64 //liters
+		drop     func(i int) bool
+	}{
+		{"constant", func(t float64) float64 { return 30 }, time.Second, 0.5, none},
+		{"ramp", func(t float64) float64 { return 3600 * t }, time.Second, 1800 * math.Pow(1.0/60, 2), none},
+		{"ramp with dropped samples", func(t float64) float64 { return 3600 * t }, time.Second, 1800 * math.Pow(1.0/60, 2), dropped},
+		{"half sine", func(t float64) float64 { return 30 * math.Sin(math.Pi*t*30) }, 2 * time.Second, 2 * 30 / (math.Pi * 30), none},
+		{"half sine with dropped samples", func(t float64) float64 { return 30 * math.Sin(math.Pi*t*30) }, 2 * time.Second, 2 * 30 / (math.Pi * 30), dropped},
+		{"half sine with gap", func(t float64) float64 { return 30 * math.Sin(math.Pi*t*30) }, 2 * time.Second, 2 * 30 / (math.Pi * 30), burst},
+	}
+
+	for _, c := range cases {
+		i := integrate(c.f, c.duration, c.drop)
+
+		actual := math.Abs(i.total - c.expected)
+		if actual > 1e-9 && actual > 2*i.error {
+			t.Errorf("%v: expected %v liters, got %v; error %v exceeds estimate %v", c.name, c.expected, i.total, actual, i.error)
+		}
+		if i.error > 1e-3*c.expected {
+			t.Errorf("%v: error estimate %v is implausibly large for %v liters", c.name, i.error, c.expected)
+		}
+	}
+}
+
+func TestIntegratorOutOfOrder(t *testing.T) {
+
+	start := time.Now()
+	i := integrator{}
+	i.add(start, 60)
+	i.add(start.Add(time.Second), 60)
+	i.add(start.Add(time.Second), 1000)        // Duplicate timestamp is ignored
+	i.add(start.Add(500*time.Millisecond), 99) // Out of order is ignored
+	i.add(start.Add(2*time.Second), 60)
+
+	if math.Abs(i.total-2) > 1e-9 {
+		t.Fatalf("Expected 2 liters, got %v", i.total)
+	}
+}
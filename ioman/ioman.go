@@ -1,249 +1,566 @@
 package ioman
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
-	"periph.io/x/periph/conn/i2c"
-	"periph.io/x/periph/conn/i2c/i2creg"
-
-	"github.com/kaelanfouwels/iodrivers/i2c/sfm3000"
-	"github.com/kaelanfouwels/iodrivers/spi/mcp3208"
-	"github.com/kaelanfouwels/iodrivers/spi/mcp4921"
-	"periph.io/x/periph/conn/physic"
-	"periph.io/x/periph/conn/spi"
-	"periph.io/x/periph/conn/spi/spireg"
 	"periph.io/x/periph/host"
-)
-
-const _sampleRate = (1 * time.Second) / 1000 //1KHz
 
-const _flow1Address = 0x40
-const _flow1IsAir = false
-const _i2cBus = "/dev/i2c-1"
+	"github.com/kaelanfouwels/gogles/logman"
+)
 
-const _adcSpiBus = "/dev/spidev0.1"
-const _dacSpiBus = "/dev/spidev0.0"
-const _spiSpeed = physic.Frequency(1 * physic.MegaHertz)
+const _stopRetries = 3 //attempts at writing the closed safe state on stop
 
 //IOMan ..
 type IOMan struct {
-	sensors  *phySensors
+	hardware HardwareConfig
+	sensors  *Devices
+	clock    Clock
+	channels []ChannelConfig
+	filters  []FilterConfig //Flow filter chain
+	trigger  TriggerConfig
+	breath   BreathConfig
+	recorder *Recorder
+	proximal int          //Index of the proximal flow sensor
+	rflows   []*recoverer //Health and recovery of each device
+	radc     *recoverer
+	rdac     *recoverer
+	stats    *statsCollector
+	pub      *publisher
+	history  *history
+	mode     Mode
+	mvalve   sync.Mutex
+	command  uint16     //Last DAC value written
+	faulted  bool       //Valve is in the closed safe state
 	o        DataPacket //Output data variables - external buffer. DataPacket is copied from working buffer to output buffer at end of io cycle.
 	moutputs sync.Mutex
 }
 
-type phySensors struct {
-	Flow *sfm3000.SFM3000
-	ADC  *mcp3208.Mcp3208
-	DAC  *mcp4921.Mcp4921
-}
-
-//NewIOMan ..
-func NewIOMan() (*IOMan, error) {
-	iom := IOMan{}
+//NewIOMan creates an IOMan on the physical buses described by config
+func NewIOMan(config HardwareConfig) (*IOMan, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hardware config: %w", err)
+	}
 
-	logf("ioman", "Initializing sensors")
-	sens, err := iom.initialize()
+	logman.Infof("ioman", "Initializing sensors")
+	sens, err := initialize(config)
 	if err != nil {
-		logf("ioman", "Initialization failed")
+		logman.Errorf("ioman", "Initialization failed")
 		return nil, fmt.Errorf("Failed to initialize: %w", err)
 	}
 
-	logf("ioman", "Performing Self Test")
-	err = iom.selftest(sens)
+	return NewIOManWithDevices(*sens, config)
+}
+
+//NewIOManWithDevices creates an IOMan on injected device implementations, such as fakes or simulators.
+//Only the sample rate, and the gas and role of each flow sensor of config apply, the buses are those of the devices.
+func NewIOManWithDevices(devices Devices, config HardwareConfig) (*IOMan, error) {
+	if len(devices.Flows) == 0 || devices.ADC == nil || devices.DAC == nil {
+		return nil, fmt.Errorf("Devices must provide a Flow, ADC and DAC implementation")
+	}
+	for _, f := range devices.Flows {
+		if f == nil {
+			return nil, fmt.Errorf("Devices must not provide a nil Flow implementation")
+		}
+	}
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hardware config: %w", err)
+	}
+	if len(devices.Flows) != len(config.Flows) {
+		return nil, fmt.Errorf("Devices provide %v flow sensors, hardware config describes %v", len(devices.Flows), len(config.Flows))
+	}
+
+	clock := devices.Clock
+	if clock == nil {
+		clock = SystemClock()
+	}
+
+	iom := IOMan{
+		hardware: config,
+		clock:    clock,
+		proximal: proximalFlow(config.Flows),
+		channels: DefaultChannelMap(),
+		filters:  DefaultFlowFilters(),
+		trigger:  DefaultTriggerConfig(),
+		breath:   DefaultBreathConfig(),
+		mode:     &standby{},
+		stats:    newStatsCollector(config.SampleRate, len(config.Flows)),
+		pub:      newPublisher(),
+		history:  newHistory(_historyDuration, config.SampleRate),
+	}
+
+	logman.Infof("ioman", "Performing Self Test")
+	err = iom.selftest(&devices)
 	if err != nil {
-		logf("ioman", "Self test failed")
+		logman.Errorf("ioman", "Self test failed")
 		return nil, fmt.Errorf("Failed to self test: %w", err)
 	}
 
-	iom.sensors = sens
+	iom.sensors = &devices
+	for i, f := range config.Flows {
+		i := i
+		iom.rflows = append(iom.rflows, newRecoverer(f.Label, iom.clock, func(attempt uint64) error { return iom.recoverFlow(i, attempt) }))
+	}
+	iom.radc = newRecoverer(devices.ADC.Label(), iom.clock, iom.recoverADC)
+	iom.rdac = newRecoverer(devices.DAC.Label(), iom.clock, iom.recoverDAC)
 
 	return &iom, nil
 }
 
-func (io *IOMan) initialize() (*phySensors, error) {
+func initialize(config HardwareConfig) (*Devices, error) {
 
 	//Initialize host - required for SPI driver
-	logf("ioman:initialize", "Initializing host")
+	logman.Infof("ioman:initialize", "Initializing host")
 	_, err := host.Init()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize periph.io host: %v", err)
 	}
 
-	//Initialize I2C
-	logf("ioman:initialize", "Initializing I2C on bus %v", _i2cBus)
-	i2cbus, err := i2creg.Open(_i2cBus)
+	flows := []FlowSensor{}
+	for _, f := range config.Flows {
+		f := f
+		flow := newReopenableFlow(f.Label, func() (FlowSensor, closer, error) { return openFlow(f) })
+		err = flow.Reopen()
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, flow)
+	}
+
+	adc1 := newReopenableADC("ADC1", func() (ADCReader, closer, error) { return openADC1(config) })
+	err = adc1.Reopen()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create I2C device: %w", err)
+		return nil, err
 	}
-	//Initialize SPI1
-	logf("ioman:initialize", "Initializing SPI on bus %v at %v ", _adcSpiBus, _spiSpeed)
-	s1bus, err := spireg.Open(_adcSpiBus)
+
+	dac1 := newReopenableDAC("DAC1", func() (DACWriter, closer, error) { return openDAC1(config) })
+	err = dac1.Reopen()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open SPI bus %v: %v", _adcSpiBus, err)
+		return nil, err
 	}
 
-	conn1, err := s1bus.Connect(_spiSpeed, spi.Mode0, 8)
+	return &Devices{
+		Flows: flows,
+		ADC:   adc1,
+		DAC:   dac1,
+	}, nil
+}
+
+func (io *IOMan) selftest(sensors *Devices) error {
+	for _, f := range sensors.Flows {
+		err := testFlow(f, io.clock)
+		if err != nil {
+			return err
+		}
+	}
+	err := testADC(sensors.ADC, io.clock)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to connect SPI: %v", err)
+		return err
 	}
+	return testDAC(sensors.DAC)
+}
 
-	//Initialize SPI2
-	logf("ioman:initialize", "Initializing SPI on bus %v at %v ", _dacSpiBus, _spiSpeed)
-	s2bus, err := spireg.Open(_dacSpiBus)
+func testFlow(flow FlowSensor, clock Clock) error {
+	logman.Infof("ioman:selftest", "Testing %v", flow.Label())
+
+	err := flow.SoftReset()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open SPI bus %v: %v", _adcSpiBus, err)
+		return fmt.Errorf("Failed to soft reset %v: %w", flow.Label(), err)
 	}
+	logman.Infof("ioman:selftest", "%v soft-reset OK", flow.Label())
+	clock.Sleep(100 * time.Millisecond) // Wait for sensor to reset
 
-	conn2, err := s2bus.Connect(_spiSpeed, spi.Mode0, 8)
+	serial, err := flow.GetSerial()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to connect SPI: %v", err)
+		return fmt.Errorf("Failed to get %v serial number: %w", flow.Label(), err)
 	}
+	logman.Infof("ioman:selftest", "%v serial number OK: %v", flow.Label(), serial)
 
-	//Initialize SFM3000
-	logf("ioman:initialize", "Initializing SFM3000 on I2C bus %v 0x%x as %v", _i2cBus, _flow1Address, "FLOW1")
+	_, _, _, _ = flow.GetRaw() //First value is expected to be garbage
 
-	dev := i2c.Dev{
-		Bus:  i2cbus,
-		Addr: _flow1Address,
+	raw, crc, _, err := flow.GetRaw()
+	if err != nil {
+		return fmt.Errorf("Failed to get %v value: %w", flow.Label(), err)
 	}
+	logman.Infof("ioman:selftest", "%v flow value OK: 0x%x crc 0x%x", flow.Label(), raw, crc)
+	return nil
+}
+
+func testADC(adc ADCReader, clock Clock) error {
+	logman.Infof("ioman:selftest", "Testing %v", adc.Label())
 
-	flow1, err := sfm3000.NewSFM3000(&dev, _flow1Address, _flow1IsAir, "FLOW1")
+	_, _, _ = adc.GetValues(0, 4) //First value is expected to be garbage
+	clock.Sleep(50 * time.Millisecond)
+
+	vals, _, err := adc.GetValues(0, 4)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create SFM3000: %w", err)
+		return fmt.Errorf("Failed to get %v values: %w", adc.Label(), err)
 	}
+	logman.Infof("ioman:selftest", "%v adc values OK: %v ", adc.Label(), vals)
+	return nil
+}
 
-	//Initialize MCP3208
-	logf("ioman:initialize", "Initializing MCP3208 on SPI bus %v as %v", _adcSpiBus, "ADC1")
-	adc1, err := mcp3208.NewMcp3208(conn1, "ADC1")
+func testDAC(dac DACWriter) error {
+	logman.Infof("ioman:selftest", "Testing %v", dac.Label())
+	err := dac.Write(0) //Write closed
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create MCP3208: %v", err)
+		return fmt.Errorf("Failed to write %v to %v: %w", 0, dac.Label(), err)
 	}
+	return nil
+}
 
-	//Initialize MCP4921
-	logf("ioman:initialize", "Initializing MCP4921 on SPI bus %v as %v", _dacSpiBus, "DAC1")
-	dac1, err := mcp4921.NewMcp4921(conn2, "DAC1", mcp4921.EnumBufferedTrue, mcp4921.EnumOutputGain1x, mcp4921.EnumShutdownModeActive)
+//SetChannelMap sets the mapping of ADC channels to physical quantities. Must be called before Start.
+func (io *IOMan) SetChannelMap(channels []ChannelConfig) error {
+	err := ValidateChannelMap(channels, io.hardware.SampleRate)
 	if err != nil {
-		log.Fatalf("Failed to create MCP4921: %v", err)
+		return fmt.Errorf("Invalid channel map: %w", err)
 	}
 
-	return &phySensors{
-		Flow: flow1,
-		ADC:  adc1,
-		DAC:  dac1,
-	}, nil
+	io.channels = channels
+	return nil
 }
 
-func (io *IOMan) selftest(sensors *phySensors) error {
+//SetFlowFilters sets the filter chain applied to flow before breath detection. Must be called before Start.
+func (io *IOMan) SetFlowFilters(filters []FilterConfig) error {
+	err := ValidateFilters(filters, io.hardware.SampleRate)
+	if err != nil {
+		return fmt.Errorf("Invalid flow filter: %w", err)
+	}
 
-	//Test SFM3000
-	logf("ioman:selftest", "Testing %v", sensors.Flow.Label())
+	io.filters = filters
+	return nil
+}
 
-	err := sensors.Flow.SoftReset()
+//SetTrigger sets detection of patient effort for spontaneous breaths. Must be called before Start.
+func (io *IOMan) SetTrigger(trigger TriggerConfig) error {
+	err := trigger.Validate()
 	if err != nil {
-		return fmt.Errorf("Failed to soft reset %v: %w", sensors.Flow.Label(), err)
+		return fmt.Errorf("Invalid trigger: %w", err)
 	}
-	logf("ioman:selftest", "%v soft-reset OK", sensors.Flow.Label())
-	time.Sleep(100 * time.Millisecond) // Wait for sensor to reset
 
-	serial, err := sensors.Flow.GetSerial()
+	io.trigger = trigger
+	return nil
+}
+
+//SetHistory sets the duration of samples kept for History. Must be called before Start.
+func (io *IOMan) SetHistory(duration time.Duration) error {
+	err := ValidateHistory(duration, io.hardware.SampleRate)
 	if err != nil {
-		return fmt.Errorf("Failed to get %v serial number: %w", sensors.Flow.Label(), err)
+		return fmt.Errorf("Invalid history: %w", err)
 	}
-	logf("ioman:selftest", "%v serial number OK: %v", sensors.Flow.Label(), serial)
 
-	_, _, _, _ = sensors.Flow.GetValue() //First value is expected to be garbage
+	io.history = newHistory(duration, io.hardware.SampleRate)
+	return nil
+}
 
-	value, crc, _, err := sensors.Flow.GetValue()
+//SetBreathDetection sets the flow thresholds of breath detection. Must be called before Start.
+func (io *IOMan) SetBreathDetection(breath BreathConfig) error {
+	err := breath.Validate()
 	if err != nil {
-		return fmt.Errorf("Failed to get %v value: %w", sensors.Flow.Label(), err)
+		return fmt.Errorf("Invalid breath detection: %w", err)
 	}
-	logf("ioman:selftest", "%v flow value OK: %v crc %v", sensors.Flow.Label(), value, crc)
 
-	//Test MCP3208
-	logf("ioman:selftest", "Testing %v", sensors.ADC.Label())
+	io.breath = breath
+	return nil
+}
 
-	_, _, _ = sensors.ADC.GetValues(0, 4) //First value is expected to be garbage
-	time.Sleep(50 * time.Millisecond)
+//SetMode switches the ventilation mode. May be called while running, the new mode takes over from the current valve position.
+func (io *IOMan) SetMode(mode Mode) {
+	io.mvalve.Lock()
+	defer io.mvalve.Unlock()
 
-	vals, _, err := sensors.ADC.GetValues(0, 4)
-	if err != nil {
-		return fmt.Errorf("Failed to get %v values: %w", sensors.ADC.Label(), err)
+	logman.Infof("ioman", "Switching mode from %v to %v", io.mode.Name(), mode.Name())
+	mode.Start(float64(io.command)/_dacFullScale, io.clock.Now())
+	io.mode = mode
+}
+
+//Mode returns the current ventilation mode
+func (io *IOMan) Mode() Mode {
+	io.mvalve.Lock()
+	defer io.mvalve.Unlock()
+	return io.mode
+}
+
+//Record starts recording every DataPacket to disk. Must be called before Start.
+func (io *IOMan) Record(config RecorderConfig) error {
+	flows := []string{}
+	for _, f := range io.hardware.Flows {
+		flows = append(flows, f.Label)
 	}
-	logf("ioman:selftest", "%v adc values OK: %v ", sensors.ADC.Label(), vals)
 
-	//Test MCP4921
-	logf("ioman:selftest", "Testing %v", sensors.DAC.Label())
-	err = sensors.DAC.Write(0) //Write closed
+	rec, err := NewRecorder(config, io.hardware.SampleRate, flows, []string{io.sensors.ADC.Label(), io.sensors.DAC.Label()})
 	if err != nil {
-		return fmt.Errorf("Failed to write %v to %v", 0, sensors.DAC.Label())
+		return fmt.Errorf("Failed to create recorder: %w", err)
 	}
+
+	io.recorder = rec
 	return nil
 }
 
-//Start ..
-func (io *IOMan) Start(cherr chan<- error) {
-	logf("ioman:start", "Starting at %v hz", 1/_sampleRate.Seconds())
-	lt := time.NewTicker(_sampleRate)
+//Start runs the io loop until ctx is cancelled, then closes the valve and stops device recovery.
+//A nil return means the valve was left closed. Faults raised while running are sent to cherr.
+func (io *IOMan) Start(ctx context.Context, cherr chan<- error) error {
+	logman.Infof("ioman:start", "Starting at %v hz", 1/io.hardware.SampleRate.Seconds())
+	lt := io.clock.NewTicker(io.hardware.SampleRate)
 	defer lt.Stop()
-	cont := newController(_sampleRate)
-
-	for range lt.C {
-
-		// Read inputs
-		fval, fcrc, tstamp, ferr := io.sensors.Flow.GetValue()
-		flow := Flow{
-			Val:       fval,
-			CRC:       fcrc,
-			Timestamp: tstamp,
-			Err:       ferr,
+	cont := newController(io.hardware.SampleRate, io.clock)
+	cont.state.config = io.breath
+	cont.trigger.config = io.trigger
+	cont.setFlowFilters(io.filters)
+	filters := channelFilters(io.channels, io.hardware.SampleRate)
+	phase := PhaseExpiration //machine phase of the last valve output
+	checkers := []*flowChecker{}
+	for range io.hardware.Flows {
+		checkers = append(checkers, newFlowChecker())
+	}
+	quality := make([]EnumQuality, len(io.sensors.Flows))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return io.stop()
+		case _, ok := <-lt.C():
+			if !ok {
+				err := fmt.Errorf("io loop ended unexpectedly")
+				cherr <- err
+				return err
+			}
+		}
+		begin := io.clock.Now()
+		io.stats.loop(begin)
+
+		// Read inputs, skipping devices being recovered
+		flows := make([]Flow, len(io.sensors.Flows))
+		for i := range flows {
+			flows[i] = io.readFlow(i, checkers[i])
+			if flows[i].Quality != quality[i] {
+				logman.Limitf(logman.LevelWarn, "ioman", "%v sample quality changed from %v to %v", flows[i].Label, quality[i], flows[i].Quality)
+				quality[i] = flows[i].Quality
+			}
 		}
 
-		ivals, tstamp, ferr := io.sensors.ADC.GetValues(0, 4)
-		adc := ADC{
-			Vals:      ivals,
-			Err:       ferr,
-			Timestamp: tstamp,
+		adc := ADC{Err: ErrRecovering}
+		if io.radc.available() {
+			start := io.clock.Now()
+			ivals, tstamp, ferr := io.sensors.ADC.GetValues(0, channelCount(io.channels))
+			io.stats.operation(_busADC, start, io.clock.Now(), ferr)
+			adc = ADC{
+				Vals:      ivals,
+				Err:       ferr,
+				Timestamp: tstamp,
+			}
 		}
+		io.radc.observe(adc.Err)
 
 		sensors := Sensors{
-			Flow: flow,
-			ADC:  adc,
+			Flow:  flows[io.proximal],
+			Flows: flows,
+			ADC:   adc,
 		}
+		measure(&sensors, io.channels, filters)
 
 		d := DataPacket{
-			Sensors:   sensors,
-			Timestamp: time.Now(),
+			Timestamp: io.clock.Now(),
 		}
 
-		// If inputs read ok
-		if d.Sensors.Flow.Err == nil && d.Sensors.ADC.Err == nil {
-			d.Stats.OkReads++
+		io.stats.read(d.Timestamp, sensors.Flow.Err == nil && sensors.ADC.Err == nil)
 
+		// Short runs of bad flow samples are bridged by the controller, anything else invalidates the packet
+		if sensors.ADC.Err == nil && cont.bridge(&sensors) {
 			cont.buffers(sensors)
+			trigger := cont.triggers(sensors, phase)
 			state := cont.states(sensors)
 			calculated := cont.calculate(sensors)
 
 			d.State = state
+			d.Trigger = trigger
 			d.Calculated = calculated
 			d.Valid = true
+		}
+		d.Sensors = sensors
 
-		} else {
-			d.Stats.FailedReads++
+		d.Valve = io.actuate(d)
+		phase = d.Valve.Phase
+		d.Health = io.Health()
+		d.Stats = io.stats.snapshot(io.clock.Now())
 
-			d.Valid = false
+		if io.recorder != nil {
+			io.recorder.Write(d)
 		}
 
 		// Copy to output registers
 		io.moutputs.Lock()
 		io.o = d
 		io.moutputs.Unlock()
+		io.pub.publish(d)
+		io.history.add(d)
+
+		io.stats.done(begin, io.clock.Now())
+	}
+}
+
+// stop ends device recovery, so that the DAC is no longer used off the io loop, and writes the closed safe state
+func (io *IOMan) stop() error {
+	logman.Infof("ioman:stop", "Stopping, closing valve")
+	io.shutdown()
+
+	io.mvalve.Lock()
+	defer io.mvalve.Unlock()
+
+	var err error
+	for attempt := 1; attempt <= _stopRetries; attempt++ {
+		err = io.sensors.DAC.Write(0)
+		if err == nil {
+			break
+		}
+		logman.Warnf("ioman:stop", "Failed to close valve, attempt %v of %v: %v", attempt, _stopRetries, err)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to close valve %v: %w", io.sensors.DAC.Label(), err)
+	}
+
+	io.command = 0
+	io.faulted = true
+	logman.Infof("ioman:stop", "Valve closed")
+	return nil
+}
+
+// shutdown ends recovery of every device, waiting for attempts in progress
+func (io *IOMan) shutdown() {
+	for _, r := range io.rflows {
+		r.shutdown()
+	}
+	io.radc.shutdown()
+	io.rdac.shutdown()
+}
+
+// readFlow reads and checks flow sensor i, observing the result for its recovery
+func (io *IOMan) readFlow(i int, checker *flowChecker) Flow {
+	sensor := io.sensors.Flows[i]
+	flow := Flow{Err: ErrRecovering}
+	if io.rflows[i].available() {
+		start := io.clock.Now()
+		fraw, fcrc, tstamp, ferr := sensor.GetRaw()
+		io.stats.operation(_busFlow+i, start, io.clock.Now(), ferr)
+		flow = Flow{
+			Val:       sfm3000Value(fraw, io.hardware.Flows[i].IsAir),
+			Raw:       fraw,
+			CRC:       fcrc,
+			Timestamp: tstamp,
+			Err:       ferr,
+		}
+	}
+	flow.Label = io.hardware.Flows[i].Label
+	flow.Role = io.hardware.Flows[i].Role
+	flow.Quality = checker.check(flow, io.clock.Now())
+
+	if flow.Quality == QualityGood {
+		io.rflows[i].observe(nil)
+	} else if flow.Err != nil {
+		io.rflows[i].observe(flow.Err)
+	} else {
+		io.rflows[i].observe(fmt.Errorf("Sample quality %v", flow.Quality))
+	}
+	return flow
+}
+
+// actuate runs the ventilation mode and writes the DAC, falling back to closed on any fault
+func (io *IOMan) actuate(d DataPacket) Valve {
+	io.mvalve.Lock()
+	defer io.mvalve.Unlock()
+
+	valve := Valve{
+		Phase: PhaseExpiration,
+		Err:   fmt.Errorf("Sensor read failed"),
+	}
+	if d.Valid {
+		// Restart the mode from closed once a fault has cleared
+		if io.faulted {
+			io.mode.Start(0, d.Timestamp)
+		}
+		valve = io.mode.Update(d.Sensors, d.State, d.Trigger != nil && d.Trigger.Type == BreathSpontaneous, d.Timestamp)
+	}
+
+	if valve.Err != nil {
+		valve.Command = 0
+		valve.Setpoint = 0
+		if !io.faulted {
+			logman.Limitf(logman.LevelError, "ioman", "Valve entering safe state: %v", valve.Err)
+		}
 	}
+	io.faulted = valve.Err != nil
 
-	cherr <- fmt.Errorf("io loop ended unexpectedly")
+	if valve.Command == io.command && valve.Err == nil {
+		return valve
+	}
+
+	if !io.rdac.available() {
+		return Valve{
+			Phase: PhaseExpiration,
+			Err:   fmt.Errorf("Failed to write %v to %v: %w", valve.Command, io.sensors.DAC.Label(), ErrRecovering),
+		}
+	}
+
+	start := io.clock.Now()
+	err := io.sensors.DAC.Write(valve.Command)
+	io.stats.operation(_busDAC, start, io.clock.Now(), err)
+	if err != nil {
+		valve = Valve{
+			Phase: PhaseExpiration,
+			Err:   fmt.Errorf("Failed to write %v to %v: %w", valve.Command, io.sensors.DAC.Label(), err),
+		}
+		io.faulted = true
+		_ = io.sensors.DAC.Write(0) //Best effort, the fault is reported on the returned valve
+	}
+	io.rdac.observe(err) //May hand the DAC to recovery, so it is not used after this
+	io.command = valve.Command
+
+	return valve
+}
+
+//Health returns the state of each device
+func (io *IOMan) Health() Health {
+	flows := make([]DeviceHealth, len(io.rflows))
+	for i, r := range io.rflows {
+		flows[i] = r.Health()
+	}
+
+	return Health{
+		Flow:  flows[io.proximal],
+		Flows: flows,
+		ADC:   io.radc.Health(),
+		DAC:   io.rdac.Health(),
+	}
+}
+
+//GetStats returns cumulative io loop statistics, and windowed statistics over the last second
+func (io *IOMan) GetStats() Stats {
+	return io.stats.snapshot(io.clock.Now())
+}
+
+//Subscribe returns a Subscription to DataPackets as they are produced by the io loop.
+//A subscriber that falls behind loses DataPackets according to its overflow policy, it never delays the io loop.
+func (io *IOMan) Subscribe(config SubscribeConfig) (*Subscription, error) {
+	return io.pub.subscribe(config)
+}
+
+//Unsubscribe ends a Subscription, closing its channel
+func (io *IOMan) Unsubscribe(s *Subscription) {
+	io.pub.unsubscribe(s)
+}
+
+//History returns the kept samples between from and to inclusive, aggregated into buckets of decimation samples
+func (io *IOMan) History(from time.Time, to time.Time, decimation int) ([]HistoryBucket, error) {
+	return io.history.query(from, to, decimation)
+}
+
+//BreathHistory returns the kept breaths that ended between from and to inclusive, oldest first
+func (io *IOMan) BreathHistory(from time.Time, to time.Time) []Breath {
+	return io.history.breathsBetween(from, to)
 }
 
 //GetDataPacket ..
@@ -253,12 +570,34 @@ func (io *IOMan) GetDataPacket() DataPacket {
 	return io.o
 }
 
-//Destroy ..
-func (*IOMan) Destroy() {
+//Destroy flushes and closes the recording, ends every Subscription and closes the device buses.
+//Must be called after Start has returned, returning the first error met.
+func (io *IOMan) Destroy() error {
+	var first error
+	fail := func(err error) {
+		logman.Errorf("ioman:destroy", "%v", err)
+		if first == nil {
+			first = err
+		}
+	}
 
-}
+	io.shutdown()
+
+	if io.recorder != nil {
+		err := io.recorder.Close()
+		if err != nil {
+			fail(fmt.Errorf("Failed to close recorder: %w", err))
+		}
+		io.recorder = nil
+	}
+
+	io.pub.close()
+
+	err := closeDevices(io.sensors)
+	if err != nil {
+		fail(err)
+	}
 
-func logf(owner string, format string, v ...interface{}) {
-	message := fmt.Sprintf(format, v...)
-	log.Printf("[%v] %v", owner, message)
+	logman.Infof("ioman:destroy", "Destroyed")
+	return first
 }
@@ -1 +1,259 @@
 package ioman
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeFlow struct {
+	val float64
+}
+
+func (f *fakeFlow) Label() string              { return "FAKEFLOW" }
+func (f *fakeFlow) SoftReset() error           { return nil }
+func (f *fakeFlow) GetSerial() (uint32, error) { return 0xCAFE, nil }
+func (f *fakeFlow) GetRaw() (uint16, uint8, time.Time, error) {
+	raw, crc := sfm3000Encode(f.val, DefaultHardwareConfig().Flows[0].IsAir)
+	return raw, crc, time.Now(), nil
+}
+
+type fakeADC struct{}
+
+func (a *fakeADC) Label() string { return "FAKEADC" }
+func (a *fakeADC) GetValues(start int, count int) ([]uint16, time.Time, error) {
+	return make([]uint16, count), time.Now(), nil
+}
+
+type fakeDAC struct {
+	last uint16
+}
+
+func (d *fakeDAC) Label() string            { return "FAKEDAC" }
+func (d *fakeDAC) Write(value uint16) error { d.last = value; return nil }
+
+// startIOMan runs the io loop of iom until the test ends, returning the channel faults are sent on
+func startIOMan(t *testing.T, iom *IOMan) <-chan error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cherr := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		_ = iom.Start(ctx, cherr)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return cherr
+}
+
+func TestNewIOManWithDevices(t *testing.T) {
+
+	_, err := NewIOManWithDevices(Devices{}, DefaultHardwareConfig())
+	if err == nil {
+		t.Fatalf("Expected error for missing devices")
+	}
+
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   &fakeDAC{},
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+
+	startIOMan(t, iom)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		dp := iom.GetDataPacket()
+		if dp.Valid {
+			if dp.Sensors.Flow.Val != 10 {
+				t.Fatalf("Expected flow of 10, got %v", dp.Sensors.Flow.Val)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("No valid DataPacket produced")
+}
+
+type closingDAC struct {
+	fakeDAC
+	closed bool
+}
+
+func (d *closingDAC) Close() error { d.closed = true; return nil }
+
+func TestShutdown(t *testing.T) {
+
+	dac := &closingDAC{}
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   dac,
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+	sub, err := iom.Subscribe(DefaultSubscribeConfig())
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	// A valve left open when the io loop is stopped
+	dac.last = 1000
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- iom.Start(ctx, make(chan error, 1)) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("Expected a clean stop, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Start to return once cancelled")
+	}
+	if dac.last != 0 {
+		t.Fatalf("Expected the valve to be closed on stop, got %v", dac.last)
+	}
+
+	err = iom.Destroy()
+	if err != nil {
+		t.Fatalf("Failed to destroy: %v", err)
+	}
+	if !dac.closed {
+		t.Fatalf("Expected the DAC bus to be closed")
+	}
+	for range sub.C {
+	}
+	_, err = iom.Subscribe(DefaultSubscribeConfig())
+	if err == nil {
+		t.Fatalf("Expected subscribing after Destroy to fail")
+	}
+
+	// A valve that cannot be closed is reported
+	iom, err = NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   &failingDAC{},
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = iom.Start(ctx, make(chan error, 1))
+	if err == nil || !strings.Contains(err.Error(), "Failed to close valve") {
+		t.Fatalf("Expected a failure to close the valve, got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	capture := "0s,1\n1ms,2\n2ms,3\n3ms,4\n"
+	records, err := ParseFlowCSV(strings.NewReader(capture))
+	if err != nil {
+		t.Fatalf("Failed to parse capture: %v", err)
+	}
+	if len(records) != 4 || records[3].Offset != 3*time.Millisecond || records[3].Val != 4 {
+		t.Fatalf("Unexpected records: %+v", records)
+	}
+
+	replay, err := NewReplayFromRecords(records, nil, 0.001, false)
+	if err != nil {
+		t.Fatalf("Failed to create replay: %v", err)
+	}
+	flow := replay.Devices().Flows[0]
+
+	replay.Seek(2 * time.Millisecond)
+	raw, _, _, err := flow.GetRaw()
+	if err != nil || raw != sfm3000Raw(3, false) {
+		t.Fatalf("Expected 3 after seek, got %v: %v", sfm3000Value(raw, false), err)
+	}
+
+	replay.Seek(time.Hour)
+	time.Sleep(time.Millisecond)
+	_, _, _, err = flow.GetRaw()
+	if err != ErrReplayEnded {
+		t.Fatalf("Expected replay to have ended, got %v", err)
+	}
+
+	looped, err := NewReplayFromRecords(records, nil, 1, true)
+	if err != nil {
+		t.Fatalf("Failed to create replay: %v", err)
+	}
+	looped.Seek(time.Hour)
+	time.Sleep(time.Millisecond)
+	_, _, _, err = looped.Devices().Flows[0].GetRaw()
+	if err != nil {
+		t.Fatalf("Expected looping replay to continue, got %v", err)
+	}
+
+	// Each pass follows the last one sample period on, rather than repeating its timestamp
+	epoch := time.Unix(1000, 0)
+	clock := NewVirtualClock(epoch)
+	looped.SetClock(clock)
+	for i := 0; i < 10; i++ {
+		raw, _, tstamp, err := looped.Devices().Flows[0].GetRaw()
+		if err != nil || raw != sfm3000Raw(float64(i%4+1), false) || !tstamp.Equal(epoch.Add(time.Duration(i)*time.Millisecond)) {
+			t.Fatalf("Expected sample %v of the looped capture at %vms, got %v at %v: %v", i%4, i, sfm3000Value(raw, false), tstamp.Sub(epoch), err)
+		}
+		clock.Advance(time.Millisecond)
+	}
+}
+
+func TestChannelMap(t *testing.T) {
+
+	linear := LinearCalibration(410, 32.76)
+	if v := linear.Apply(410); math.Abs(v) > 1e-9 {
+		t.Fatalf("Expected 0 at offset, got %v", v)
+	}
+	if v := linear.Apply(410 + 3276); math.Abs(v-100) > 1e-9 {
+		t.Fatalf("Expected 100 at full scale, got %v", v)
+	}
+
+	poly := Calibration{Coefficients: []float64{1, 2, 3}}
+	if v := poly.Apply(2); v != 1+2*2+3*4 {
+		t.Fatalf("Expected polynomial of 17, got %v", v)
+	}
+
+	err := ValidateChannelMap([]ChannelConfig{{Channel: 8, Quantity: QuantityOxygen, Calibration: linear}}, _defaultSampleRate)
+	if err == nil {
+		t.Fatalf("Expected out of range channel to fail validation")
+	}
+	err = ValidateChannelMap([]ChannelConfig{
+		{Channel: 0, Quantity: QuantityOxygen, Calibration: linear},
+		{Channel: 1, Quantity: QuantityOxygen, Calibration: linear},
+	}, _defaultSampleRate)
+	if err == nil {
+		t.Fatalf("Expected duplicate quantity to fail validation")
+	}
+
+	// The simulated ADC should read back through the default channel map
+	config := DefaultSimConfig()
+	lung := NewSimLung(config)
+	vals, _, _ := lung.Devices().ADC.GetValues(0, channelCount(DefaultChannelMap()))
+
+	sensors := Sensors{ADC: ADC{Vals: vals}}
+	measure(&sensors, DefaultChannelMap(), nil)
+
+	if !sensors.AirwayPressure.Valid || math.Abs(sensors.AirwayPressure.Val-config.PEEP) > 0.1 {
+		t.Fatalf("Expected airway pressure of %v, got %+v", config.PEEP, sensors.AirwayPressure)
+	}
+	if !sensors.Oxygen.Valid || math.Abs(sensors.Oxygen.Val-config.Oxygen) > 0.1 {
+		t.Fatalf("Expected oxygen of %v, got %+v", config.Oxygen, sensors.Oxygen)
+	}
+	if !sensors.SupplyPressure.Valid || math.Abs(sensors.SupplyPressure.Val-config.Supply) > 0.5 {
+		t.Fatalf("Expected supply pressure of %v, got %+v", config.Supply, sensors.SupplyPressure)
+	}
+}
@@ -0,0 +1,388 @@
+package ioman
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const _dacFullScale = 4095 //MCP4921 is 12 bit
+
+//Mode is a ventilation mode. Modes decide the valve command and machine breath phase from sensors and the breath state.
+type Mode interface {
+	Name() string
+	//Start is called when the mode takes over the valve, with the current valve command as a fraction of fully open
+	Start(command float64, t time.Time)
+	//Update returns the valve output. Command is a DAC value, a non nil Err puts the valve in the closed safe state.
+	//Triggered is true on the sample at which patient effort initiated a spontaneous breath.
+	Update(sensors Sensors, state EnumState, triggered bool, t time.Time) Valve
+}
+
+//ModeConfig holds the settings of all modes, each mode uses the subset relevant to it
+type ModeConfig struct {
+	Rate                float64       //Machine breaths per minute, for PCV and VCV
+	InspiratoryTime     time.Duration //For PCV and VCV, and the maximum inspiratory time for PSV
+	InspiratoryPressure float64       //cmH2O, for PCV
+	TidalVolume         float64       //Liters, for VCV
+	PEEP                float64       //cmH2O, for all modes
+	PressureSupport     float64       //cmH2O above PEEP, for PSV
+	CycleOff            float64       //Fraction of peak inspiratory flow at which inspiration ends, for PSV
+	PressureGains       PIDGains      //Valve fraction per cmH2O
+	FlowGains           PIDGains      //Valve fraction per SLM
+}
+
+//DefaultModeConfig ..
+func DefaultModeConfig() ModeConfig {
+	return ModeConfig{
+		Rate:                15,
+		InspiratoryTime:     time.Second,
+		InspiratoryPressure: 20,
+		TidalVolume:         0.5,
+		PEEP:                5,
+		PressureSupport:     10,
+		CycleOff:            0.25,
+		PressureGains:       PIDGains{Kp: 0.01, Ki: 2},
+		FlowGains:           PIDGains{Kp: 0.001, Ki: 0.5},
+	}
+}
+
+var _modes = map[string]func(config ModeConfig) (Mode, error){
+	"standby": NewStandby,
+	"pcv":     NewPCV,
+	"vcv":     NewVCV,
+	"cpap":    NewCPAP,
+	"psv":     NewPSV,
+}
+
+//ModeNames returns the names accepted by NewMode
+func ModeNames() []string {
+	names := []string{}
+	for n := range _modes {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//NewMode creates a mode by name
+func NewMode(name string, config ModeConfig) (Mode, error) {
+	constructor, ok := _modes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown mode %v, expected one of %v", name, ModeNames())
+	}
+	return constructor(config)
+}
+
+func validateTiming(config ModeConfig) error {
+	if config.Rate <= 0 {
+		return fmt.Errorf("Rate must be positive, got %v", config.Rate)
+	}
+	period := time.Duration(float64(time.Minute) / config.Rate)
+	if config.InspiratoryTime <= 0 || config.InspiratoryTime >= period {
+		return fmt.Errorf("Inspiratory time %v must be positive and shorter than the breath period %v", config.InspiratoryTime, period)
+	}
+	return nil
+}
+
+func validatePEEP(config ModeConfig) error {
+	if config.PEEP < 0 {
+		return fmt.Errorf("PEEP must not be negative, got %v", config.PEEP)
+	}
+	return nil
+}
+
+//timedCycle generates machine breath phases at a fixed rate and inspiratory time
+type timedCycle struct {
+	period      time.Duration
+	inspiration time.Duration
+	start       time.Time
+}
+
+func newTimedCycle(config ModeConfig) timedCycle {
+	return timedCycle{
+		period:      time.Duration(float64(time.Minute) / config.Rate),
+		inspiration: config.InspiratoryTime,
+	}
+}
+
+func (c *timedCycle) phase(t time.Time) EnumPhase {
+	if c.start.IsZero() || t.Sub(c.start) >= c.period {
+		c.start = t
+	}
+	if t.Sub(c.start) < c.inspiration {
+		return PhaseInspiration
+	}
+	return PhaseExpiration
+}
+
+func command(output float64) uint16 {
+	return uint16(clamp(output, 0, 1) * _dacFullScale)
+}
+
+func requirePressure(sensors Sensors) error {
+	if !sensors.AirwayPressure.Valid {
+		return fmt.Errorf("Airway pressure is not available")
+	}
+	return nil
+}
+
+//standby holds the valve closed
+type standby struct{}
+
+//NewStandby ..
+func NewStandby(config ModeConfig) (Mode, error) {
+	return &standby{}, nil
+}
+
+func (m *standby) Name() string                       { return "Standby" }
+func (m *standby) Start(command float64, t time.Time) {}
+func (m *standby) Update(sensors Sensors, state EnumState, triggered bool, t time.Time) Valve {
+	return Valve{Phase: PhaseExpiration}
+}
+
+//cpap controls airway pressure to PEEP continuously
+type cpap struct {
+	config   ModeConfig
+	pressure *pid
+}
+
+//NewCPAP ..
+func NewCPAP(config ModeConfig) (Mode, error) {
+	err := validatePEEP(config)
+	if err != nil {
+		return nil, err
+	}
+	return &cpap{
+		config:   config,
+		pressure: newPID(config.PressureGains, 0, 1),
+	}, nil
+}
+
+func (m *cpap) Name() string { return "CPAP" }
+
+func (m *cpap) Start(command float64, t time.Time) {
+	m.pressure.preset(command)
+}
+
+func (m *cpap) Update(sensors Sensors, state EnumState, triggered bool, t time.Time) Valve {
+	err := requirePressure(sensors)
+	if err != nil {
+		return Valve{Err: err}
+	}
+
+	output := m.pressure.update(m.config.PEEP, sensors.AirwayPressure.Val, t)
+	return Valve{
+		Command:  command(output),
+		Phase:    PhaseExpiration,
+		Setpoint: m.config.PEEP,
+	}
+}
+
+//pcv is pressure controlled ventilation, airway pressure is controlled to InspiratoryPressure during machine timed inspiration
+type pcv struct {
+	config   ModeConfig
+	cycle    timedCycle
+	phase    EnumPhase
+	pressure *pid
+}
+
+//NewPCV ..
+func NewPCV(config ModeConfig) (Mode, error) {
+	err := validateTiming(config)
+	if err == nil {
+		err = validatePEEP(config)
+	}
+	if err == nil && config.InspiratoryPressure <= config.PEEP {
+		err = fmt.Errorf("Inspiratory pressure %v must be above PEEP %v", config.InspiratoryPressure, config.PEEP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &pcv{
+		config:   config,
+		cycle:    newTimedCycle(config),
+		pressure: newPID(config.PressureGains, 0, 1),
+	}, nil
+}
+
+func (m *pcv) Name() string { return "PCV" }
+
+func (m *pcv) Start(command float64, t time.Time) {
+	m.cycle.start = time.Time{}
+	m.phase = PhaseExpiration
+	m.pressure.preset(command)
+}
+
+func (m *pcv) Update(sensors Sensors, state EnumState, triggered bool, t time.Time) Valve {
+	err := requirePressure(sensors)
+	if err != nil {
+		return Valve{Err: err}
+	}
+
+	m.phase = m.cycle.phase(t)
+
+	setpoint := m.config.PEEP
+	if m.phase == PhaseInspiration {
+		setpoint = m.config.InspiratoryPressure
+	}
+
+	output := m.pressure.update(setpoint, sensors.AirwayPressure.Val, t)
+	return Valve{
+		Command:  command(output),
+		Phase:    m.phase,
+		Setpoint: setpoint,
+	}
+}
+
+//vcv is volume controlled ventilation, flow is controlled to deliver TidalVolume over machine timed inspiration
+type vcv struct {
+	config    ModeConfig
+	cycle     timedCycle
+	phase     EnumPhase
+	pressure  *pid
+	flow      *pid
+	delivered integrator //volume delivered during the current inspiration
+}
+
+//NewVCV ..
+func NewVCV(config ModeConfig) (Mode, error) {
+	err := validateTiming(config)
+	if err == nil {
+		err = validatePEEP(config)
+	}
+	if err == nil && config.TidalVolume <= 0 {
+		err = fmt.Errorf("Tidal volume must be positive, got %v", config.TidalVolume)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &vcv{
+		config:   config,
+		cycle:    newTimedCycle(config),
+		pressure: newPID(config.PressureGains, 0, 1),
+		flow:     newPID(config.FlowGains, 0, 1),
+	}, nil
+}
+
+func (m *vcv) Name() string { return "VCV" }
+
+func (m *vcv) Start(command float64, t time.Time) {
+	m.cycle.start = time.Time{}
+	m.phase = PhaseExpiration
+	m.pressure.preset(command)
+	m.flow.preset(command)
+}
+
+func (m *vcv) Update(sensors Sensors, state EnumState, triggered bool, t time.Time) Valve {
+	err := requirePressure(sensors)
+	if err != nil {
+		return Valve{Err: err}
+	}
+
+	phase := m.cycle.phase(t)
+	if phase != m.phase {
+		m.delivered.reset()
+		m.phase = phase
+	}
+
+	valve := Valve{
+		Phase: phase,
+	}
+
+	if phase == PhaseInspiration {
+		m.delivered.add(sensors.Flow.Timestamp, sensors.Flow.Val)
+		if m.delivered.total < m.config.TidalVolume {
+			valve.Setpoint = m.config.TidalVolume / m.config.InspiratoryTime.Minutes()
+			valve.Command = command(m.flow.update(valve.Setpoint, sensors.Flow.Val, t))
+		}
+		m.pressure.preset(float64(valve.Command) / _dacFullScale)
+		return valve
+	}
+
+	valve.Setpoint = m.config.PEEP
+	valve.Command = command(m.pressure.update(valve.Setpoint, sensors.AirwayPressure.Val, t))
+	m.flow.preset(0)
+	return valve
+}
+
+//psv is pressure support ventilation, patient effort triggers inspiration at PEEP+PressureSupport, which cycles off on falling flow
+type psv struct {
+	config     ModeConfig
+	phase      EnumPhase
+	phaseStart time.Time
+	peak       float64 //peak inspiratory flow of the current breath
+	pressure   *pid
+}
+
+//NewPSV ..
+func NewPSV(config ModeConfig) (Mode, error) {
+	err := validatePEEP(config)
+	if err == nil && config.PressureSupport <= 0 {
+		err = fmt.Errorf("Pressure support must be positive, got %v", config.PressureSupport)
+	}
+	if err == nil && (config.CycleOff <= 0 || config.CycleOff >= 1) {
+		err = fmt.Errorf("Cycle off must be a fraction between 0 and 1, got %v", config.CycleOff)
+	}
+	if err == nil && config.InspiratoryTime <= 0 {
+		err = fmt.Errorf("Inspiratory time must be positive, got %v", config.InspiratoryTime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &psv{
+		config:   config,
+		pressure: newPID(config.PressureGains, 0, 1),
+	}, nil
+}
+
+func (m *psv) Name() string { return "PSV" }
+
+func (m *psv) Start(command float64, t time.Time) {
+	m.phase = PhaseExpiration
+	m.phaseStart = t
+	m.pressure.preset(command)
+}
+
+func (m *psv) Update(sensors Sensors, state EnumState, triggered bool, t time.Time) Valve {
+	err := requirePressure(sensors)
+	if err != nil {
+		return Valve{Err: err}
+	}
+
+	flow := sensors.Flow.Val
+	elapsed := t.Sub(m.phaseStart)
+
+	switch m.phase {
+	case PhaseExpiration:
+		if triggered {
+			m.phase = PhaseInspiration
+			m.phaseStart = t
+			m.peak = flow
+		}
+	case PhaseInspiration:
+		if flow > m.peak {
+			m.peak = flow
+		}
+		cycled := flow < m.config.CycleOff*m.peak
+		exhaling := state == StateBreathingOut
+		if cycled || exhaling || elapsed >= m.config.InspiratoryTime {
+			m.phase = PhaseExpiration
+			m.phaseStart = t
+		}
+	}
+
+	setpoint := m.config.PEEP
+	if m.phase == PhaseInspiration {
+		setpoint = m.config.PEEP + m.config.PressureSupport
+	}
+
+	output := m.pressure.update(setpoint, sensors.AirwayPressure.Val, t)
+	return Valve{
+		Command:  command(output),
+		Phase:    m.phase,
+		Setpoint: setpoint,
+	}
+}
@@ -0,0 +1,223 @@
+package ioman
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// runMode closes the loop between a mode and a simulated lung, calling check with each valve output
+func runMode(mode Mode, lung *SimLung, start time.Time, duration time.Duration, check func(t time.Duration, v Valve)) {
+	cont := newController(_testSampleRate, SystemClock())
+	phase := PhaseExpiration
+
+	for t := time.Duration(0); t < duration; t += _testSampleRate {
+		lung.Step(_testSampleRate)
+		now := start.Add(t)
+
+		sensors := Sensors{
+			Flow:           Flow{Val: lung.Flow(), Timestamp: now},
+			AirwayPressure: Measurement{Val: lung.Pressure(), Valid: true},
+		}
+		cont.buffers(sensors)
+		trigger := cont.triggers(sensors, phase)
+		state := cont.states(sensors)
+
+		v := mode.Update(sensors, state, trigger != nil && trigger.Type == BreathSpontaneous, now)
+		phase = v.Phase
+		lung.SetValve(v.Command)
+		check(t, v)
+	}
+}
+
+// passiveLung returns a simulated lung without patient effort, with the valve closed at 0 cmH2O
+func passiveLung() *SimLung {
+	sim := DefaultSimConfig()
+	sim.Effort = 0
+	sim.PEEP = 0
+	sim.Noise = 0
+	return NewSimLung(sim)
+}
+
+func TestModePCV(t *testing.T) {
+
+	config := DefaultModeConfig()
+	mode, err := NewPCV(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+	lung := passiveLung()
+	period := time.Duration(float64(time.Minute) / config.Rate)
+
+	// Check settled pressure late in inspiration and expiration of the second breath
+	runMode(mode, lung, time.Now(), 2*period, func(at time.Duration, v Valve) {
+		switch at {
+		case period + config.InspiratoryTime - 10*time.Millisecond:
+			if math.Abs(lung.Pressure()-config.InspiratoryPressure) > 0.5 || v.Phase != PhaseInspiration {
+				t.Errorf("Expected inspiratory pressure of %v, got %v in %v", config.InspiratoryPressure, lung.Pressure(), v.Phase)
+			}
+		case 2*period - 10*time.Millisecond:
+			if math.Abs(lung.Pressure()-config.PEEP) > 0.5 || v.Phase != PhaseExpiration {
+				t.Errorf("Expected PEEP of %v, got %v in %v", config.PEEP, lung.Pressure(), v.Phase)
+			}
+		}
+	})
+}
+
+func TestModeVCV(t *testing.T) {
+
+	config := DefaultModeConfig()
+	mode, err := NewVCV(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+	lung := passiveLung()
+	period := time.Duration(float64(time.Minute) / config.Rate)
+
+	// Measure from the end of the first breath, once the lung has emptied to PEEP, to peak volume of the second
+	start := float64(0)
+	peak := float64(0)
+	runMode(mode, lung, time.Now(), period+config.InspiratoryTime, func(at time.Duration, v Valve) {
+		if at == period-time.Millisecond {
+			start = lung.Volume()
+		}
+		peak = math.Max(peak, lung.Volume())
+	})
+
+	delivered := peak - start
+	if math.Abs(delivered-config.TidalVolume) > 0.1*config.TidalVolume {
+		t.Fatalf("Expected tidal volume of %v, got %v", config.TidalVolume, delivered)
+	}
+}
+
+func TestModeCPAP(t *testing.T) {
+
+	config := DefaultModeConfig()
+	mode, err := NewCPAP(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+
+	// A breathing patient should see constant pressure
+	sim := DefaultSimConfig()
+	sim.PEEP = 0
+	lung := NewSimLung(sim)
+
+	runMode(mode, lung, time.Now(), 8*time.Second, func(at time.Duration, v Valve) {
+		if at > time.Second && math.Abs(lung.Pressure()-config.PEEP) > 1 {
+			t.Fatalf("Expected CPAP of %v, got %v at %v", config.PEEP, lung.Pressure(), at)
+		}
+	})
+}
+
+func TestModePSV(t *testing.T) {
+
+	config := DefaultModeConfig()
+	mode, err := NewPSV(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+
+	sim := DefaultSimConfig()
+	sim.PEEP = 0
+	sim.Noise = 0
+	lung := NewSimLung(sim)
+	period := time.Duration(60/sim.Rate) * time.Second
+
+	// Every spontaneous effort should trigger one supported breath
+	triggered := 0
+	last := PhaseExpiration
+	runMode(mode, lung, time.Now(), 4*period, func(at time.Duration, v Valve) {
+		if v.Phase == PhaseInspiration && last != PhaseInspiration {
+			triggered++
+		}
+		if v.Phase == PhaseInspiration && at%period > period/2 {
+			t.Fatalf("Expected inspiration only during patient effort, got inspiration at %v", at)
+		}
+		last = v.Phase
+	})
+
+	if triggered != 4 {
+		t.Fatalf("Expected 4 triggered breaths, got %v", triggered)
+	}
+}
+
+func TestModeSwitchBumpless(t *testing.T) {
+
+	config := DefaultModeConfig()
+	lung := passiveLung()
+	now := time.Now()
+
+	cpap, err := NewCPAP(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+	var last Valve
+	runMode(cpap, lung, now, 2*time.Second, func(at time.Duration, v Valve) { last = v })
+
+	// Switching to another mode holding the same pressure should not move the valve
+	psv, err := NewPSV(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+	psv.Start(float64(last.Command)/_dacFullScale, now.Add(2*time.Second))
+
+	first := true
+	runMode(psv, lung, now.Add(2*time.Second), time.Second, func(at time.Duration, v Valve) {
+		if first && math.Abs(float64(v.Command)-float64(last.Command)) > 0.05*_dacFullScale {
+			t.Fatalf("Expected bumpless transfer from %v, got %v", last.Command, v.Command)
+		}
+		first = false
+	})
+}
+
+func TestModeSafeState(t *testing.T) {
+
+	config := DefaultModeConfig()
+	mode, err := NewCPAP(config)
+	if err != nil {
+		t.Fatalf("Failed to create mode: %v", err)
+	}
+	now := time.Now()
+
+	v := mode.Update(Sensors{}, StateRest, false, now)
+	if v.Err == nil {
+		t.Fatalf("Expected fault without airway pressure, got %+v", v)
+	}
+
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{}},
+		ADC:   &fakeADC{},
+		DAC:   &failingDAC{},
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+	iom.SetMode(mode)
+
+	pressure := Sensors{AirwayPressure: Measurement{Val: 0, Valid: true}}
+	v = iom.actuate(DataPacket{Valid: true, Timestamp: now, Sensors: pressure})
+	v = iom.actuate(DataPacket{Valid: true, Timestamp: now.Add(100 * time.Millisecond), Sensors: pressure})
+	if v.Command != 0 || v.Err == nil {
+		t.Fatalf("Expected valve to close with a fault on DAC write failure, got %+v", v)
+	}
+
+	v = iom.actuate(DataPacket{Valid: false, Timestamp: now.Add(200 * time.Millisecond)})
+	if v.Command != 0 || v.Err == nil {
+		t.Fatalf("Expected valve to close with a fault on sensor failure, got %+v", v)
+	}
+}
+
+type failingDAC struct {
+	writes int
+}
+
+func (d *failingDAC) Label() string { return "FAILDAC" }
+func (d *failingDAC) Write(value uint16) error {
+	d.writes++
+	if d.writes == 1 {
+		return nil //Allow self test
+	}
+	return fmt.Errorf("write failed")
+}
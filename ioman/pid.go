@@ -0,0 +1,80 @@
+package ioman
+
+import "time"
+
+//PIDGains ..
+type PIDGains struct {
+	Kp float64
+	Ki float64 //Per second
+	Kd float64 //Seconds
+}
+
+//pid is a PID controller with output clamping and conditional integration anti-windup
+type pid struct {
+	gains    PIDGains
+	min      float64
+	max      float64
+	integral float64
+	lastErr  float64
+	lastTime time.Time
+}
+
+func newPID(gains PIDGains, min float64, max float64) *pid {
+	return &pid{
+		gains: gains,
+		min:   min,
+		max:   max,
+	}
+}
+
+func (p *pid) reset() {
+	p.integral = 0
+	p.lastErr = 0
+	p.lastTime = time.Time{}
+}
+
+//preset sets the integral so that a zero error produces output, for bumpless transfer
+func (p *pid) preset(output float64) {
+	p.reset()
+	p.integral = clamp(output, p.min, p.max)
+}
+
+func (p *pid) update(setpoint float64, measured float64, t time.Time) float64 {
+	err := setpoint - measured
+
+	dt := float64(0)
+	if !p.lastTime.IsZero() {
+		dt = t.Sub(p.lastTime).Seconds()
+	}
+
+	derivative := float64(0)
+	if dt > 0 {
+		derivative = (err - p.lastErr) / dt
+	}
+
+	proportional := p.gains.Kp * err
+	integral := p.integral + p.gains.Ki*err*dt
+	output := proportional + integral + p.gains.Kd*derivative
+
+	// Only integrate while unsaturated, or while the error drives the output out of saturation
+	saturatedHigh := output > p.max && err > 0
+	saturatedLow := output < p.min && err < 0
+	if !saturatedHigh && !saturatedLow {
+		p.integral = clamp(integral, p.min, p.max)
+	}
+
+	p.lastErr = err
+	p.lastTime = t
+
+	return clamp(output, p.min, p.max)
+}
+
+func clamp(v float64, min float64, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,84 @@
+package ioman
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPIDPressureControl(t *testing.T) {
+
+	lung := passiveLung()
+	gains := DefaultModeConfig().PressureGains
+	p := newPID(gains, 0, 1)
+	now := time.Now()
+
+	// The valve is driven straight from the PID, which must settle the lung at each setpoint in turn
+	for _, setpoint := range []float64{20, 5, 12} {
+		for i := 0; i < 2000; i++ {
+			lung.Step(_testSampleRate)
+			now = now.Add(_testSampleRate)
+			lung.SetValve(command(p.update(setpoint, lung.Pressure(), now)))
+		}
+		if math.Abs(lung.Pressure()-setpoint) > 0.5 {
+			t.Fatalf("Expected pressure of %v, got %v", setpoint, lung.Pressure())
+		}
+	}
+}
+
+func TestPIDTerms(t *testing.T) {
+
+	now := time.Now()
+
+	// The first update has no interval, so only the proportional term contributes
+	p := newPID(PIDGains{Kp: 0.1, Ki: 1, Kd: 0.01}, -10, 10)
+	if out := p.update(2, 0, now); math.Abs(out-0.2) > 1e-9 {
+		t.Fatalf("Expected proportional output of 0.2, got %v", out)
+	}
+
+	// Integral over 100ms of an error of 2, and the derivative of the error falling from 2 to 1
+	out := p.update(2, 1, now.Add(100*time.Millisecond))
+	expected := 0.1*1 + 1*1*0.1 + 0.01*(1-2)/0.1
+	if math.Abs(out-expected) > 1e-9 {
+		t.Fatalf("Expected output of %v, got %v", expected, out)
+	}
+}
+
+func TestPIDPreset(t *testing.T) {
+
+	p := newPID(PIDGains{Kp: 0.1, Ki: 1}, 0, 1)
+	now := time.Now()
+
+	// A preset controller holds its output at zero error, for bumpless transfer
+	p.preset(0.4)
+	for i := 0; i < 10; i++ {
+		if out := p.update(5, 5, now.Add(time.Duration(i)*time.Millisecond)); math.Abs(out-0.4) > 1e-9 {
+			t.Fatalf("Expected preset output of 0.4, got %v", out)
+		}
+	}
+
+	p.preset(2)
+	if out := p.update(5, 5, now.Add(time.Second)); out != 1 {
+		t.Fatalf("Expected preset to be clamped to the output range, got %v", out)
+	}
+}
+
+func TestPIDAntiWindup(t *testing.T) {
+
+	p := newPID(PIDGains{Kp: 0.1, Ki: 1}, 0, 1)
+	now := time.Now()
+
+	// Saturate for a long time, the integral must not wind up beyond the output range
+	for i := 0; i < 10000; i++ {
+		out := p.update(100, 0, now.Add(time.Duration(i)*time.Millisecond))
+		if out != 1 {
+			t.Fatalf("Expected saturated output of 1, got %v", out)
+		}
+	}
+
+	// Output must come out of saturation as soon as the error reverses
+	out := p.update(0, 100, now.Add(10001*time.Millisecond))
+	if out >= 1 {
+		t.Fatalf("Expected output to leave saturation immediately, got %v", out)
+	}
+}
@@ -0,0 +1,115 @@
+package ioman
+
+import (
+	"math"
+	"time"
+)
+
+//SFM3000 conversion, flow = (raw - offset) / scale
+const _sfm3000Offset = 32000
+const _sfm3000ScaleAir = 140
+const _sfm3000ScaleO2 = 142.8
+const _sfm3000CRCPolynomial = 0x31 //x^8 + x^5 + x^4 + 1
+const _sfm3000CRCInit = 0x00
+const _sfm3000StartMeasurement = 0x1000 //Command starting continuous measurement
+
+//Flow plausibility
+const _flowMin = -200                         //SLM, SFM3000 calibrated range
+const _flowMax = 200                          //SLM, SFM3000 calibrated range
+const _flowMaxSlew = 20000                    //SLM per second between consecutive samples
+const _flowStuckTime = 500 * time.Millisecond //time the sensor may repeat the same word before it is considered stuck
+
+func sfm3000Scale(isAir bool) float64 {
+	if isAir {
+		return _sfm3000ScaleAir
+	}
+	return _sfm3000ScaleO2
+}
+
+// sfm3000Raw converts a flow in SLM to the nearest raw sensor value
+func sfm3000Raw(val float64, isAir bool) uint16 {
+	return uint16(clamp(math.Round(val*sfm3000Scale(isAir)+_sfm3000Offset), 0, math.MaxUint16))
+}
+
+// sfm3000Value scales a raw sensor value to flow in SLM
+func sfm3000Value(raw uint16, isAir bool) float64 {
+	return (float64(raw) - _sfm3000Offset) / sfm3000Scale(isAir)
+}
+
+// sfm3000CRC is the CRC-8 the SFM3000 sends after the two bytes of each measurement
+func sfm3000CRC(raw uint16) uint8 {
+	crc := uint8(_sfm3000CRCInit)
+	for _, b := range []uint8{uint8(raw >> 8), uint8(raw)} {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ _sfm3000CRCPolynomial
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// sfm3000Encode returns the raw value and CRC the sensor would send for a flow, for simulated sensors
+func sfm3000Encode(val float64, isAir bool) (uint16, uint8) {
+	raw := sfm3000Raw(val, isAir)
+	return raw, sfm3000CRC(raw)
+}
+
+//flowChecker assigns a quality to each flow sample
+type flowChecker struct {
+	prev         Flow      //last sample passing CRC and range checks
+	good         Flow      //last sample of good quality
+	changedSince time.Time //io loop time at which the word or CRC last changed
+}
+
+func newFlowChecker() *flowChecker {
+	return &flowChecker{}
+}
+
+// check assigns a quality to f, read by the io loop at now. Sensor noise changes the word of even a steady flow, so a
+// word and CRC repeated for longer than _flowStuckTime is stuck, whatever the timestamp of the read.
+func (q *flowChecker) check(f Flow, now time.Time) EnumQuality {
+	if f.Err != nil {
+		return QualityReadError
+	}
+	if sfm3000CRC(f.Raw) != f.CRC {
+		return QualityCRC
+	}
+	if f.Val < _flowMin || f.Val > _flowMax {
+		return QualityRange
+	}
+
+	prev := q.prev
+	q.prev = f
+
+	// A jump away from both the last good and the previous sample is a spike. A jump that the following
+	// sample agrees with is a real change, and only the first sample of it is rejected.
+	if slewed(q.good, f) && slewed(prev, f) {
+		return QualityRate
+	}
+
+	if prev.Timestamp.IsZero() || f.Raw != prev.Raw || f.CRC != prev.CRC {
+		q.changedSince = now
+	}
+	if now.Sub(q.changedSince) > _flowStuckTime {
+		return QualityStuck
+	}
+
+	q.good = f
+	return QualityGood
+}
+
+// slewed returns true if flow changed faster than physically plausible between from and to
+func slewed(from Flow, to Flow) bool {
+	if from.Timestamp.IsZero() {
+		return false
+	}
+	dt := to.Timestamp.Sub(from.Timestamp).Seconds()
+	if dt <= 0 {
+		return false
+	}
+	return math.Abs(to.Val-from.Val)/dt > _flowMaxSlew
+}
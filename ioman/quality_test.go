@@ -0,0 +1,121 @@
+package ioman
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSFM3000CRC(t *testing.T) {
+	// Reference values for CRC-8 polynomial 0x31 with initialisation 0x00
+	for raw, expected := range map[uint16]uint8{0xBEEF: 0x13, 0x7D00: 0x7B, 0x8000: 0x23} {
+		if crc := sfm3000CRC(raw); crc != expected {
+			t.Fatalf("Expected CRC 0x%x for 0x%x, got 0x%x", expected, raw, crc)
+		}
+	}
+
+	// Round trip through the sensor scaling, for both gases
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		isAir := i%2 == 0
+		val := r.Float64()*400 - 200
+		raw, crc := sfm3000Encode(val, isAir)
+		if math.Abs(sfm3000Value(raw, isAir)-val) > 0.5/sfm3000Scale(isAir) {
+			t.Fatalf("Expected flow %v to be kept to the sensor resolution, got %v", val, sfm3000Value(raw, isAir))
+		}
+		if sfm3000CRC(raw^1) == crc {
+			t.Fatalf("Expected CRC to detect a flipped bit for flow %v", val)
+		}
+	}
+}
+
+// sample returns an encoded flow sample at ms milliseconds
+func sample(start time.Time, ms int, val float64) Flow {
+	isAir := DefaultHardwareConfig().Flows[0].IsAir
+	raw, crc := sfm3000Encode(val, isAir)
+	return Flow{Val: sfm3000Value(raw, isAir), Raw: raw, CRC: crc, Timestamp: start.Add(time.Duration(ms) * time.Millisecond)}
+}
+
+func TestFlowChecker(t *testing.T) {
+	start := time.Now()
+
+	q := newFlowChecker()
+	expect := func(f Flow, expected EnumQuality) {
+		t.Helper()
+		if quality := q.check(f, f.Timestamp); quality != expected {
+			t.Fatalf("Expected %v for %+v, got %v", expected, f, quality)
+		}
+	}
+
+	expect(sample(start, 0, 10), QualityGood)
+	expect(Flow{Err: fmt.Errorf("nack"), Timestamp: start.Add(time.Millisecond)}, QualityReadError)
+
+	corrupt := sample(start, 2, 10.5)
+	corrupt.CRC++
+	expect(corrupt, QualityCRC)
+
+	expect(sample(start, 3, 250), QualityRange)
+
+	// A single spike is rejected, the samples either side are good
+	expect(sample(start, 4, 10.2), QualityGood)
+	expect(sample(start, 5, 150), QualityRate)
+	expect(sample(start, 6, 10.4), QualityGood)
+
+	// A step is real once the following sample agrees with it
+	expect(sample(start, 7, 120), QualityRate)
+	expect(sample(start, 8, 120.5), QualityGood)
+	expect(sample(start, 9, 121), QualityGood)
+
+	// A steady flow, such as a pause, is good while sensor noise changes the word
+	ms := 10
+	for ; ms < 10+2*int(_flowStuckTime/time.Millisecond); ms++ {
+		expect(sample(start, ms, 121.5+0.01*float64(ms%2)), QualityGood)
+	}
+
+	// The same word and CRC read with advancing timestamps for too long is stuck, until the word changes
+	stuck := ms
+	for ; ms <= stuck+int(_flowStuckTime/time.Millisecond); ms++ {
+		expect(sample(start, ms, 121.6), QualityGood)
+	}
+	expect(sample(start, ms, 121.6), QualityStuck)
+	expect(sample(start, ms+1, 121.6), QualityStuck)
+	expect(sample(start, ms+2, 121.7), QualityGood)
+}
+
+func TestFlowBridge(t *testing.T) {
+	start := time.Now()
+	clock := NewVirtualClock(start)
+	c := newController(_testSampleRate, clock)
+
+	// No good sample yet
+	bad := sample(start, 0, 10)
+	bad.Quality = QualityCRC
+	sensors := Sensors{Flow: bad}
+	if c.bridge(&sensors) {
+		t.Fatalf("Expected bad sample without a good sample to be rejected")
+	}
+
+	sensors = Sensors{Flow: sample(start, 1, 10)}
+	if !c.bridge(&sensors) || sensors.Flow.Val != 10 {
+		t.Fatalf("Expected good sample to pass unchanged, got %+v", sensors.Flow)
+	}
+
+	// Bad samples are held at the last good value up to the maximum gap
+	gap := int(_flowMaxGap / time.Millisecond)
+	clock.Advance(time.Millisecond)
+	for ms := 2; ms <= gap+2; ms++ {
+		sensors = Sensors{Flow: Flow{Err: fmt.Errorf("nack"), Quality: QualityReadError}}
+		clock.Advance(time.Millisecond)
+		now := clock.Now()
+		ok := c.bridge(&sensors)
+
+		if ms <= gap+1 && (!ok || sensors.Flow.Val != 10 || sensors.Flow.Timestamp != now) {
+			t.Fatalf("Expected bad sample at %vms to be held at the last good value, got %v %+v", ms, ok, sensors.Flow)
+		}
+		if ms > gap+1 && ok {
+			t.Fatalf("Expected bad sample at %vms beyond the maximum gap to be rejected", ms)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package ioman
+
+// Session recordings are append-only CSV files named session-<start>-<index>.csv, rotated once MaxFileSize is exceeded.
+//
+// Each file starts with a header of # prefixed key=value lines, followed by a column line:
+//
+//	# gogles session v2
+//	# sample_rate_hz=1000
+//	# sensors=FLOW1,FLOW2,ADC1,DAC1
+//	# started=2020-04-01T12:00:00Z
+//	timestamp_ns,valid,state,flow,flow_crc,flow_timestamp_ns,flow_err,flow_quality,adc0,adc1,adc2,adc3,adc_timestamp_ns,adc_err,airway_pressure,oxygen,supply_pressure,flow_integrated,flow_integrated_err,flow_integrated_timestamp_ns,breath_number,breath_start_ns,breath_end_ns,breath_inspired_l,breath_inspired_err_l,breath_expired_l,breath_expired_err_l,breath_leak_l,breath_leak_err_l,breath_peak_flow,breath_peak_pressure,breath_peep,breath_ti_ms,breath_te_ms,breath_ie,breath_rate,breath_minute_ventilation,breath_type,trigger_type,trigger_source,valve_command,valve_phase,valve_setpoint,valve_err,ok_reads,failed_reads,loops,overruns,read_rate,loop_jitter_us,flow0,flow0_quality,flow0_err,flow1,flow1_quality,flow1_err
+//
+// The flow_ columns hold the proximal flow sensor, and are followed by a flow<n> group for each flow sensor,
+// in the order listed in sensors.
+// Timestamps are unix nanoseconds, 0 where unset. Errors are CSV quoted strings, empty where nil.
+// Calibrated measurements are empty where not mapped or not read.
+// The breath_ columns hold the last completed breath, and only change when breath_number does.
+// The trigger_ columns are empty except on the sample at which a breath was triggered.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+const _sessionHeader = "# gogles session"
+const _recorderVersion = 2   //Incremented whenever the columns change
+const _recorderBuffer = 4096 //DataPackets buffered between the io loop and the writer
+
+var _recorderColumns = []string{
+	"timestamp_ns", "valid", "state",
+	"flow", "flow_crc", "flow_timestamp_ns", "flow_err", "flow_quality",
+	"adc0", "adc1", "adc2", "adc3", "adc_timestamp_ns", "adc_err",
+	"airway_pressure", "oxygen", "supply_pressure",
+	"flow_integrated", "flow_integrated_err", "flow_integrated_timestamp_ns",
+	"breath_number", "breath_start_ns", "breath_end_ns",
+	"breath_inspired_l", "breath_inspired_err_l", "breath_expired_l", "breath_expired_err_l",
+	"breath_leak_l", "breath_leak_err_l",
+	"breath_peak_flow", "breath_peak_pressure", "breath_peep",
+	"breath_ti_ms", "breath_te_ms", "breath_ie", "breath_rate", "breath_minute_ventilation", "breath_type",
+	"trigger_type", "trigger_source",
+	"valve_command", "valve_phase", "valve_setpoint", "valve_err",
+	"ok_reads", "failed_reads", "loops", "overruns", "read_rate", "loop_jitter_us",
+}
+
+//RecorderConfig ..
+type RecorderConfig struct {
+	Directory   string //Directory recordings are written to
+	MaxFileSize int64  //Size in bytes after which a new file is started
+	MaxFiles    int    //Number of files kept before the oldest is removed, 0 to keep all
+}
+
+//Recorder writes DataPackets to rotating session files
+type Recorder struct {
+	config     RecorderConfig
+	sampleRate time.Duration
+	labels     []string
+	flows      int //Flow sensors, the first of labels
+	columns    []string
+	started    time.Time
+
+	packets chan DataPacket
+	done    chan struct{}
+	mclosed sync.Mutex
+	closed  bool
+	mdrop   sync.Mutex
+	dropped uint64
+
+	file    *os.File
+	writer  *bufio.Writer
+	written int64
+	index   int
+}
+
+//NewRecorder creates the first session file and starts the writer goroutine. Flows labels the flow sensors in
+//config order, each recorded in its own columns, and devices the others.
+func NewRecorder(config RecorderConfig, sampleRate time.Duration, flows []string, devices []string) (*Recorder, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("Recorder directory must be set")
+	}
+	if config.MaxFileSize <= 0 {
+		return nil, fmt.Errorf("Recorder max file size must be positive, got %v", config.MaxFileSize)
+	}
+
+	err := os.MkdirAll(config.Directory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create recorder directory %v: %w", config.Directory, err)
+	}
+
+	r := Recorder{
+		config:     config,
+		sampleRate: sampleRate,
+		labels:     append(append([]string{}, flows...), devices...),
+		flows:      len(flows),
+		columns:    recorderColumns(len(flows)),
+		started:    time.Now(),
+		packets:    make(chan DataPacket, _recorderBuffer),
+		done:       make(chan struct{}),
+	}
+
+	err = r.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	go r.run()
+
+	return &r, nil
+}
+
+//Write queues a DataPacket for writing without blocking. DataPackets are dropped if the writer has fallen behind,
+//or once the Recorder has been closed.
+func (r *Recorder) Write(d DataPacket) {
+	r.mclosed.Lock()
+	defer r.mclosed.Unlock()
+
+	if !r.closed {
+		select {
+		case r.packets <- d:
+			return
+		default:
+		}
+	}
+	r.mdrop.Lock()
+	r.dropped++
+	r.mdrop.Unlock()
+}
+
+//Dropped returns the number of DataPackets dropped because the writer had fallen behind
+func (r *Recorder) Dropped() uint64 {
+	r.mdrop.Lock()
+	defer r.mdrop.Unlock()
+	return r.dropped
+}
+
+//Close writes out all queued DataPackets and closes the current file
+func (r *Recorder) Close() error {
+	r.mclosed.Lock()
+	if r.closed {
+		r.mclosed.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.packets)
+	r.mclosed.Unlock()
+
+	<-r.done
+
+	err := r.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("Failed to flush recording: %w", err)
+	}
+	return r.file.Close()
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+
+	for {
+		select {
+		case d, ok := <-r.packets:
+			if !ok {
+				return
+			}
+			err := r.write(d)
+			if err != nil {
+				logman.Limitf(logman.LevelError, "ioman:recorder", "Failed to write recording: %v", err)
+			}
+		case <-flush.C:
+			err := r.writer.Flush()
+			if err != nil {
+				logman.Limitf(logman.LevelError, "ioman:recorder", "Failed to flush recording: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Recorder) write(d DataPacket) error {
+	if r.written >= r.config.MaxFileSize {
+		err := r.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := r.writer.WriteString(formatRecord(d, r.flows))
+	r.written += int64(n)
+	return err
+}
+
+func (r *Recorder) rotate() error {
+	if r.file != nil {
+		err := r.writer.Flush()
+		if err != nil {
+			return fmt.Errorf("Failed to flush recording: %w", err)
+		}
+		err = r.file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to close recording: %w", err)
+		}
+	}
+
+	name := filepath.Join(r.config.Directory, fmt.Sprintf("session-%v-%03d.csv", r.started.Format("20060102-150405"), r.index))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to create recording %v: %w", name, err)
+	}
+	logman.Infof("ioman:recorder", "Recording to %v", name)
+
+	r.file = f
+	r.writer = bufio.NewWriter(f)
+	r.written = 0
+	r.index++
+
+	header := fmt.Sprintf("%v v%v\n# sample_rate_hz=%v\n# sensors=%v\n# started=%v\n%v\n",
+		_sessionHeader,
+		_recorderVersion,
+		1/r.sampleRate.Seconds(),
+		strings.Join(r.labels, ","),
+		r.started.UTC().Format(time.RFC3339),
+		strings.Join(r.columns, ","))
+
+	n, err := r.writer.WriteString(header)
+	r.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("Failed to write recording header: %w", err)
+	}
+
+	return r.prune()
+}
+
+func (r *Recorder) prune() error {
+	if r.config.MaxFiles <= 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(r.config.Directory, "session-*.csv"))
+	if err != nil {
+		return fmt.Errorf("Failed to list recordings: %w", err)
+	}
+	sort.Strings(files) //Names sort by start time and index
+
+	for len(files) > r.config.MaxFiles {
+		err := os.Remove(files[0])
+		if err != nil {
+			return fmt.Errorf("Failed to remove recording %v: %w", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// recorderColumns returns the columns of a recording of flows flow sensors
+func recorderColumns(flows int) []string {
+	columns := append([]string{}, _recorderColumns...)
+	for i := 0; i < flows; i++ {
+		columns = append(columns, fmt.Sprintf("flow%v", i), fmt.Sprintf("flow%v_quality", i), fmt.Sprintf("flow%v_err", i))
+	}
+	return columns
+}
+
+func formatRecord(d DataPacket, flows int) string {
+	fields := []string{
+		formatTime(d.Timestamp),
+		strconv.FormatBool(d.Valid),
+		strconv.Itoa(int(d.State)),
+		formatFloat(d.Sensors.Flow.Val),
+		strconv.Itoa(int(d.Sensors.Flow.CRC)),
+		formatTime(d.Sensors.Flow.Timestamp),
+		formatError(d.Sensors.Flow.Err),
+		strconv.Itoa(int(d.Sensors.Flow.Quality)),
+	}
+
+	for i := 0; i < 4; i++ {
+		if i < len(d.Sensors.ADC.Vals) {
+			fields = append(fields, strconv.Itoa(int(d.Sensors.ADC.Vals[i])))
+		} else {
+			fields = append(fields, "")
+		}
+	}
+
+	fields = append(fields,
+		formatTime(d.Sensors.ADC.Timestamp),
+		formatError(d.Sensors.ADC.Err),
+		formatMeasurement(d.Sensors.AirwayPressure),
+		formatMeasurement(d.Sensors.Oxygen),
+		formatMeasurement(d.Sensors.SupplyPressure),
+		formatFloat(d.Calculated.FlowIntegrated),
+		formatFloat(d.Calculated.FlowIntegratedError),
+		formatTime(d.Calculated.FlowIntegratedTimestamp),
+	)
+
+	b := d.Calculated.Breath
+	fields = append(fields,
+		strconv.FormatUint(b.Number, 10),
+		formatTime(b.Start),
+		formatTime(b.End),
+		formatFloat(b.InspiredVolume),
+		formatFloat(b.InspiredVolumeError),
+		formatFloat(b.ExpiredVolume),
+		formatFloat(b.ExpiredVolumeError),
+		formatFloat(b.Leak),
+		formatFloat(b.LeakError),
+		formatFloat(b.PeakInspiratoryFlow),
+		formatFloat(b.PeakPressure),
+		formatFloat(b.PEEP),
+		strconv.FormatInt(b.InspiratoryTime.Milliseconds(), 10),
+		strconv.FormatInt(b.ExpiratoryTime.Milliseconds(), 10),
+		formatFloat(b.IERatio),
+		formatFloat(b.Rate),
+		formatFloat(b.MinuteVentilation),
+		strconv.Itoa(int(b.Type)),
+	)
+
+	if d.Trigger != nil {
+		fields = append(fields,
+			strconv.Itoa(int(d.Trigger.Type)),
+			strconv.Itoa(int(d.Trigger.Source)),
+		)
+	} else {
+		fields = append(fields, "", "")
+	}
+
+	fields = append(fields,
+		strconv.Itoa(int(d.Valve.Command)),
+		strconv.Itoa(int(d.Valve.Phase)),
+		formatFloat(d.Valve.Setpoint),
+		formatError(d.Valve.Err),
+	)
+
+	fields = append(fields,
+		strconv.FormatUint(d.Stats.OkReads, 10),
+		strconv.FormatUint(d.Stats.FailedReads, 10),
+		strconv.FormatUint(d.Stats.Loops, 10),
+		strconv.FormatUint(d.Stats.Overruns, 10),
+		formatFloat(d.Stats.ReadRate),
+		strconv.FormatInt(d.Stats.Jitter.Microseconds(), 10),
+	)
+
+	for i := 0; i < flows; i++ {
+		if i < len(d.Sensors.Flows) {
+			f := d.Sensors.Flows[i]
+			fields = append(fields, formatFloat(f.Val), strconv.Itoa(int(f.Quality)), formatError(f.Err))
+		} else {
+			fields = append(fields, "", "", "")
+		}
+	}
+
+	return strings.Join(fields, ",") + "\n"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatMeasurement(m Measurement) string {
+	if !m.Valid {
+		return ""
+	}
+	return formatFloat(m.Val)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func formatError(err error) string {
+	if err == nil {
+		return ""
+	}
+	return `"` + strings.ReplaceAll(err.Error(), `"`, `""`) + `"`
+}
@@ -0,0 +1,131 @@
+package ioman
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(RecorderConfig{
+		Directory:   dir,
+		MaxFileSize: 2048,
+		MaxFiles:    3,
+	}, _testSampleRate, []string{"FLOW1", "FLOW2"}, []string{"ADC1"})
+	if err != nil {
+		t.Fatalf("Failed to create recorder: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		rec.Write(DataPacket{
+			Valid:     true,
+			Timestamp: time.Now(),
+			Sensors: Sensors{
+				Flow:  Flow{Val: float64(i), Err: fmt.Errorf("read \"failed\"")},
+				Flows: []Flow{{Val: float64(i), Err: fmt.Errorf("read \"failed\"")}, {Val: 2 * float64(i), Quality: QualityStuck}},
+				ADC:   ADC{Vals: []uint16{1, 2, 3, 4}},
+			},
+		})
+	}
+
+	err = rec.Close()
+	if err != nil {
+		t.Fatalf("Failed to close recorder: %v", err)
+	}
+
+	// A late DataPacket from the io loop is dropped
+	rec.Write(DataPacket{})
+	if rec.Dropped() != 1 || rec.Close() != nil {
+		t.Fatalf("Expected a write after close to be dropped, and close to be repeatable")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "session-*.csv"))
+	if err != nil {
+		t.Fatalf("Failed to list recordings: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected rotation to keep 3 files, got %v", len(files))
+	}
+
+	f, err := os.Open(files[len(files)-1])
+	if err != nil {
+		t.Fatalf("Failed to open recording: %v", err)
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if lines[0] != "# gogles session v2" || lines[1] != "# sample_rate_hz=1000" || lines[2] != "# sensors=FLOW1,FLOW2,ADC1" {
+		t.Fatalf("Unexpected header: %v", lines[:3])
+	}
+	columns := strings.Split(lines[4], ",")
+	if len(columns) != len(_recorderColumns)+6 || columns[len(columns)-3] != "flow1" {
+		t.Fatalf("Unexpected columns: %v", lines[4])
+	}
+
+	last := strings.Split(lines[len(lines)-1], ",")
+	if len(last) != len(columns) || last[3] != "99" {
+		t.Fatalf("Unexpected last record: %v", lines[len(lines)-1])
+	}
+	if flow1 := last[len(last)-3:]; flow1[0] != "198" || flow1[1] != fmt.Sprint(int(QualityStuck)) || flow1[2] != "" {
+		t.Fatalf("Expected the second flow sensor in its own columns, got %v", flow1)
+	}
+}
+
+func TestReplaySession(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(RecorderConfig{Directory: dir, MaxFileSize: 1 << 20}, _testSampleRate, []string{"FLOW1"}, []string{"ADC1"})
+	if err != nil {
+		t.Fatalf("Failed to create recorder: %v", err)
+	}
+	start := time.Unix(1000, 0)
+	for i := 0; i < 10; i++ {
+		flow := Flow{Val: float64(i)}
+		if i == 5 {
+			flow = Flow{Err: fmt.Errorf("nack")}
+		}
+		rec.Write(DataPacket{
+			Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+			Sensors:   Sensors{Flow: flow, ADC: ADC{Vals: []uint16{uint16(i), 2, 3, 4}}},
+		})
+	}
+	err = rec.Close()
+	if err != nil {
+		t.Fatalf("Failed to close recorder: %v", err)
+	}
+
+	// A session plays back as recorded, less the failed flow read
+	files, _ := filepath.Glob(filepath.Join(dir, "session-*.csv"))
+	replay, err := NewReplay(ReplayConfig{FlowFile: files[0], Speed: 1})
+	if err != nil {
+		t.Fatalf("Failed to load session: %v", err)
+	}
+	if len(replay.flows) != 9 || replay.flows[5].Offset != 6*time.Millisecond || replay.flows[5].Val != 6 {
+		t.Fatalf("Unexpected flow records: %+v", replay.flows)
+	}
+	if len(replay.adcs) != 10 || replay.adcs[9].Vals[0] != 9 || replay.Duration() != 9*time.Millisecond {
+		t.Fatalf("Unexpected adc records: %+v", replay.adcs)
+	}
+}
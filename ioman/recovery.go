@@ -0,0 +1,184 @@
+package ioman
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+const _recoveryThreshold = 20                      //consecutive failures before a device is recovered
+const _recoveryFailed = 5                          //recovery attempts after which a device is reported failed
+const _recoveryBackoffMin = 100 * time.Millisecond //delay after the first failed recovery attempt
+const _recoveryBackoffMax = 10 * time.Second       //delay between recovery attempts, doubling up to this
+
+//ErrRecovering is returned in place of a device operation while the device is being recovered
+var ErrRecovering = errors.New("Device is recovering")
+
+//recoverer tracks the health of one device, and recovers it in the background after repeated failures.
+//While recovering, the device belongs to the recovery goroutine and must not be used by the io loop.
+type recoverer struct {
+	label      string
+	mhealth    sync.Mutex
+	health     DeviceHealth
+	recovering bool
+	recover    func(attempt uint64) error //device specific recovery, run off the io loop
+	clock      Clock                      //Times the backoff between attempts
+	stopped    bool                       //No further recovery is started
+	stop       chan struct{}              //Closed to end recovery in progress
+	running    sync.WaitGroup
+}
+
+func newRecoverer(label string, clock Clock, recover func(attempt uint64) error) *recoverer {
+	return &recoverer{
+		label:   label,
+		health:  DeviceHealth{Label: label},
+		recover: recover,
+		clock:   clock,
+		stop:    make(chan struct{}),
+	}
+}
+
+// available returns false while the device is being recovered
+func (r *recoverer) available() bool {
+	r.mhealth.Lock()
+	defer r.mhealth.Unlock()
+	return !r.recovering
+}
+
+// observe records the result of a device operation, starting recovery after _recoveryThreshold consecutive failures
+func (r *recoverer) observe(err error) {
+	r.mhealth.Lock()
+	defer r.mhealth.Unlock()
+
+	if r.recovering {
+		return
+	}
+	if err == nil {
+		r.health.Failures = 0
+		r.health.Err = nil
+		return
+	}
+
+	r.health.Failures++
+	r.health.Err = err
+	if r.health.Failures >= _recoveryThreshold && !r.stopped {
+		logman.Warnf("ioman:recovery", "%v degraded after %v consecutive failures, recovering: %v", r.label, r.health.Failures, err)
+		r.health.State = HealthDegraded
+		r.recovering = true
+		r.running.Add(1)
+		go r.run()
+	}
+}
+
+// shutdown ends recovery, waiting for an attempt in progress, after which recovery no longer uses the device
+func (r *recoverer) shutdown() {
+	r.mhealth.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.stop)
+	}
+	r.mhealth.Unlock()
+
+	r.running.Wait()
+}
+
+func (r *recoverer) run() {
+	defer r.running.Done()
+	backoff := _recoveryBackoffMin
+
+	// The ticker of a backoff is stopped only once the attempt after it has run, and the next backoff started,
+	// so that a VirtualClock is held until each attempt is complete
+	var wait Ticker
+	defer func() {
+		if wait != nil {
+			wait.Stop()
+		}
+	}()
+
+	for attempt := uint64(1); ; attempt++ {
+		err := r.recover(attempt)
+
+		r.mhealth.Lock()
+		r.health.Attempts = attempt
+		if err == nil {
+			logman.Infof("ioman:recovery", "%v recovered after %v attempts", r.label, attempt)
+			r.health = DeviceHealth{Label: r.label}
+			r.recovering = false
+			r.mhealth.Unlock()
+			return
+		}
+		r.health.Err = err
+		if attempt >= _recoveryFailed && r.health.State != HealthFailed {
+			logman.Errorf("ioman:recovery", "%v failed, recovery continues every %v", r.label, _recoveryBackoffMax)
+			r.health.State = HealthFailed
+		}
+		r.mhealth.Unlock()
+
+		logman.Warnf("ioman:recovery", "%v recovery attempt %v failed, retrying in %v: %v", r.label, attempt, backoff, err)
+		next := r.clock.NewTicker(backoff)
+		if wait != nil {
+			wait.Stop()
+		}
+		wait = next
+		select {
+		case <-wait.C():
+		case <-r.stop:
+			logman.Infof("ioman:recovery", "%v recovery stopped", r.label)
+			return
+		}
+		backoff *= 2
+		if backoff > _recoveryBackoffMax {
+			backoff = _recoveryBackoffMax
+		}
+	}
+}
+
+//Health ..
+func (r *recoverer) Health() DeviceHealth {
+	r.mhealth.Lock()
+	defer r.mhealth.Unlock()
+	return r.health
+}
+
+// reopen re-opens the bus of a device if it supports it, from the second recovery attempt on
+func reopen(device interface{}, label string, attempt uint64) error {
+	r, ok := device.(Reopener)
+	if !ok || attempt < 2 {
+		return nil
+	}
+
+	logman.Infof("ioman:recovery", "Re-opening bus of %v", label)
+	err := r.Reopen()
+	if err != nil {
+		return fmt.Errorf("Failed to re-open bus of %v: %w", label, err)
+	}
+	return nil
+}
+
+func (io *IOMan) recoverFlow(i int, attempt uint64) error {
+	flow := io.sensors.Flows[i]
+	err := reopen(flow, flow.Label(), attempt)
+	if err != nil {
+		return err
+	}
+	return testFlow(flow, io.clock)
+}
+
+func (io *IOMan) recoverADC(attempt uint64) error {
+	err := reopen(io.sensors.ADC, io.sensors.ADC.Label(), attempt)
+	if err != nil {
+		return err
+	}
+	return testADC(io.sensors.ADC, io.clock)
+}
+
+func (io *IOMan) recoverDAC(attempt uint64) error {
+	err := reopen(io.sensors.DAC, io.sensors.DAC.Label(), attempt)
+	if err != nil {
+		return err
+	}
+	return testDAC(io.sensors.DAC)
+}
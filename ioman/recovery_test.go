@@ -0,0 +1,245 @@
+package ioman
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//glitchFlow fails reads from a chosen point until it is soft reset, or re-opened if stuck
+type glitchFlow struct {
+	fakeFlow
+	mglitch  sync.Mutex
+	failing  bool
+	stuck    bool //soft reset does not clear the fault
+	resets   int
+	reopens  int
+	failures int
+}
+
+func (f *glitchFlow) fail(stuck bool) {
+	f.mglitch.Lock()
+	defer f.mglitch.Unlock()
+	f.failing = true
+	f.stuck = stuck
+}
+
+func (f *glitchFlow) SoftReset() error {
+	f.mglitch.Lock()
+	defer f.mglitch.Unlock()
+	f.resets++
+	if f.stuck {
+		return fmt.Errorf("nack")
+	}
+	f.failing = false
+	return nil
+}
+
+func (f *glitchFlow) Reopen() error {
+	f.mglitch.Lock()
+	defer f.mglitch.Unlock()
+	f.reopens++
+	f.stuck = false
+	f.failing = false
+	return nil
+}
+
+func (f *glitchFlow) GetRaw() (uint16, uint8, time.Time, error) {
+	f.mglitch.Lock()
+	defer f.mglitch.Unlock()
+	if f.failing {
+		f.failures++
+		return 0, 0, time.Now(), fmt.Errorf("nack")
+	}
+	return f.fakeFlow.GetRaw()
+}
+
+// waitHealth waits for the flow sensor to reach state, returning the last DataPacket
+func waitHealth(t *testing.T, iom *IOMan, state EnumHealth) DataPacket {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		dp := iom.GetDataPacket()
+		if dp.Health.Flow.State == state && (state != HealthOK || dp.Valid) {
+			return dp
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Flow sensor did not reach %v, health %+v", state, iom.Health().Flow)
+	return DataPacket{}
+}
+
+func TestRecovery(t *testing.T) {
+	for _, stuck := range []bool{false, true} {
+		flow := &glitchFlow{fakeFlow: fakeFlow{val: 10}}
+		iom, err := NewIOManWithDevices(Devices{
+			Flows: []FlowSensor{flow},
+			ADC:   &fakeADC{},
+			DAC:   &fakeDAC{},
+		}, DefaultHardwareConfig())
+		if err != nil {
+			t.Fatalf("Failed to create IOMan: %v", err)
+		}
+
+		cherr := startIOMan(t, iom)
+		waitHealth(t, iom, HealthOK)
+
+		// A failing sensor is degraded and recovered, without ending the io loop
+		flow.fail(stuck)
+		dp := waitHealth(t, iom, HealthDegraded)
+		if dp.Valid || dp.Valve.Err == nil {
+			t.Fatalf("Expected invalid data and the valve in its safe state while degraded, got %+v", dp)
+		}
+		waitHealth(t, iom, HealthOK)
+
+		flow.mglitch.Lock()
+		if flow.failures < _recoveryThreshold || flow.failures > 2*_recoveryThreshold {
+			t.Fatalf("Expected reads to stop once recovery starts after %v failures, got %v", _recoveryThreshold, flow.failures)
+		}
+		if stuck && flow.reopens != 1 {
+			t.Fatalf("Expected a stuck sensor to be re-opened once, got %v", flow.reopens)
+		}
+		if !stuck && flow.reopens != 0 {
+			t.Fatalf("Expected a soft reset to recover the sensor without re-opening, got %v", flow.reopens)
+		}
+		flow.mglitch.Unlock()
+
+		select {
+		case err := <-cherr:
+			t.Fatalf("Expected io loop to continue, got %v", err)
+		default:
+		}
+	}
+}
+
+func TestRecovererFailed(t *testing.T) {
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	attempts := make(chan uint64, _recoveryFailed+1)
+	r := newRecoverer("TEST", clock, func(attempt uint64) error {
+		attempts <- attempt
+		if attempt > _recoveryFailed {
+			return nil
+		}
+		return fmt.Errorf("attempt %v failed", attempt)
+	})
+
+	for i := 0; i < _recoveryThreshold-1; i++ {
+		r.observe(fmt.Errorf("failed"))
+	}
+	r.observe(nil)
+	if !r.available() || r.Health().State != HealthOK || r.Health().Failures != 0 {
+		t.Fatalf("Expected a success to reset the failure count, got %+v", r.Health())
+	}
+
+	for i := 0; i < _recoveryThreshold; i++ {
+		r.observe(fmt.Errorf("failed"))
+	}
+	if r.available() {
+		t.Fatalf("Expected device to be unavailable while recovering")
+	}
+
+	// Each failed attempt is followed by a doubling backoff on the clock, the device is reported failed before finally recovering
+	backoff := _recoveryBackoffMin
+	for a := uint64(1); a <= _recoveryFailed; a++ {
+		if attempt := <-attempts; attempt != a {
+			t.Fatalf("Expected attempt %v, got %v", a, attempt)
+		}
+		clock.WaitForTickers(1)
+		if failed := r.Health().State == HealthFailed; failed != (a == _recoveryFailed) {
+			t.Fatalf("Expected device to be reported failed after %v attempts, got %+v after %v", _recoveryFailed, r.Health(), a)
+		}
+
+		clock.Advance(backoff - time.Millisecond)
+		if len(attempts) != 0 {
+			t.Fatalf("Expected attempt %v to wait %v", a+1, backoff)
+		}
+		clock.Advance(time.Millisecond)
+		backoff *= 2
+	}
+
+	if attempt := <-attempts; attempt != _recoveryFailed+1 {
+		t.Fatalf("Expected attempt %v, got %v", _recoveryFailed+1, attempt)
+	}
+	if !r.available() || r.Health().State != HealthOK {
+		t.Fatalf("Expected device to recover, got %+v", r.Health())
+	}
+}
+
+func TestRecoveryShutdown(t *testing.T) {
+	attempts := make(chan uint64, 100)
+	r := newRecoverer("TEST", SystemClock(), func(attempt uint64) error {
+		attempts <- attempt
+		return fmt.Errorf("nack")
+	})
+	for i := 0; i < _recoveryThreshold; i++ {
+		r.observe(fmt.Errorf("nack"))
+	}
+	<-attempts
+
+	// Shutdown interrupts the backoff, and no further recovery is started
+	done := make(chan struct{})
+	go func() {
+		r.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected shutdown to end recovery in progress")
+	}
+	r.shutdown()
+
+	r.mhealth.Lock()
+	r.recovering = false
+	r.mhealth.Unlock()
+	for i := 0; i < _recoveryThreshold; i++ {
+		r.observe(fmt.Errorf("nack"))
+	}
+	if !r.available() || len(attempts) > 1 {
+		t.Fatalf("Expected no recovery after shutdown, got %v further attempts", len(attempts))
+	}
+}
+
+func TestReopenWhileRunning(t *testing.T) {
+	nop := func() error { return nil }
+	flow := newReopenableFlow(DefaultHardwareConfig().Flows[0].Label, func() (FlowSensor, closer, error) { return &fakeFlow{val: 10}, nop, nil })
+	dac := newReopenableDAC("DAC", func() (DACWriter, closer, error) { return &fakeDAC{}, nop, nil })
+	for _, r := range []Reopener{flow, dac} {
+		err := r.Reopen()
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+	}
+
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{flow},
+		ADC:   &fakeADC{},
+		DAC:   dac,
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+
+	// Swap the devices under the running io loop, as recovery does, for the race detector to check
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- iom.Start(ctx, make(chan error, 1)) }()
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_ = flow.Reopen()
+		_ = dac.Reopen()
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	err = <-stopped
+	if err != nil {
+		t.Fatalf("Failed to stop: %v", err)
+	}
+
+	dp := iom.GetDataPacket()
+	if dp.Sensors.Flow.Label != DefaultHardwareConfig().Flows[0].Label || !dp.Valid {
+		t.Fatalf("Expected valid packets throughout, got %+v", dp)
+	}
+}
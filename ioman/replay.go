@@ -0,0 +1,419 @@
+package ioman
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//ErrReplayEnded is returned by replay devices once a non looping capture has been played out
+var ErrReplayEnded = errors.New("replay has ended")
+
+//ReplayConfig ..
+type ReplayConfig struct {
+	FlowFile  string  //CSV of duration,flow, or a session recording
+	ADCFile   string  //CSV of duration,val0,val1...; optional, in place of the adc values of a session recording
+	Speed     float64 //Playback speed multiplier, 1 for original timing
+	Loop      bool    //Restart from the beginning at the end of the capture
+	FlowIsAir bool    //Flow sensor gas the CRCs of replayed samples are computed for
+}
+
+//FlowRecord is a single recorded flow sample at an offset from the start of a capture
+type FlowRecord struct {
+	Offset time.Duration
+	Val    float64
+}
+
+//ADCRecord is a single recorded set of ADC values at an offset from the start of a capture
+type ADCRecord struct {
+	Offset time.Duration
+	Vals   []uint16
+}
+
+//Replay plays recorded flow and ADC captures back through the IOMan device interfaces
+type Replay struct {
+	flows []FlowRecord
+	adcs  []ADCRecord
+	speed float64
+	loop  bool
+	isAir bool      //Flow sensor gas of returned CRCs
+	epoch time.Time //Timestamp base of returned samples
+	clock Clock
+
+	mreplay sync.Mutex
+	start   time.Time     //Clock time at which position was last set
+	offset  time.Duration //Position at start
+}
+
+//NewReplay loads the capture files described by config
+func NewReplay(config ReplayConfig) (*Replay, error) {
+
+	f, err := os.Open(config.FlowFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open flow capture %v: %w", config.FlowFile, err)
+	}
+	defer f.Close()
+
+	var flows []FlowRecord
+	adcs := []ADCRecord{}
+	reader := bufio.NewReader(f)
+	if isSession(reader) {
+		flows, adcs, err = ParseSessionCSV(reader)
+	} else {
+		flows, err = ParseFlowCSV(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse flow capture %v: %w", config.FlowFile, err)
+	}
+
+	if config.ADCFile != "" {
+		a, err := os.Open(config.ADCFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open adc capture %v: %w", config.ADCFile, err)
+		}
+		defer a.Close()
+
+		adcs, err = ParseADCCSV(a)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse adc capture %v: %w", config.ADCFile, err)
+		}
+	}
+
+	r, err := NewReplayFromRecords(flows, adcs, config.Speed, config.Loop)
+	if err != nil {
+		return nil, err
+	}
+	r.isAir = config.FlowIsAir
+	return r, nil
+}
+
+//NewReplayFromRecords creates a replay from already loaded records
+func NewReplayFromRecords(flows []FlowRecord, adcs []ADCRecord, speed float64, loop bool) (*Replay, error) {
+	if len(flows) == 0 {
+		return nil, fmt.Errorf("Flow capture is empty")
+	}
+	if speed <= 0 {
+		return nil, fmt.Errorf("Replay speed must be positive, got %v", speed)
+	}
+
+	clock := SystemClock()
+	now := clock.Now()
+	return &Replay{
+		flows: flows,
+		adcs:  adcs,
+		speed: speed,
+		loop:  loop,
+		epoch: now,
+		clock: clock,
+		start: now,
+	}, nil
+}
+
+//SetClock sets the time the replay plays back in, real time by default, and restarts it from the beginning.
+//Must be called before the devices are used.
+func (r *Replay) SetClock(clock Clock) {
+	r.mreplay.Lock()
+	defer r.mreplay.Unlock()
+
+	r.clock = clock
+	r.epoch = clock.Now()
+	r.start = r.epoch
+	r.offset = 0
+}
+
+//Devices returns FlowSensor, ADCReader and DACWriter implementations backed by the replay, sampled with its clock
+func (r *Replay) Devices() Devices {
+	return Devices{
+		Flows: []FlowSensor{&replayFlow{replay: r}},
+		ADC:   &replayADC{replay: r},
+		DAC:   &replayDAC{},
+		Clock: r.clock,
+	}
+}
+
+//Duration returns the length of the flow capture
+func (r *Replay) Duration() time.Duration {
+	return r.flows[len(r.flows)-1].Offset
+}
+
+// span returns the time one pass of the capture takes. When looping it is one sample period longer than Duration,
+// so that the first sample of a pass follows the last sample of the one before.
+func (r *Replay) span() time.Duration {
+	length := r.Duration()
+	if r.loop && len(r.flows) > 1 {
+		length += r.flows[len(r.flows)-1].Offset - r.flows[len(r.flows)-2].Offset
+	}
+	return length
+}
+
+//Position returns the current playback position within the capture
+func (r *Replay) Position() time.Duration {
+	r.mreplay.Lock()
+	defer r.mreplay.Unlock()
+
+	position, _ := r.position()
+	return position
+}
+
+//Seek moves playback to position within the capture
+func (r *Replay) Seek(position time.Duration) {
+	r.mreplay.Lock()
+	defer r.mreplay.Unlock()
+
+	if position < 0 {
+		position = 0
+	}
+	if position > r.Duration() {
+		position = r.Duration()
+	}
+
+	r.start = r.clock.Now()
+	r.offset = position
+}
+
+// position returns the position within the capture, and the number of completed loops
+func (r *Replay) position() (time.Duration, int) {
+	elapsed := r.offset + time.Duration(float64(r.clock.Now().Sub(r.start))*r.speed)
+	length := r.span()
+
+	if length <= 0 {
+		return 0, 0
+	}
+	if !r.loop {
+		if elapsed > length {
+			return length, 0
+		}
+		return elapsed, 0
+	}
+	return elapsed % length, int(elapsed / length)
+}
+
+func (r *Replay) ended() bool {
+	if r.loop {
+		return false
+	}
+	elapsed := r.offset + time.Duration(float64(r.clock.Now().Sub(r.start))*r.speed)
+	return elapsed > r.Duration()
+}
+
+type replayFlow struct {
+	replay *Replay
+}
+
+func (f *replayFlow) Label() string              { return "REPLAYFLOW" }
+func (f *replayFlow) SoftReset() error           { return nil }
+func (f *replayFlow) GetSerial() (uint32, error) { return 0, nil }
+
+func (f *replayFlow) GetRaw() (uint16, uint8, time.Time, error) {
+	r := f.replay
+	r.mreplay.Lock()
+	defer r.mreplay.Unlock()
+
+	if r.ended() {
+		return 0, 0, time.Time{}, ErrReplayEnded
+	}
+
+	position, loops := r.position()
+	i := sort.Search(len(r.flows), func(i int) bool { return r.flows[i].Offset > position }) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	rec := r.flows[i]
+	tstamp := r.epoch.Add(time.Duration(loops)*r.span() + rec.Offset)
+
+	raw, crc := sfm3000Encode(rec.Val, r.isAir)
+	return raw, crc, tstamp, nil
+}
+
+type replayADC struct {
+	replay *Replay
+}
+
+func (a *replayADC) Label() string { return "REPLAYADC" }
+
+func (a *replayADC) GetValues(start int, count int) ([]uint16, time.Time, error) {
+	r := a.replay
+	r.mreplay.Lock()
+	defer r.mreplay.Unlock()
+
+	vals := make([]uint16, count)
+
+	if r.ended() {
+		return vals, time.Time{}, ErrReplayEnded
+	}
+
+	position, loops := r.position()
+	tstamp := r.epoch.Add(time.Duration(loops)*r.span() + position)
+
+	i := sort.Search(len(r.adcs), func(i int) bool { return r.adcs[i].Offset > position }) - 1
+	if i < 0 {
+		return vals, tstamp, nil
+	}
+
+	for c := range vals {
+		if start+c < len(r.adcs[i].Vals) {
+			vals[c] = r.adcs[i].Vals[start+c]
+		}
+	}
+
+	return vals, tstamp, nil
+}
+
+type replayDAC struct{}
+
+func (d *replayDAC) Label() string            { return "REPLAYDAC" }
+func (d *replayDAC) Write(value uint16) error { return nil }
+
+//ParseFlowCSV parses a flow capture of duration,flow records, such as 1.5ms,12.25
+func ParseFlowCSV(reader io.Reader) ([]FlowRecord, error) {
+
+	cs := csv.NewReader(reader)
+	cs.FieldsPerRecord = -1
+	records, err := cs.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read csv: %w", err)
+	}
+
+	flows := []FlowRecord{}
+	for _, v := range records {
+		if len(v) < 2 {
+			continue //Trailing partial records are expected on captures cut short
+		}
+
+		offset, err := time.ParseDuration(v[0])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse duration: %v", v[0])
+		}
+		val, err := strconv.ParseFloat(v[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse value: %v", v[1])
+		}
+
+		flows = append(flows, FlowRecord{
+			Offset: offset,
+			Val:    val,
+		})
+	}
+
+	return flows, nil
+}
+
+// isSession returns true if reader starts with the header of a session recording
+func isSession(reader *bufio.Reader) bool {
+	header, _ := reader.Peek(len(_sessionHeader))
+	return string(header) == _sessionHeader
+}
+
+//ParseSessionCSV parses the flow and adc values of a session recording, as written by Recorder, with offsets from
+//its first record. Records without a flow or adc reading are skipped for that capture.
+func ParseSessionCSV(reader io.Reader) ([]FlowRecord, []ADCRecord, error) {
+
+	cs := csv.NewReader(reader)
+	cs.Comment = '#'
+	cs.FieldsPerRecord = -1
+	records, err := cs.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to read csv: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("Session has no columns")
+	}
+
+	index := map[string]int{}
+	for i, c := range records[0] {
+		index[c] = i
+	}
+	required := []string{"timestamp_ns", "flow", "flow_err", "adc0", "adc1", "adc2", "adc3", "adc_err"}
+	for _, c := range required {
+		if _, ok := index[c]; !ok {
+			return nil, nil, fmt.Errorf("Session has no %v column", c)
+		}
+	}
+
+	flows := []FlowRecord{}
+	adcs := []ADCRecord{}
+	var first int64
+	for n, v := range records[1:] {
+		if len(v) != len(records[0]) {
+			continue //Trailing partial records are expected on sessions cut short
+		}
+
+		ts, err := strconv.ParseInt(v[index["timestamp_ns"]], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse timestamp: %v", v[index["timestamp_ns"]])
+		}
+		if n == 0 {
+			first = ts
+		}
+		offset := time.Duration(ts - first)
+
+		if v[index["flow_err"]] == "" {
+			val, err := strconv.ParseFloat(v[index["flow"]], 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Failed to parse value: %v", v[index["flow"]])
+			}
+			flows = append(flows, FlowRecord{Offset: offset, Val: val})
+		}
+
+		if v[index["adc_err"]] == "" && v[index["adc0"]] != "" {
+			vals := []uint16{}
+			for _, c := range []string{"adc0", "adc1", "adc2", "adc3"} {
+				val, err := strconv.ParseUint(v[index[c]], 10, 16)
+				if err != nil {
+					return nil, nil, fmt.Errorf("Failed to parse value: %v", v[index[c]])
+				}
+				vals = append(vals, uint16(val))
+			}
+			adcs = append(adcs, ADCRecord{Offset: offset, Vals: vals})
+		}
+	}
+
+	return flows, adcs, nil
+}
+
+//ParseADCCSV parses an adc capture of duration,val0,val1... records
+func ParseADCCSV(reader io.Reader) ([]ADCRecord, error) {
+
+	cs := csv.NewReader(reader)
+	cs.FieldsPerRecord = -1
+	records, err := cs.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read csv: %w", err)
+	}
+
+	adcs := []ADCRecord{}
+	for _, v := range records {
+		if len(v) < 2 {
+			continue
+		}
+
+		offset, err := time.ParseDuration(v[0])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse duration: %v", v[0])
+		}
+
+		vals := []uint16{}
+		for _, c := range v[1:] {
+			val, err := strconv.ParseUint(c, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse value: %v", c)
+			}
+			vals = append(vals, uint16(val))
+		}
+
+		adcs = append(adcs, ADCRecord{
+			Offset: offset,
+			Vals:   vals,
+		})
+	}
+
+	return adcs, nil
+}
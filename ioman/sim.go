@@ -0,0 +1,258 @@
+package ioman
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const _simMaxStep = time.Millisecond //Maximum integration step of the lung model
+const _simDACFullScale = 4095        //MCP4921 is 12 bit
+const _simADCFullScale = 4095        //MCP3208 is 12 bit
+
+//SimConfig describes the simulated patient and lung
+type SimConfig struct {
+	Compliance     float64 //Lung compliance in mL/cmH2O
+	Resistance     float64 //Airway resistance in cmH2O/(L/s)
+	Rate           float64 //Spontaneous respiratory rate in breaths per minute
+	IERatio        float64 //Expiratory time as a multiple of inspiratory time, 1:IERatio
+	Effort         float64 //Peak patient muscle pressure in cmH2O, 0 for an apnoeic patient
+	PEEP           float64 //Ventilator baseline pressure in cmH2O, applied with the valve closed
+	SupplyPressure float64 //Ventilator pressure above PEEP in cmH2O with the valve fully open
+	Oxygen         float64 //Delivered oxygen in percent O2
+	Supply         float64 //Gas supply pressure in kPa
+	Noise          float64 //Standard deviation of flow sensor noise in slm
+	Seed           int64   //Seed for the noise generator
+	FlowIsAir      bool    //Flow sensor gas the simulated samples are encoded for
+}
+
+//DefaultSimConfig returns an adult patient with light spontaneous effort
+func DefaultSimConfig() SimConfig {
+	return SimConfig{
+		Compliance:     50,
+		Resistance:     5,
+		Rate:           15,
+		IERatio:        2,
+		Effort:         8,
+		PEEP:           5,
+		SupplyPressure: 40,
+		Oxygen:         21,
+		Supply:         400,
+		Noise:          0.2,
+		Seed:           1,
+		FlowIsAir:      false,
+	}
+}
+
+//Validate ..
+func (c SimConfig) Validate() error {
+	if c.Compliance <= 0 || c.Resistance <= 0 {
+		return fmt.Errorf("Compliance and resistance must be positive, got %v and %v", c.Compliance, c.Resistance)
+	}
+	if c.Rate < 0 || c.IERatio <= 0 {
+		return fmt.Errorf("Rate must not be negative and I:E ratio must be positive, got %v and %v", c.Rate, c.IERatio)
+	}
+	if c.Effort < 0 || c.Noise < 0 {
+		return fmt.Errorf("Effort and noise must not be negative, got %v and %v", c.Effort, c.Noise)
+	}
+	if c.Oxygen < 21 || c.Oxygen > 100 {
+		return fmt.Errorf("Oxygen must be between 21 and 100 percent, got %v", c.Oxygen)
+	}
+	return nil
+}
+
+//SimLung is a single compartment lung model driven by patient effort and the valve DAC
+type SimLung struct {
+	config SimConfig
+	rand   *rand.Rand
+	clock  Clock
+
+	mlung   sync.Mutex
+	elapsed time.Duration //Simulated time since start
+	last    time.Time     //Clock time of last advance
+	volume  float64       //Volume above relaxation volume in L
+	flow    float64       //Flow into the lung in L/s
+	dac     uint16        //Last valve command
+}
+
+//NewSimLung ..
+func NewSimLung(config SimConfig) *SimLung {
+	s := SimLung{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+		clock:  SystemClock(),
+	}
+	s.volume = s.config.PEEP * s.compliance()
+
+	return &s
+}
+
+//SetClock sets the time the lung advances in, real time by default. Must be called before the devices are used.
+func (s *SimLung) SetClock(clock Clock) {
+	s.mlung.Lock()
+	defer s.mlung.Unlock()
+	s.clock = clock
+	s.last = time.Time{}
+}
+
+//Devices returns FlowSensor, ADCReader and DACWriter implementations backed by the lung, advancing with its clock
+func (s *SimLung) Devices() Devices {
+	return Devices{
+		Flows: []FlowSensor{&simFlow{lung: s}},
+		ADC:   &simADC{lung: s},
+		DAC:   &simDAC{lung: s},
+		Clock: s.clock,
+	}
+}
+
+//Step advances the model by dt
+func (s *SimLung) Step(dt time.Duration) {
+	s.mlung.Lock()
+	defer s.mlung.Unlock()
+	s.step(dt)
+}
+
+//SetValve sets the valve command as a DAC value
+func (s *SimLung) SetValve(value uint16) {
+	s.mlung.Lock()
+	defer s.mlung.Unlock()
+	s.dac = value
+}
+
+//Flow returns the current flow into the lung in slm
+func (s *SimLung) Flow() float64 {
+	s.mlung.Lock()
+	defer s.mlung.Unlock()
+	return s.flow * 60
+}
+
+//Volume returns the current volume above relaxation volume in L
+func (s *SimLung) Volume() float64 {
+	s.mlung.Lock()
+	defer s.mlung.Unlock()
+	return s.volume
+}
+
+//Pressure returns the current airway pressure in cmH2O
+func (s *SimLung) Pressure() float64 {
+	s.mlung.Lock()
+	defer s.mlung.Unlock()
+	return s.airway()
+}
+
+func (s *SimLung) compliance() float64 {
+	return s.config.Compliance / 1000 //mL/cmH2O to L/cmH2O
+}
+
+func (s *SimLung) airway() float64 {
+	if s.dac > _simDACFullScale {
+		return s.config.PEEP + s.config.SupplyPressure
+	}
+	return s.config.PEEP + s.config.SupplyPressure*float64(s.dac)/_simDACFullScale
+}
+
+func (s *SimLung) muscle() float64 {
+	if s.config.Rate <= 0 || s.config.Effort <= 0 {
+		return 0
+	}
+
+	period := 60 / s.config.Rate
+	inspiration := period / (1 + s.config.IERatio)
+	t := math.Mod(s.elapsed.Seconds(), period)
+
+	if t >= inspiration {
+		return 0
+	}
+	return s.config.Effort * math.Sin(math.Pi*t/inspiration)
+}
+
+// step integrates P_aw + P_mus = V/C + R*Q over dt, in sub steps of at most _simMaxStep
+func (s *SimLung) step(dt time.Duration) {
+	for dt > 0 {
+		h := dt
+		if h > _simMaxStep {
+			h = _simMaxStep
+		}
+
+		s.flow = (s.airway() + s.muscle() - s.volume/s.compliance()) / s.config.Resistance
+		s.volume += s.flow * h.Seconds()
+		s.elapsed += h
+		dt -= h
+	}
+}
+
+func (s *SimLung) advance() time.Time {
+	now := s.clock.Now()
+	if !s.last.IsZero() {
+		s.step(now.Sub(s.last))
+	}
+	s.last = now
+	return now
+}
+
+type simFlow struct {
+	lung *SimLung
+}
+
+func (f *simFlow) Label() string              { return "SIMFLOW" }
+func (f *simFlow) SoftReset() error           { return nil }
+func (f *simFlow) GetSerial() (uint32, error) { return 0, nil }
+
+func (f *simFlow) GetRaw() (uint16, uint8, time.Time, error) {
+	f.lung.mlung.Lock()
+	defer f.lung.mlung.Unlock()
+
+	now := f.lung.advance()
+	raw, crc := sfm3000Encode(f.lung.flow*60+f.lung.rand.NormFloat64()*f.lung.config.Noise, f.lung.config.FlowIsAir)
+
+	return raw, crc, now, nil
+}
+
+type simADC struct {
+	lung *SimLung
+}
+
+func (a *simADC) Label() string { return "SIMADC" }
+
+func (a *simADC) GetValues(start int, count int) ([]uint16, time.Time, error) {
+	a.lung.mlung.Lock()
+	defer a.lung.mlung.Unlock()
+
+	now := a.lung.advance()
+
+	// Channels match DefaultChannelMap
+	vals := make([]uint16, count)
+	for i := range vals {
+		switch start + i {
+		case 0:
+			vals[i] = simCounts(_defaultPressureOffset + a.lung.airway()*_defaultPressureGain)
+		case 1:
+			vals[i] = simCounts(_defaultOxygenOffset + a.lung.config.Oxygen*_defaultOxygenGain)
+		case 2:
+			vals[i] = simCounts(_defaultSupplyOffset + a.lung.config.Supply*_defaultSupplyGain)
+		}
+	}
+
+	return vals, now, nil
+}
+
+func simCounts(counts float64) uint16 {
+	return uint16(math.Max(0, math.Min(_simADCFullScale, math.Round(counts))))
+}
+
+type simDAC struct {
+	lung *SimLung
+}
+
+func (d *simDAC) Label() string { return "SIMDAC" }
+
+func (d *simDAC) Write(value uint16) error {
+	d.lung.mlung.Lock()
+	defer d.lung.mlung.Unlock()
+
+	d.lung.advance()
+	d.lung.dac = value
+	return nil
+}
@@ -0,0 +1,42 @@
+package ioman
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSimLung(t *testing.T) {
+
+	config := DefaultSimConfig()
+	lung := NewSimLung(config)
+
+	// Spontaneous breathing should inhale and exhale within one breath period
+	period := time.Duration(60/config.Rate) * time.Second
+	peak := float64(0)
+	trough := float64(0)
+	for elapsed := time.Duration(0); elapsed < period; elapsed += time.Millisecond {
+		lung.Step(time.Millisecond)
+		peak = math.Max(peak, lung.Flow())
+		trough = math.Min(trough, lung.Flow())
+	}
+	if peak <= DefaultBreathConfig().InFlowThreshold {
+		t.Fatalf("Expected inspiratory flow above %v slm, got %v", DefaultBreathConfig().InFlowThreshold, peak)
+	}
+	if trough >= 0 {
+		t.Fatalf("Expected expiratory flow below 0 slm, got %v", trough)
+	}
+
+	// Opening the valve should drive flow into the lung
+	config.Effort = 0
+	lung = NewSimLung(config)
+	lung.Step(time.Second)
+	lung.SetValve(_simDACFullScale / 2)
+	lung.Step(10 * time.Millisecond)
+	if lung.Flow() <= 0 {
+		t.Fatalf("Expected positive flow with valve open, got %v", lung.Flow())
+	}
+	if math.Abs(lung.Pressure()-(config.PEEP+config.SupplyPressure/2)) > 0.1 {
+		t.Fatalf("Expected airway pressure of %v, got %v", config.PEEP+config.SupplyPressure/2, lung.Pressure())
+	}
+}
@@ -0,0 +1,185 @@
+package ioman
+
+import (
+	"sync"
+	"time"
+)
+
+const _statsWindow = time.Second //sliding window of the windowed statistics
+const _statsBuckets = 10         //resolution of the sliding window
+
+//Bus indexes of statsCollector, each flow sensor has its own from _busFlow on, in HardwareConfig order
+const (
+	_busADC = iota
+	_busDAC
+	_busFlow
+)
+
+type statsBucket struct {
+	start      time.Time
+	ok         uint64 //loops with flow and ADC read ok
+	jitter     time.Duration
+	failed     []uint64        //by bus index
+	maxLatency []time.Duration //by bus index
+}
+
+//statsCollector accumulates io loop statistics, windowed statistics are kept in buckets of _statsWindow/_statsBuckets
+type statsCollector struct {
+	period    time.Duration //expected time between loops
+	mstats    sync.Mutex
+	stats     Stats
+	buses     []BusStats //by bus index
+	buckets   [_statsBuckets]statsBucket
+	started   time.Time
+	lastStart time.Time //start of the previous loop
+}
+
+func newStatsCollector(period time.Duration, flows int) *statsCollector {
+	s := statsCollector{
+		period: period,
+		buses:  make([]BusStats, _busFlow+flows),
+	}
+	for i := range s.buckets {
+		s.buckets[i].failed = make([]uint64, len(s.buses))
+		s.buckets[i].maxLatency = make([]time.Duration, len(s.buses))
+	}
+	return &s
+}
+
+// bucket returns the bucket for t, clearing it if it held an expired interval
+func (s *statsCollector) bucket(t time.Time) *statsBucket {
+	width := _statsWindow / _statsBuckets
+	start := t.Truncate(width)
+	b := &s.buckets[(start.UnixNano()/int64(width))%_statsBuckets]
+	if !b.start.Equal(start) {
+		b.start = start
+		b.ok = 0
+		b.jitter = 0
+		for i := range b.failed {
+			b.failed[i] = 0
+			b.maxLatency[i] = 0
+		}
+	}
+	return b
+}
+
+// loop records the start of a loop iteration
+func (s *statsCollector) loop(start time.Time) {
+	s.mstats.Lock()
+	defer s.mstats.Unlock()
+
+	if s.started.IsZero() {
+		s.started = start
+	}
+	s.stats.Loops++
+
+	if !s.lastStart.IsZero() {
+		jitter := start.Sub(s.lastStart) - s.period
+		if jitter < 0 {
+			jitter = -jitter
+		}
+		b := s.bucket(start)
+		if jitter > b.jitter {
+			b.jitter = jitter
+		}
+	}
+	s.lastStart = start
+}
+
+// done records the end of a loop iteration, counting an overrun if it took longer than the period
+func (s *statsCollector) done(start time.Time, end time.Time) {
+	s.mstats.Lock()
+	defer s.mstats.Unlock()
+
+	if end.Sub(start) > s.period {
+		s.stats.Overruns++
+	}
+}
+
+// read records whether both flow and ADC were read ok
+func (s *statsCollector) read(t time.Time, ok bool) {
+	s.mstats.Lock()
+	defer s.mstats.Unlock()
+
+	if ok {
+		s.stats.OkReads++
+		s.bucket(t).ok++
+	} else {
+		s.stats.FailedReads++
+	}
+}
+
+// operation records a device operation on bus, started at start
+func (s *statsCollector) operation(bus int, start time.Time, end time.Time, err error) {
+	s.mstats.Lock()
+	defer s.mstats.Unlock()
+
+	b := s.bucket(end)
+	latency := end.Sub(start)
+	if latency > b.maxLatency[bus] {
+		b.maxLatency[bus] = latency
+	}
+
+	if err == nil {
+		s.buses[bus].Ok++
+		s.buses[bus].Consecutive = 0
+		return
+	}
+	s.buses[bus].Failed++
+	s.buses[bus].Consecutive++
+	b.failed[bus]++
+}
+
+// snapshot returns cumulative statistics, and windowed statistics over the window ending at now
+func (s *statsCollector) snapshot(now time.Time) Stats {
+	s.mstats.Lock()
+	defer s.mstats.Unlock()
+
+	stats := s.stats
+	buses := make([]BusStats, len(s.buses))
+	copy(buses, s.buses)
+	for i := range buses {
+		buses[i].FailureRate = 0
+		buses[i].MaxLatency = 0
+	}
+	stats.ADC, stats.DAC, stats.Flows = buses[_busADC], buses[_busDAC], buses[_busFlow:]
+
+	if s.started.IsZero() {
+		return stats
+	}
+
+	ok := uint64(0)
+	oldest := now
+	for _, b := range s.buckets {
+		if b.start.IsZero() || now.Sub(b.start) >= _statsWindow || b.start.After(now) {
+			continue
+		}
+		if b.start.Before(oldest) {
+			oldest = b.start
+		}
+		ok += b.ok
+		if b.jitter > stats.Jitter {
+			stats.Jitter = b.jitter
+		}
+		for i := range buses {
+			buses[i].FailureRate += float64(b.failed[i])
+			if b.maxLatency[i] > buses[i].MaxLatency {
+				buses[i].MaxLatency = b.maxLatency[i]
+			}
+		}
+	}
+
+	// Rates are over the time the buckets cover, which is shorter than _statsWindow until running that long
+	if oldest.Before(s.started) {
+		oldest = s.started
+	}
+	if window := now.Sub(oldest).Seconds(); window > 0 {
+		stats.ReadRate = float64(ok) / window
+		for i := range buses {
+			buses[i].FailureRate /= window
+		}
+	}
+	stats.ADC, stats.DAC = buses[_busADC], buses[_busDAC]
+
+	return stats
+}
@@ -0,0 +1,107 @@
+package ioman
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatsCollector(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := newStatsCollector(_defaultSampleRate, 2)
+
+	// One second of loops on time, with every tenth read of the first flow sensor failing, and every read of the second
+	now := start
+	for i := 0; i < 1000; i++ {
+		now = start.Add(time.Duration(i) * _defaultSampleRate)
+		s.loop(now)
+		var err error
+		if i%10 == 0 {
+			err = fmt.Errorf("nack")
+		}
+		s.operation(_busFlow, now, now.Add(100*time.Microsecond), err)
+		s.operation(_busFlow+1, now, now.Add(300*time.Microsecond), fmt.Errorf("nack"))
+		s.operation(_busADC, now, now.Add(50*time.Microsecond), nil)
+		s.read(now, err == nil)
+		s.done(now, now.Add(200*time.Microsecond))
+	}
+
+	stats := s.snapshot(now)
+	if stats.Loops != 1000 || stats.OkReads != 900 || stats.FailedReads != 100 || stats.Overruns != 0 {
+		t.Fatalf("Unexpected cumulative counts: %+v", stats)
+	}
+	if stats.ReadRate < 850 || stats.ReadRate > 950 {
+		t.Fatalf("Expected read rate of around 900 Hz, got %v", stats.ReadRate)
+	}
+	if len(stats.Flows) != 2 {
+		t.Fatalf("Expected statistics for each flow sensor, got %+v", stats.Flows)
+	}
+	if stats.Flows[0].FailureRate < 90 || stats.Flows[0].FailureRate > 110 || stats.ADC.FailureRate != 0 {
+		t.Fatalf("Expected flow failure rate of around 100 Hz, got %+v", stats.Flows[0])
+	}
+	if stats.Flows[0].Failed != 100 || stats.Flows[0].Ok != 900 || stats.Flows[0].Consecutive != 0 {
+		t.Fatalf("Unexpected flow bus counts: %+v", stats.Flows[0])
+	}
+	// The healthy sensor does not hide the failing one
+	if stats.Flows[1].Failed != 1000 || stats.Flows[1].Consecutive != 1000 || stats.Flows[1].FailureRate < 900 {
+		t.Fatalf("Unexpected failing flow bus counts: %+v", stats.Flows[1])
+	}
+	if stats.Flows[0].MaxLatency != 100*time.Microsecond || stats.Flows[1].MaxLatency != 300*time.Microsecond || stats.ADC.MaxLatency != 50*time.Microsecond {
+		t.Fatalf("Unexpected max latency: flow %v %v adc %v", stats.Flows[0].MaxLatency, stats.Flows[1].MaxLatency, stats.ADC.MaxLatency)
+	}
+	if stats.Jitter != 0 {
+		t.Fatalf("Expected no jitter on an exact ticker, got %v", stats.Jitter)
+	}
+
+	// A late loop that overruns, with consecutive failures
+	late := now.Add(_defaultSampleRate + 300*time.Microsecond)
+	s.loop(late)
+	for i := 0; i < 3; i++ {
+		s.operation(_busDAC, late, late.Add(2*time.Millisecond), fmt.Errorf("nack"))
+	}
+	s.done(late, late.Add(2*time.Millisecond))
+
+	stats = s.snapshot(late)
+	if stats.Jitter != 300*time.Microsecond {
+		t.Fatalf("Expected 300us jitter, got %v", stats.Jitter)
+	}
+	if stats.Overruns != 1 {
+		t.Fatalf("Expected 1 overrun, got %v", stats.Overruns)
+	}
+	if stats.DAC.Consecutive != 3 || stats.DAC.MaxLatency != 2*time.Millisecond {
+		t.Fatalf("Unexpected DAC stats: %+v", stats.DAC)
+	}
+
+	// Windowed statistics expire, cumulative counts do not
+	stats = s.snapshot(late.Add(2 * _statsWindow))
+	if stats.ReadRate != 0 || stats.Jitter != 0 || stats.Flows[0].FailureRate != 0 || stats.DAC.MaxLatency != 0 {
+		t.Fatalf("Expected windowed statistics to expire, got %+v", stats)
+	}
+	if stats.Loops != 1001 || stats.OkReads != 900 || stats.DAC.Failed != 3 {
+		t.Fatalf("Expected cumulative counts to be kept, got %+v", stats)
+	}
+}
+
+func TestStatsIOMan(t *testing.T) {
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   &fakeDAC{},
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+
+	startIOMan(t, iom)
+	time.Sleep(200 * time.Millisecond)
+
+	// Counts accumulate across DataPackets
+	stats := iom.GetStats()
+	dp := iom.GetDataPacket()
+	if dp.Stats.OkReads < 50 || stats.OkReads < dp.Stats.OkReads || stats.Loops < stats.OkReads {
+		t.Fatalf("Expected cumulative read counts, got %+v and %+v", dp.Stats, stats)
+	}
+	if stats.ReadRate <= 0 || len(stats.Flows) != 1 || stats.Flows[0].Ok == 0 || stats.ADC.Ok == 0 {
+		t.Fatalf("Expected a read rate and bus counts, got %+v", stats)
+	}
+}
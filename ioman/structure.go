@@ -9,23 +9,77 @@ type DataPacket struct {
 	Sensors    Sensors
 	Calculated Calculated
 	State      EnumState
+	Trigger    *BreathTriggered //Set on the sample a breath was initiated, nil otherwise
+	Valve      Valve
+	Health     Health
 	Stats      Stats
 }
 
 //Sensors ..
 type Sensors struct {
-	Flow Flow
-	ADC  ADC
+	Flow           Flow   //Proximal flow, used for breath detection and control
+	Flows          []Flow //Every flow sensor, in HardwareConfig order
+	ADC            ADC
+	AirwayPressure Measurement //cmH2O
+	Oxygen         Measurement //Percent O2
+	SupplyPressure Measurement //kPa
+}
+
+//Measurement is a calibrated physical value derived from an ADC channel
+type Measurement struct {
+	Val   float64
+	Valid bool //False if no channel is mapped to the quantity, or the ADC read failed
 }
 
 //Flow ..
 type Flow struct {
-	Val       float64
+	Val       float64 //Held at the last good sample while Quality is not QualityGood
+	Raw       uint16  //Measurement word as read from the bus
 	CRC       uint8
 	Err       error
 	Timestamp time.Time
+	Quality   EnumQuality
+	Label     string
+	Role      EnumFlowRole
+}
+
+//EnumQuality is the result of validating a sensor sample
+type EnumQuality int
+
+func (e EnumQuality) String() string {
+	switch int(e) {
+	case 0:
+		return "Good"
+	case 1:
+		return "Read Error"
+	case 2:
+		return "CRC Error"
+	case 3:
+		return "Out Of Range"
+	case 4:
+		return "Implausible Rate"
+	case 5:
+		return "Stuck"
+	default:
+		return "Enum Error"
+	}
 }
 
+const (
+	//QualityGood ..
+	QualityGood EnumQuality = iota
+	//QualityReadError is a failed read of the sensor
+	QualityReadError
+	//QualityCRC is a sample that does not match its CRC
+	QualityCRC
+	//QualityRange is a sample outside of the sensor range
+	QualityRange
+	//QualityRate is a sample changing faster than physically plausible
+	QualityRate
+	//QualityStuck is a sample repeating an identical value for too long
+	QualityStuck
+)
+
 //ADC ..
 type ADC struct {
 	Vals      []uint16
@@ -36,10 +90,69 @@ type ADC struct {
 //Calculated ..
 type Calculated struct {
 	FlowIntegrated          float64
+	FlowIntegratedError     float64 //Estimated integration error in liters
 	FlowIntegratedTimestamp time.Time
+	Volume                  float64 //Liters of flow integrated since the start of the current breath, 0 before the first
+	Breath                  Breath  //Last completed breath, Number is 0 until the first breath completes
+}
+
+//Breath holds the metrics of a single completed breath
+type Breath struct {
+	Number              uint64
+	Type                EnumBreathType
+	Start               time.Time     //Start of inspiration
+	End                 time.Time     //End of expiration, the start of the next inspiration
+	InspiredVolume      float64       //Liters
+	InspiredVolumeError float64       //Estimated integration error in liters
+	ExpiredVolume       float64       //Liters
+	ExpiredVolumeError  float64       //Estimated integration error in liters
+	Leak                float64       //Liters, inspiratory less expiratory limb volume, 0 without both limb sensors
+	LeakError           float64       //Estimated integration error in liters
+	PeakInspiratoryFlow float64       //SLM
+	PeakPressure        float64       //cmH2O, 0 without airway pressure
+	PEEP                float64       //cmH2O airway pressure at end of expiration, 0 without airway pressure
+	InspiratoryTime     time.Duration //Including inspiratory pause
+	ExpiratoryTime      time.Duration //Including expiratory pause
+	IERatio             float64       //Expiratory time as a multiple of inspiratory time, 1:IERatio
+	Rate                float64       //Breaths per minute
+	MinuteVentilation   float64       //Expired liters per minute
 }
 
-//EnumState ..
+//BreathTriggered is the event of a breath being initiated, by the patient or by the machine
+type BreathTriggered struct {
+	Timestamp time.Time
+	Type      EnumBreathType
+	Source    EnumTriggerSource //Signal that detected patient effort, only meaningful for spontaneous breaths
+}
+
+//EnumBreathType is what initiated a breath
+type EnumBreathType int
+
+func (e EnumBreathType) String() string {
+	switch int(e) {
+	case 0:
+		return "Unknown"
+	case 1:
+		return "Spontaneous"
+	case 2:
+		return "Machine"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//BreathUnknown is a breath detected from flow without a preceding trigger
+	BreathUnknown EnumBreathType = iota
+	//BreathSpontaneous is a breath initiated by patient effort
+	BreathSpontaneous
+	//BreathMachine is a breath initiated by the ventilation mode without patient effort
+	BreathMachine
+)
+
+//EnumState is the breath cycle phase. Once breathing is detected the cycle is always
+//BreathingIn -> InspiratoryPause -> BreathingOut -> ExpiratoryPause -> BreathingIn,
+//where a pause may be resumed back into the phase preceding it.
 type EnumState int
 
 func (e EnumState) String() string {
@@ -50,6 +163,12 @@ func (e EnumState) String() string {
 		return "Breathing In"
 	case 2:
 		return "Rest"
+	case 3:
+		return "Breathing Out"
+	case 4:
+		return "Inspiratory Pause"
+	case 5:
+		return "Expiratory Pause"
 	default:
 		return "Enum Error"
 	}
@@ -60,12 +179,115 @@ const (
 	StateError EnumState = iota
 	//StateBreathingIn ..
 	StateBreathingIn
-	//StateRest ..
+	//StateRest is the initial state, before any breath has been detected
 	StateRest
+	//StateBreathingOut ..
+	StateBreathingOut
+	//StateInspiratoryPause is the low flow period between breathing in and breathing out
+	StateInspiratoryPause
+	//StateExpiratoryPause is the low flow period between breathing out and the next breath
+	StateExpiratoryPause
 )
 
-//Stats ..
+//Valve is the output of the valve control loop
+type Valve struct {
+	Command  uint16    //DAC value
+	Phase    EnumPhase //Machine breath phase
+	Setpoint float64   //Pressure in cmH2O or flow in SLM being controlled to, 0 with the valve held closed
+	Err      error     //Fault that put the valve in the closed safe state
+}
+
+//EnumPhase is the machine breath phase
+type EnumPhase int
+
+func (e EnumPhase) String() string {
+	switch int(e) {
+	case 0:
+		return "Expiration"
+	case 1:
+		return "Inspiration"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//PhaseExpiration ..
+	PhaseExpiration EnumPhase = iota
+	//PhaseInspiration ..
+	PhaseInspiration
+)
+
+//Health is the state of each device
+type Health struct {
+	Flow  DeviceHealth   //Proximal flow sensor
+	Flows []DeviceHealth //Every flow sensor, in HardwareConfig order
+	ADC   DeviceHealth
+	DAC   DeviceHealth
+}
+
+//Degraded returns true if any device is not healthy
+func (h Health) Degraded() bool {
+	for _, f := range h.Flows {
+		if f.State != HealthOK {
+			return true
+		}
+	}
+	return h.Flow.State != HealthOK || h.ADC.State != HealthOK || h.DAC.State != HealthOK
+}
+
+//DeviceHealth ..
+type DeviceHealth struct {
+	Label    string
+	State    EnumHealth
+	Failures uint64 //Consecutive failed operations
+	Attempts uint64 //Recovery attempts made since the device became degraded
+	Err      error  //Last error, nil while healthy
+}
+
+//EnumHealth is the state of a device
+type EnumHealth int
+
+func (e EnumHealth) String() string {
+	switch int(e) {
+	case 0:
+		return "OK"
+	case 1:
+		return "Degraded"
+	case 2:
+		return "Failed"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//HealthOK ..
+	HealthOK EnumHealth = iota
+	//HealthDegraded is a device that has failed repeatedly and is being recovered
+	HealthDegraded
+	//HealthFailed is a device that recovery has not restored, recovery continues at a reduced rate
+	HealthFailed
+)
+
+//Stats are cumulative since Start, or over a sliding window of _statsWindow
 type Stats struct {
-	OkReads     uint64
-	FailedReads uint64
+	OkReads     uint64        //Cumulative loops with flow and ADC read ok
+	FailedReads uint64        //Cumulative loops with a failed flow or ADC read
+	Loops       uint64        //Cumulative
+	Overruns    uint64        //Cumulative loops that took longer than the sample period
+	ReadRate    float64       //Hz of loops with flow and ADC read ok, over the window
+	Jitter      time.Duration //Largest deviation of the loop period from the sample period, over the window
+	Flows       []BusStats    //Each flow sensor, in HardwareConfig order
+	ADC         BusStats
+	DAC         BusStats
+}
+
+//BusStats are the statistics of one device
+type BusStats struct {
+	Ok          uint64        //Cumulative successful operations
+	Failed      uint64        //Cumulative failed operations
+	Consecutive uint64        //Consecutive failed operations
+	FailureRate float64       //Hz of failed operations, over the window
+	MaxLatency  time.Duration //Longest operation, over the window
 }
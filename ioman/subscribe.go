@@ -0,0 +1,231 @@
+package ioman
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+//EnumStream selects the DataPackets delivered to a Subscription
+type EnumStream int
+
+func (e EnumStream) String() string {
+	switch int(e) {
+	case 0:
+		return "All"
+	case 1:
+		return "Events"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//StreamAll delivers every DataPacket, reduced by Decimation
+	StreamAll EnumStream = iota
+	//StreamEvents delivers only DataPackets at which a breath was triggered or completed, or the breath state, machine phase, validity or health changed
+	StreamEvents
+)
+
+//EnumOverflow is the policy applied when a Subscription channel is full
+type EnumOverflow int
+
+func (e EnumOverflow) String() string {
+	switch int(e) {
+	case 0:
+		return "Drop Newest"
+	case 1:
+		return "Drop Oldest"
+	case 2:
+		return "Disconnect"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//OverflowDropNewest discards the DataPacket being published, keeping those already queued
+	OverflowDropNewest EnumOverflow = iota
+	//OverflowDropOldest discards the oldest queued DataPacket to make room, keeping the subscriber current
+	OverflowDropOldest
+	//OverflowDisconnect closes the channel and ends the Subscription
+	OverflowDisconnect
+)
+
+//SubscribeConfig ..
+type SubscribeConfig struct {
+	Stream     EnumStream
+	Decimation int //Deliver every Nth DataPacket of StreamAll, 1 for the full stream
+	Buffer     int //Channel capacity
+	Overflow   EnumOverflow
+}
+
+//DefaultSubscribeConfig is the full stream, keeping the subscriber current if it falls behind
+func DefaultSubscribeConfig() SubscribeConfig {
+	return SubscribeConfig{
+		Stream:     StreamAll,
+		Decimation: 1,
+		Buffer:     64,
+		Overflow:   OverflowDropOldest,
+	}
+}
+
+func (s SubscribeConfig) validate() error {
+	if s.Stream != StreamAll && s.Stream != StreamEvents {
+		return fmt.Errorf("Unknown stream %v", s.Stream)
+	}
+	if s.Decimation < 1 {
+		return fmt.Errorf("Decimation must be at least 1, got %v", s.Decimation)
+	}
+	if s.Buffer < 1 {
+		return fmt.Errorf("Buffer must be at least 1, got %v", s.Buffer)
+	}
+	if s.Overflow != OverflowDropNewest && s.Overflow != OverflowDropOldest && s.Overflow != OverflowDisconnect {
+		return fmt.Errorf("Unknown overflow policy %v", s.Overflow)
+	}
+	return nil
+}
+
+//Subscription delivers DataPackets published by the io loop on C, which is closed once the Subscription ends
+type Subscription struct {
+	C       <-chan DataPacket
+	ch      chan DataPacket
+	config  SubscribeConfig
+	count   uint64 //DataPackets offered, for decimation
+	mdrop   sync.Mutex
+	dropped uint64
+}
+
+//Dropped returns the number of DataPackets discarded because the subscriber had fallen behind
+func (s *Subscription) Dropped() uint64 {
+	s.mdrop.Lock()
+	defer s.mdrop.Unlock()
+	return s.dropped
+}
+
+//publisher fans DataPackets out to subscriptions without ever blocking the io loop
+type publisher struct {
+	msubs  sync.Mutex
+	subs   map[*Subscription]struct{}
+	last   DataPacket //previous DataPacket, for event detection
+	closed bool       //No further subscriptions are accepted
+}
+
+func newPublisher() *publisher {
+	return &publisher{
+		subs: map[*Subscription]struct{}{},
+	}
+}
+
+func (p *publisher) subscribe(config SubscribeConfig) (*Subscription, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to validate subscription: %w", err)
+	}
+
+	ch := make(chan DataPacket, config.Buffer)
+	s := &Subscription{
+		C:      ch,
+		ch:     ch,
+		config: config,
+	}
+
+	p.msubs.Lock()
+	defer p.msubs.Unlock()
+	if p.closed {
+		return nil, fmt.Errorf("Failed to subscribe: IOMan has been destroyed")
+	}
+	p.subs[s] = struct{}{}
+	return s, nil
+}
+
+func (p *publisher) unsubscribe(s *Subscription) {
+	p.msubs.Lock()
+	defer p.msubs.Unlock()
+	p.remove(s)
+}
+
+// close ends every subscription, and rejects any further
+func (p *publisher) close() {
+	p.msubs.Lock()
+	defer p.msubs.Unlock()
+	for s := range p.subs {
+		p.remove(s)
+	}
+	p.closed = true
+}
+
+// remove ends a subscription, must be called with msubs held
+func (p *publisher) remove(s *Subscription) {
+	if _, ok := p.subs[s]; !ok {
+		return
+	}
+	delete(p.subs, s)
+	close(s.ch)
+}
+
+// publish offers d to every subscription, applying its overflow policy rather than waiting on a full channel
+func (p *publisher) publish(d DataPacket) {
+	p.msubs.Lock()
+	defer p.msubs.Unlock()
+
+	event := isEvent(p.last, d)
+	p.last = d
+
+	for s := range p.subs {
+		if s.config.Stream == StreamEvents && !event {
+			continue
+		}
+		if s.config.Stream == StreamAll {
+			s.count++
+			if (s.count-1)%uint64(s.config.Decimation) != 0 {
+				continue
+			}
+		}
+
+		select {
+		case s.ch <- d:
+			continue
+		default:
+		}
+
+		s.mdrop.Lock()
+		s.dropped++
+		s.mdrop.Unlock()
+
+		switch s.config.Overflow {
+		case OverflowDropOldest:
+			// Only the io loop sends, so once one is taken there is room
+			select {
+			case <-s.ch:
+			default:
+			}
+			s.ch <- d
+		case OverflowDisconnect:
+			logman.Warnf("ioman:subscribe", "Disconnecting subscriber that has fallen %v DataPackets behind", s.config.Buffer)
+			p.remove(s)
+		}
+	}
+}
+
+// isEvent returns true if d is the first DataPacket of a triggered or completed breath, or of a change in breath state, machine phase, validity or health
+func isEvent(last DataPacket, d DataPacket) bool {
+	if len(d.Health.Flows) != len(last.Health.Flows) {
+		return true
+	}
+	for i := range d.Health.Flows {
+		if d.Health.Flows[i].State != last.Health.Flows[i].State {
+			return true
+		}
+	}
+
+	return d.Trigger != nil ||
+		d.Calculated.Breath.Number != last.Calculated.Breath.Number ||
+		d.State != last.State ||
+		d.Valid != last.Valid ||
+		d.Valve.Phase != last.Valve.Phase ||
+		d.Health.Flow.State != last.Health.Flow.State ||
+		d.Health.ADC.State != last.Health.ADC.State ||
+		d.Health.DAC.State != last.Health.DAC.State
+}
@@ -0,0 +1,167 @@
+package ioman
+
+import (
+	"testing"
+	"time"
+)
+
+// drain returns the DataPackets queued on a subscription
+func drain(s *Subscription) []DataPacket {
+	dps := []DataPacket{}
+	for {
+		select {
+		case dp, ok := <-s.C:
+			if !ok {
+				return dps
+			}
+			dps = append(dps, dp)
+		default:
+			return dps
+		}
+	}
+}
+
+// numbered returns a valid DataPacket identified by its Stats.Loops
+func numbered(n uint64) DataPacket {
+	return DataPacket{Valid: true, Stats: Stats{Loops: n}}
+}
+
+func TestSubscribeDecimation(t *testing.T) {
+	p := newPublisher()
+	all, _ := p.subscribe(SubscribeConfig{Stream: StreamAll, Decimation: 1, Buffer: 100, Overflow: OverflowDropNewest})
+	decimated, _ := p.subscribe(SubscribeConfig{Stream: StreamAll, Decimation: 10, Buffer: 100, Overflow: OverflowDropNewest})
+
+	for i := uint64(0); i < 100; i++ {
+		p.publish(numbered(i))
+	}
+
+	if dps := drain(all); len(dps) != 100 {
+		t.Fatalf("Expected the full stream of 100 DataPackets, got %v", len(dps))
+	}
+	dps := drain(decimated)
+	if len(dps) != 10 {
+		t.Fatalf("Expected every 10th of 100 DataPackets, got %v", len(dps))
+	}
+	for i, dp := range dps {
+		if dp.Stats.Loops != uint64(i*10) {
+			t.Fatalf("Expected DataPacket %v at %v, got %v", i*10, i, dp.Stats.Loops)
+		}
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	p := newPublisher()
+	s, _ := p.subscribe(SubscribeConfig{Stream: StreamEvents, Decimation: 1, Buffer: 100, Overflow: OverflowDropNewest})
+
+	p.publish(numbered(0)) // Becoming valid
+	p.publish(numbered(1))
+
+	triggered := numbered(2)
+	triggered.Trigger = &BreathTriggered{Type: BreathSpontaneous}
+	p.publish(triggered)
+
+	completed := numbered(3)
+	completed.Calculated.Breath.Number = 1
+	p.publish(completed)
+	p.publish(completed)
+
+	degraded := completed
+	degraded.Stats.Loops = 4
+	degraded.Health.Flow.State = HealthDegraded
+	p.publish(degraded)
+
+	dps := drain(s)
+	expected := []uint64{0, 2, 3, 4}
+	if len(dps) != len(expected) {
+		t.Fatalf("Expected %v events, got %v", len(expected), len(dps))
+	}
+	for i, dp := range dps {
+		if dp.Stats.Loops != expected[i] {
+			t.Fatalf("Expected event %v at %v, got %v", expected[i], i, dp.Stats.Loops)
+		}
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	p := newPublisher()
+	newest, _ := p.subscribe(SubscribeConfig{Stream: StreamAll, Decimation: 1, Buffer: 4, Overflow: OverflowDropNewest})
+	oldest, _ := p.subscribe(SubscribeConfig{Stream: StreamAll, Decimation: 1, Buffer: 4, Overflow: OverflowDropOldest})
+	disconnect, _ := p.subscribe(SubscribeConfig{Stream: StreamAll, Decimation: 1, Buffer: 4, Overflow: OverflowDisconnect})
+
+	// Nobody is reading, publishing must not block
+	done := make(chan struct{})
+	go func() {
+		for i := uint64(0); i < 10; i++ {
+			p.publish(numbered(i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected publishing to full subscriptions not to block")
+	}
+
+	if dps := drain(newest); len(dps) != 4 || dps[3].Stats.Loops != 3 || newest.Dropped() != 6 {
+		t.Fatalf("Expected the first 4 DataPackets to be kept, got %v with %v dropped", dps, newest.Dropped())
+	}
+	if dps := drain(oldest); len(dps) != 4 || dps[0].Stats.Loops != 6 || dps[3].Stats.Loops != 9 || oldest.Dropped() != 6 {
+		t.Fatalf("Expected the last 4 DataPackets to be kept, got %v with %v dropped", dps, oldest.Dropped())
+	}
+
+	// The disconnected subscriber receives what was queued, then the channel is closed
+	if dps := drain(disconnect); len(dps) != 4 {
+		t.Fatalf("Expected 4 DataPackets before disconnecting, got %v", len(dps))
+	}
+	if _, ok := <-disconnect.C; ok {
+		t.Fatalf("Expected a subscriber that overflowed to be disconnected")
+	}
+	p.unsubscribe(disconnect) // No effect once disconnected
+
+	p.unsubscribe(newest)
+	if _, ok := <-newest.C; ok {
+		t.Fatalf("Expected channel to be closed on unsubscribe")
+	}
+}
+
+func TestSubscribeValidate(t *testing.T) {
+	p := newPublisher()
+	for _, config := range []SubscribeConfig{
+		{Stream: StreamAll, Decimation: 0, Buffer: 1},
+		{Stream: StreamAll, Decimation: 1, Buffer: 0},
+		{Stream: EnumStream(5), Decimation: 1, Buffer: 1},
+		{Stream: StreamAll, Decimation: 1, Buffer: 1, Overflow: EnumOverflow(5)},
+	} {
+		if _, err := p.subscribe(config); err == nil {
+			t.Fatalf("Expected %+v to be rejected", config)
+		}
+	}
+}
+
+func TestSubscribeIOMan(t *testing.T) {
+	iom, err := NewIOManWithDevices(Devices{
+		Flows: []FlowSensor{&fakeFlow{val: 10}},
+		ADC:   &fakeADC{},
+		DAC:   &fakeDAC{},
+	}, DefaultHardwareConfig())
+	if err != nil {
+		t.Fatalf("Failed to create IOMan: %v", err)
+	}
+	s, err := iom.Subscribe(DefaultSubscribeConfig())
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	startIOMan(t, iom)
+
+	// Every sample is delivered in order
+	last := uint64(0)
+	for i := 0; i < 100; i++ {
+		dp := <-s.C
+		if dp.Stats.Loops != last+1 {
+			t.Fatalf("Expected consecutive DataPackets, got %v after %v", dp.Stats.Loops, last)
+		}
+		last = dp.Stats.Loops
+	}
+	iom.Unsubscribe(s)
+}
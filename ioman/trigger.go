@@ -0,0 +1,153 @@
+package ioman
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kaelanfouwels/gogles/logman"
+)
+
+const _triggerBaselineTau = 200 * time.Millisecond //time constant of the airway pressure baseline for pressure triggering
+
+//EnumTriggerSource is the signal used to detect patient inspiratory effort
+type EnumTriggerSource int
+
+func (e EnumTriggerSource) String() string {
+	switch int(e) {
+	case 0:
+		return "Flow"
+	case 1:
+		return "Pressure"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//TriggerFlow detects effort as inspiratory flow
+	TriggerFlow EnumTriggerSource = iota
+	//TriggerPressure detects effort as airway pressure falling below its baseline
+	TriggerPressure
+)
+
+//ParseTriggerSource parses a trigger source by name, case insensitive
+func ParseTriggerSource(name string) (EnumTriggerSource, error) {
+	for _, s := range []EnumTriggerSource{TriggerFlow, TriggerPressure} {
+		if strings.EqualFold(name, s.String()) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown trigger source %v, expected flow or pressure", name)
+}
+
+//TriggerConfig configures detection of patient effort
+type TriggerConfig struct {
+	Source      EnumTriggerSource
+	Sensitivity float64       //SLM of inspiratory flow for a flow trigger, cmH2O below baseline for a pressure trigger
+	Refractory  time.Duration //Minimum time after the last trigger or the start of machine expiration before a breath can be triggered
+}
+
+//DefaultTriggerConfig ..
+func DefaultTriggerConfig() TriggerConfig {
+	return TriggerConfig{
+		Source:      TriggerFlow,
+		Sensitivity: 2,
+		Refractory:  500 * time.Millisecond,
+	}
+}
+
+//Validate ..
+func (t TriggerConfig) Validate() error {
+	if t.Source != TriggerFlow && t.Source != TriggerPressure {
+		return fmt.Errorf("Unknown trigger source %v", t.Source)
+	}
+	if t.Sensitivity <= 0 {
+		return fmt.Errorf("Trigger sensitivity must be positive, got %v", t.Sensitivity)
+	}
+	if t.Refractory < 0 {
+		return fmt.Errorf("Trigger refractory period must not be negative, got %v", t.Refractory)
+	}
+	return nil
+}
+
+type triggerStore struct {
+	config        TriggerConfig
+	armed         bool      //effort has been absent since the last trigger
+	baseline      float64   //airway pressure baseline in cmH2O
+	baselineValid bool      //baseline has been initialised
+	refractory    time.Time //start of the refractory period
+	phase         EnumPhase //machine phase of the previous sample
+	last          BreathTriggered
+	pending       EnumBreathType //type of the last event, until claimed by a new breath
+}
+
+// triggers detects the start of spontaneous and machine breaths. Phase is the machine phase of the previous valve output.
+// A spontaneous breath is patient effort detected while the machine is in expiration, a machine breath is a machine
+// inspiration not started in response to a spontaneous trigger.
+func (c *controller) triggers(sensors Sensors, phase EnumPhase) *BreathTriggered {
+	t := &c.trigger
+	now := sensors.Flow.Timestamp
+	var event *BreathTriggered
+
+	if phase == PhaseInspiration {
+		assisted := t.last.Type == BreathSpontaneous && now.Sub(t.last.Timestamp) < t.config.Refractory
+		if t.phase != PhaseInspiration && !assisted {
+			event = &BreathTriggered{Timestamp: now, Type: BreathMachine}
+		}
+		t.armed = false
+	} else {
+		if t.phase == PhaseInspiration {
+			t.refractory = now
+		}
+
+		effort := c.effort(sensors)
+		if effort && t.armed && now.Sub(t.refractory) >= t.config.Refractory {
+			event = &BreathTriggered{Timestamp: now, Type: BreathSpontaneous, Source: t.config.Source}
+			t.refractory = now
+		}
+		t.armed = !effort
+	}
+	t.phase = phase
+
+	if event != nil {
+		t.last = *event
+		t.pending = event.Type
+		logman.Debugf("ioman:controller", "%v breath triggered at %v", event.Type, event.Timestamp)
+	}
+	return event
+}
+
+// effort returns true if the trigger signal shows patient inspiratory effort
+func (c *controller) effort(sensors Sensors) bool {
+	t := &c.trigger
+
+	switch t.config.Source {
+	case TriggerFlow:
+		return c.buffer.flowFiltered > t.config.Sensitivity
+	case TriggerPressure:
+		if !sensors.AirwayPressure.Valid {
+			return false
+		}
+		p := sensors.AirwayPressure.Val
+		if !t.baselineValid {
+			t.baseline = p
+			t.baselineValid = true
+		}
+		if p < t.baseline-t.config.Sensitivity {
+			return true
+		}
+		// Only track the baseline without effort, so that a slow effort cannot drag it down
+		alpha := c.sampledRate.Seconds() / (_triggerBaselineTau.Seconds() + c.sampledRate.Seconds())
+		t.baseline += alpha * (p - t.baseline)
+		return false
+	}
+	return false
+}
+
+// claimTrigger returns the type of the last trigger event not yet claimed by a breath
+func (c *controller) claimTrigger() EnumBreathType {
+	kind := c.trigger.pending
+	c.trigger.pending = BreathUnknown
+	return kind
+}
@@ -0,0 +1,159 @@
+package ioman
+
+import (
+	"testing"
+	"time"
+)
+
+// runTriggers feeds flows through a controller with the given machine phase, returning trigger events and completed breaths
+func runTriggers(c *controller, flows []Flow, phase func(i int, events []BreathTriggered) EnumPhase) ([]BreathTriggered, []Breath) {
+	events := []BreathTriggered{}
+	breaths := []Breath{}
+
+	for i, f := range flows {
+		sensors := Sensors{Flow: f}
+		c.buffers(sensors)
+		e := c.triggers(sensors, phase(i, events))
+		if e != nil {
+			events = append(events, *e)
+		}
+		c.states(sensors)
+		calc := c.calculate(sensors)
+		if calc.Breath.Number != 0 && (len(breaths) == 0 || breaths[len(breaths)-1].Number != calc.Breath.Number) {
+			breaths = append(breaths, calc.Breath)
+		}
+	}
+	return events, breaths
+}
+
+func TestTriggerSpontaneous(t *testing.T) {
+	period := 2 * time.Second
+	flows := syntheticBreaths(4, period, 30, 0.5)
+
+	events, breaths := runTriggers(newController(_testSampleRate, SystemClock()), flows, func(i int, events []BreathTriggered) EnumPhase {
+		return PhaseExpiration
+	})
+
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 trigger events, got %v: %+v", len(events), events)
+	}
+	for i, e := range events {
+		if e.Type != BreathSpontaneous || e.Source != TriggerFlow {
+			t.Fatalf("Expected spontaneous flow triggered breath, got %+v", e)
+		}
+		offset := e.Timestamp.Sub(flows[0].Timestamp) - time.Duration(i)*period
+		if offset < 0 || offset > 100*time.Millisecond {
+			t.Fatalf("Expected trigger within 100ms of effort, got %v", offset)
+		}
+	}
+	for _, b := range breaths {
+		if b.Type != BreathSpontaneous {
+			t.Fatalf("Expected spontaneous breath, got %v", b.Type)
+		}
+	}
+}
+
+func TestTriggerMachine(t *testing.T) {
+	period := 2 * time.Second
+	flows := syntheticBreaths(4, period, 30, 0.5)
+	samples := int(period / _testSampleRate)
+
+	events, breaths := runTriggers(newController(_testSampleRate, SystemClock()), flows, func(i int, events []BreathTriggered) EnumPhase {
+		if i < 4*samples && i%samples < samples/2 {
+			return PhaseInspiration
+		}
+		return PhaseExpiration
+	})
+
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 trigger events, got %v: %+v", len(events), events)
+	}
+	for _, e := range events {
+		if e.Type != BreathMachine {
+			t.Fatalf("Expected machine breath, got %+v", e)
+		}
+	}
+	for _, b := range breaths {
+		if b.Type != BreathMachine {
+			t.Fatalf("Expected machine breath, got %v", b.Type)
+		}
+	}
+}
+
+func TestTriggerAssisted(t *testing.T) {
+	period := 2 * time.Second
+	flows := syntheticBreaths(4, period, 30, 0.5)
+
+	// The machine responds to each spontaneous trigger with an inspiration, which is not a machine breath
+	var inspiration time.Time
+	events, _ := runTriggers(newController(_testSampleRate, SystemClock()), flows, func(i int, events []BreathTriggered) EnumPhase {
+		if len(events) > 0 {
+			inspiration = events[len(events)-1].Timestamp
+		}
+		if !inspiration.IsZero() && flows[i].Timestamp.Sub(inspiration) < period/2 {
+			return PhaseInspiration
+		}
+		return PhaseExpiration
+	})
+
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 trigger events, got %v: %+v", len(events), events)
+	}
+	for _, e := range events {
+		if e.Type != BreathSpontaneous {
+			t.Fatalf("Expected spontaneous breath, got %+v", e)
+		}
+	}
+}
+
+func TestTriggerPressure(t *testing.T) {
+	c := newController(_testSampleRate, SystemClock())
+	c.trigger.config = TriggerConfig{Source: TriggerPressure, Sensitivity: 1, Refractory: 500 * time.Millisecond}
+	start := time.Now()
+
+	// Pressure drops of 2 cmH2O from a baseline of 5, the second within the refractory period of the first
+	dips := []time.Duration{time.Second, 1200 * time.Millisecond, 3 * time.Second}
+	events := []BreathTriggered{}
+	for ts := time.Duration(0); ts < 4*time.Second; ts += _testSampleRate {
+		pressure := 5.0
+		for _, d := range dips {
+			if ts >= d && ts < d+50*time.Millisecond {
+				pressure = 3
+			}
+		}
+		// Slow drift of the baseline must not trigger
+		pressure += ts.Seconds() * 0.5
+
+		sensors := Sensors{
+			Flow:           Flow{Timestamp: start.Add(ts)},
+			AirwayPressure: Measurement{Val: pressure, Valid: true},
+		}
+		c.buffers(sensors)
+		e := c.triggers(sensors, PhaseExpiration)
+		if e != nil {
+			events = append(events, *e)
+		}
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 trigger events, got %v: %+v", len(events), events)
+	}
+	for i, d := range []time.Duration{dips[0], dips[2]} {
+		if events[i].Timestamp != start.Add(d) || events[i].Source != TriggerPressure {
+			t.Fatalf("Expected pressure trigger at %v, got %+v", d, events[i])
+		}
+	}
+}
+
+func TestParseTriggerSource(t *testing.T) {
+	for name, expected := range map[string]EnumTriggerSource{"flow": TriggerFlow, "Pressure": TriggerPressure} {
+		s, err := ParseTriggerSource(name)
+		if err != nil || s != expected {
+			t.Fatalf("Expected %v for %v, got %v %v", expected, name, s, err)
+		}
+	}
+	_, err := ParseTriggerSource("volume")
+	if err == nil {
+		t.Fatalf("Expected error for unknown trigger source")
+	}
+}
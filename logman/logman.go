@@ -0,0 +1,375 @@
+package logman
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _timeFormat = "2006/01/02 15:04:05.000000"
+
+//EnumLevel is the severity of a log entry
+type EnumLevel int
+
+func (e EnumLevel) String() string {
+	switch int(e) {
+	case 0:
+		return "Debug"
+	case 1:
+		return "Info"
+	case 2:
+		return "Warn"
+	case 3:
+		return "Error"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//LevelDebug is detail for development, such as every state change of breath detection
+	LevelDebug EnumLevel = iota
+	//LevelInfo is the normal operation of the ventilator, such as start up and mode changes
+	LevelInfo
+	//LevelWarn is a degraded condition that is handled, such as a sensor being recovered
+	LevelWarn
+	//LevelError is a failure, such as a device that can not be recovered
+	LevelError
+)
+
+//ParseLevel parses the name of an EnumLevel, case insensitive
+func ParseLevel(name string) (EnumLevel, error) {
+	for _, l := range []EnumLevel{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %v, expected debug, info, warn or error", name)
+}
+
+//EnumFormat is how entries are written to stderr and files
+type EnumFormat int
+
+func (e EnumFormat) String() string {
+	switch int(e) {
+	case 0:
+		return "Text"
+	case 1:
+		return "JSON"
+	default:
+		return "Enum Error"
+	}
+}
+
+const (
+	//FormatText is a line of time, level, [owner] and message
+	FormatText EnumFormat = iota
+	//FormatJSON is a JSON object per line
+	FormatJSON
+)
+
+//ParseFormat parses the name of an EnumFormat, case insensitive
+func ParseFormat(name string) (EnumFormat, error) {
+	for _, f := range []EnumFormat{FormatText, FormatJSON} {
+		if strings.EqualFold(name, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log format %v, expected text or json", name)
+}
+
+//Entry is a single logged message
+type Entry struct {
+	Time       time.Time
+	Level      EnumLevel
+	Owner      string //Subsystem that logged the message, such as ioman:recovery
+	Message    string
+	Suppressed int //Messages of the same rate limited call site dropped since the last logged
+}
+
+//Format renders the entry as a single line, without a trailing newline
+func (e Entry) Format(format EnumFormat) string {
+	if format == FormatJSON {
+		b, err := json.Marshal(struct {
+			Time       string `json:"time"`
+			Level      string `json:"level"`
+			Owner      string `json:"owner"`
+			Message    string `json:"message"`
+			Suppressed int    `json:"suppressed,omitempty"`
+		}{e.Time.Format(time.RFC3339Nano), strings.ToLower(e.Level.String()), e.Owner, e.Message, e.Suppressed})
+		if err != nil {
+			return fmt.Sprintf("{\"message\":%q}", err.Error())
+		}
+		return string(b)
+	}
+
+	line := fmt.Sprintf("%v %-5v [%v] %v", e.Time.Format(_timeFormat), strings.ToUpper(e.Level.String()), e.Owner, e.Message)
+	if e.Suppressed > 0 {
+		line += fmt.Sprintf(" (%v suppressed)", e.Suppressed)
+	}
+	return line
+}
+
+//Config ..
+type Config struct {
+	Level      EnumLevel            //Lowest level logged by subsystems without a level of their own
+	Subsystems map[string]EnumLevel //Levels by subsystem, matching an owner or its : separated prefix, such as ioman for ioman:recovery
+	Format     EnumFormat
+	RateLimit  time.Duration //Minimum interval between entries of a rate limited call site
+	Stderr     bool
+	File       FileConfig //Rotating log files, disabled while Directory is empty
+	Ring       int        //Entries kept in memory for display on screen, 0 to disable
+}
+
+//DefaultConfig logs info and above as text to stderr
+func DefaultConfig() Config {
+	return Config{
+		Level:     LevelInfo,
+		Format:    FormatText,
+		RateLimit: time.Second,
+		Stderr:    true,
+		File: FileConfig{
+			MaxFileSize: 16 * 1024 * 1024,
+			MaxFiles:    8,
+		},
+		Ring: 100,
+	}
+}
+
+//Validate ..
+func (c Config) Validate() error {
+	for _, l := range c.Subsystems {
+		if l < LevelDebug || l > LevelError {
+			return fmt.Errorf("Unknown log level %v", int(l))
+		}
+	}
+	if c.Level < LevelDebug || c.Level > LevelError {
+		return fmt.Errorf("Unknown log level %v", int(c.Level))
+	}
+	if c.Format != FormatText && c.Format != FormatJSON {
+		return fmt.Errorf("Unknown log format %v", int(c.Format))
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("Rate limit must not be negative, got %v", c.RateLimit)
+	}
+	if c.File.Directory != "" && (c.File.MaxFileSize <= 0 || c.File.MaxFiles < 0) {
+		return fmt.Errorf("Log file max size must be positive and max files not negative, got %v and %v", c.File.MaxFileSize, c.File.MaxFiles)
+	}
+	if c.Ring < 0 {
+		return fmt.Errorf("Ring size must not be negative, got %v", c.Ring)
+	}
+	return nil
+}
+
+// limit is the state of a rate limited call site
+type limit struct {
+	last       time.Time
+	suppressed int
+}
+
+//Logger filters entries by level and rate, and writes them to its sinks
+type Logger struct {
+	mlogger sync.Mutex
+	config  Config
+	sinks   []Sink
+	ring    *RingSink
+	limits  map[string]*limit //By owner and format
+	now     func() time.Time
+}
+
+//NewLogger creates a Logger with the sinks of config
+func NewLogger(config Config) (*Logger, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid log config: %w", err)
+	}
+
+	l := Logger{
+		config: config,
+		limits: map[string]*limit{},
+		now:    time.Now,
+	}
+	if config.Stderr {
+		l.sinks = append(l.sinks, NewWriterSink(os.Stderr, config.Format))
+	}
+	if config.File.Directory != "" {
+		file, err := NewFileSink(config.File, config.Format)
+		if err != nil {
+			return nil, err
+		}
+		l.sinks = append(l.sinks, file)
+	}
+	if config.Ring > 0 {
+		l.ring = NewRingSink(config.Ring)
+		l.sinks = append(l.sinks, l.ring)
+	}
+	return &l, nil
+}
+
+//Enabled returns true if entries of level are logged for owner, to skip building messages that would be discarded
+func (l *Logger) Enabled(level EnumLevel, owner string) bool {
+	l.mlogger.Lock()
+	defer l.mlogger.Unlock()
+	return level >= l.level(owner)
+}
+
+//Logf logs a message
+func (l *Logger) Logf(level EnumLevel, owner string, format string, v ...interface{}) {
+	l.log(level, owner, format, false, v...)
+}
+
+//Limitf logs a message at most once per RateLimit for each owner and format, for hot paths such as the io loop.
+//The number of messages dropped is reported on the next logged.
+func (l *Logger) Limitf(level EnumLevel, owner string, format string, v ...interface{}) {
+	l.log(level, owner, format, true, v...)
+}
+
+func (l *Logger) log(level EnumLevel, owner string, format string, limited bool, v ...interface{}) {
+	l.mlogger.Lock()
+	defer l.mlogger.Unlock()
+
+	if level < l.level(owner) {
+		return
+	}
+
+	now := l.now()
+	entry := Entry{
+		Time:  now,
+		Level: level,
+		Owner: owner,
+	}
+
+	if limited {
+		key := owner + "\x00" + format
+		lim, ok := l.limits[key]
+		if !ok {
+			lim = &limit{}
+			l.limits[key] = lim
+		} else if now.Sub(lim.last) < l.config.RateLimit {
+			lim.suppressed++
+			return
+		}
+		entry.Suppressed = lim.suppressed
+		lim.last = now
+		lim.suppressed = 0
+	}
+
+	entry.Message = fmt.Sprintf(format, v...)
+	for _, s := range l.sinks {
+		err := s.Write(entry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write log entry: %v\n", err) //There is nowhere else to report it
+		}
+	}
+}
+
+// level returns the level of the subsystem of owner, the most specific of its : separated prefixes first
+func (l *Logger) level(owner string) EnumLevel {
+	name := owner
+	for {
+		if level, ok := l.config.Subsystems[name]; ok {
+			return level
+		}
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			return l.config.Level
+		}
+		name = name[:i]
+	}
+}
+
+//Ring returns the ring buffer of recent entries, nil if disabled
+func (l *Logger) Ring() *RingSink {
+	return l.ring
+}
+
+//Close closes every sink
+func (l *Logger) Close() error {
+	l.mlogger.Lock()
+	defer l.mlogger.Unlock()
+
+	var first error
+	for _, s := range l.sinks {
+		err := s.Close()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	l.sinks = nil
+	return first
+}
+
+var _mdefault sync.Mutex
+var _default = mustDefault()
+
+func mustDefault() *Logger {
+	l, err := NewLogger(DefaultConfig())
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func logger() *Logger {
+	_mdefault.Lock()
+	defer _mdefault.Unlock()
+	return _default
+}
+
+//Configure replaces the shared logger used by every manager, closing the sinks of the last
+func Configure(config Config) error {
+	l, err := NewLogger(config)
+	if err != nil {
+		return err
+	}
+
+	_mdefault.Lock()
+	last := _default
+	_default = l
+	_mdefault.Unlock()
+
+	return last.Close()
+}
+
+//Ring returns the ring buffer of recent entries of the shared logger, nil if disabled
+func Ring() *RingSink {
+	return logger().Ring()
+}
+
+//Close closes the sinks of the shared logger, flushing log files
+func Close() error {
+	return logger().Close()
+}
+
+//Enabled returns true if entries of level are logged for owner by the shared logger
+func Enabled(level EnumLevel, owner string) bool {
+	return logger().Enabled(level, owner)
+}
+
+//Debugf ..
+func Debugf(owner string, format string, v ...interface{}) {
+	logger().Logf(LevelDebug, owner, format, v...)
+}
+
+//Infof ..
+func Infof(owner string, format string, v ...interface{}) {
+	logger().Logf(LevelInfo, owner, format, v...)
+}
+
+//Warnf ..
+func Warnf(owner string, format string, v ...interface{}) {
+	logger().Logf(LevelWarn, owner, format, v...)
+}
+
+//Errorf ..
+func Errorf(owner string, format string, v ...interface{}) {
+	logger().Logf(LevelError, owner, format, v...)
+}
+
+//Limitf logs a rate limited message on the shared logger, see Logger.Limitf
+func Limitf(level EnumLevel, owner string, format string, v ...interface{}) {
+	logger().Limitf(level, owner, format, v...)
+}
@@ -0,0 +1,168 @@
+package logman
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger returns a Logger writing to a buffer and a ring, on a clock moved by the caller
+func testLogger(t *testing.T, config Config) (*Logger, *bytes.Buffer, *time.Time) {
+	t.Helper()
+
+	config.Stderr = false
+	l, err := NewLogger(config)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	out := &bytes.Buffer{}
+	l.sinks = append(l.sinks, NewWriterSink(out, config.Format))
+
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	return l, out, &now
+}
+
+func TestLevels(t *testing.T) {
+	config := DefaultConfig()
+	config.Subsystems = map[string]EnumLevel{"ioman": LevelWarn, "ioman:recovery": LevelDebug}
+	l, out, _ := testLogger(t, config)
+
+	l.Logf(LevelDebug, "alarmman", "dropped")
+	l.Logf(LevelInfo, "alarmman", "kept %v", 1)
+	l.Logf(LevelInfo, "ioman:controller", "dropped")
+	l.Logf(LevelWarn, "ioman:controller", "kept %v", 2)
+	l.Logf(LevelDebug, "ioman:recovery", "kept %v", 3)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || strings.Contains(out.String(), "dropped") {
+		t.Fatalf("Expected three entries, got %q", out.String())
+	}
+	if !strings.HasSuffix(lines[1], "WARN  [ioman:controller] kept 2") {
+		t.Fatalf("Expected a text entry of level, owner and message, got %q", lines[1])
+	}
+	if l.Enabled(LevelInfo, "ioman") || !l.Enabled(LevelDebug, "ioman:recovery:bus") {
+		t.Fatalf("Expected subsystem levels to apply to owners beneath them")
+	}
+	if len(l.Ring().Entries(0)) != 3 {
+		t.Fatalf("Expected the ring to hold every entry logged, got %v", l.Ring().Entries(0))
+	}
+}
+
+func TestLimitf(t *testing.T) {
+	config := DefaultConfig()
+	config.Format = FormatJSON
+	l, out, now := testLogger(t, config)
+
+	// A hot path logging every millisecond for two seconds, alongside another call site
+	for i := 0; i < 2000; i++ {
+		l.Limitf(LevelInfo, "ioman", "state changed to %v", i)
+		if i == 10 {
+			l.Limitf(LevelInfo, "ioman", "other call site")
+		}
+		*now = now.Add(time.Millisecond)
+	}
+
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		e := map[string]interface{}{}
+		err := json.Unmarshal([]byte(line), &e)
+		if err != nil {
+			t.Fatalf("Expected a JSON object per line, got %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("Expected one entry per second of each call site, got %v", entries)
+	}
+	if entries[0]["message"] != "state changed to 0" || entries[0]["level"] != "info" || entries[0]["owner"] != "ioman" {
+		t.Fatalf("Unexpected first entry %v", entries[0])
+	}
+	if entries[2]["message"] != "state changed to 1000" || entries[2]["suppressed"] != float64(999) {
+		t.Fatalf("Expected the second entry to count those suppressed, got %v", entries[2])
+	}
+}
+
+func TestRingSink(t *testing.T) {
+	r := NewRingSink(3)
+	if len(r.Entries(0)) != 0 {
+		t.Fatalf("Expected an empty ring")
+	}
+	for _, m := range []string{"a", "b", "c", "d"} {
+		_ = r.Write(Entry{Message: m})
+	}
+
+	entries := r.Entries(0)
+	if len(entries) != 3 || entries[0].Message != "b" || entries[2].Message != "d" {
+		t.Fatalf("Expected the last three entries oldest first, got %v", entries)
+	}
+	entries = r.Entries(2)
+	if len(entries) != 2 || entries[0].Message != "c" {
+		t.Fatalf("Expected the last two entries, got %v", entries)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logman")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileSink(FileConfig{Directory: dir, MaxFileSize: 100, MaxFiles: 2}, FormatText)
+	if err != nil {
+		t.Fatalf("Failed to create file sink: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		err := s.Write(Entry{Time: time.Unix(1000, 0), Owner: "test", Message: strings.Repeat("x", 40)})
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Two entries per file, the oldest removed
+	files, _ := filepath.Glob(filepath.Join(dir, "log-*.log"))
+	if len(files) != 2 || !strings.HasSuffix(files[1], "-004.log") {
+		t.Fatalf("Expected the two newest of five files, got %v", files)
+	}
+	b, _ := ioutil.ReadFile(files[1])
+	if strings.Count(string(b), "\n") != 2 {
+		t.Fatalf("Expected two entries in the last file, got %q", b)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if DefaultConfig().Validate() != nil {
+		t.Fatalf("Expected default config to be valid")
+	}
+	config := DefaultConfig()
+	config.Subsystems = map[string]EnumLevel{"ioman": EnumLevel(9)}
+	if config.Validate() == nil {
+		t.Fatalf("Expected an unknown subsystem level to be invalid")
+	}
+	config = DefaultConfig()
+	config.File.Directory = "logs"
+	config.File.MaxFileSize = 0
+	if config.Validate() == nil {
+		t.Fatalf("Expected a log file without a size to be invalid")
+	}
+
+	level, err := ParseLevel("WARN")
+	if err != nil || level != LevelWarn {
+		t.Fatalf("Expected warn level, got %v %v", level, err)
+	}
+	format, err := ParseFormat("json")
+	if err != nil || format != FormatJSON {
+		t.Fatalf("Expected JSON format, got %v %v", format, err)
+	}
+}
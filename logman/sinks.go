@@ -0,0 +1,202 @@
+package logman
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Sink receives every entry that passes filtering. Writes are serialised by the Logger.
+type Sink interface {
+	Write(e Entry) error
+	Close() error
+}
+
+//WriterSink writes formatted entries to a writer, such as stderr, which it does not close
+type WriterSink struct {
+	w      io.Writer
+	format EnumFormat
+}
+
+//NewWriterSink ..
+func NewWriterSink(w io.Writer, format EnumFormat) *WriterSink {
+	return &WriterSink{w: w, format: format}
+}
+
+//Write ..
+func (s *WriterSink) Write(e Entry) error {
+	_, err := io.WriteString(s.w, e.Format(s.format)+"\n")
+	return err
+}
+
+//Close ..
+func (s *WriterSink) Close() error {
+	return nil
+}
+
+//FileConfig ..
+type FileConfig struct {
+	Directory   string //Directory log files are written to
+	MaxFileSize int64  //Size in bytes after which a new file is started
+	MaxFiles    int    //Number of files kept before the oldest is removed, 0 to keep all
+}
+
+//FileSink writes formatted entries to rotating files named log-<start>-<index>.log. Entries are written
+//unbuffered, so that the log leading up to a crash is kept.
+type FileSink struct {
+	config  FileConfig
+	format  EnumFormat
+	started time.Time
+
+	file    *os.File
+	written int64
+	index   int
+}
+
+//NewFileSink creates the first log file
+func NewFileSink(config FileConfig, format EnumFormat) (*FileSink, error) {
+	if config.MaxFileSize <= 0 {
+		return nil, fmt.Errorf("Log file max size must be positive, got %v", config.MaxFileSize)
+	}
+
+	err := os.MkdirAll(config.Directory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create log directory %v: %w", config.Directory, err)
+	}
+
+	s := FileSink{
+		config:  config,
+		format:  format,
+		started: time.Now(),
+	}
+	err = s.rotate()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+//Write ..
+func (s *FileSink) Write(e Entry) error {
+	if s.file == nil {
+		return fmt.Errorf("Log file is closed")
+	}
+	if s.written >= s.config.MaxFileSize {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.WriteString(e.Format(s.format) + "\n")
+	s.written += int64(n)
+	return err
+}
+
+//Close ..
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if s.file != nil {
+		err := s.file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to close log file: %w", err)
+		}
+	}
+
+	name := filepath.Join(s.config.Directory, fmt.Sprintf("log-%v-%03d.log", s.started.Format("20060102-150405"), s.index))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.file = nil
+		return fmt.Errorf("Failed to create log file %v: %w", name, err)
+	}
+
+	s.file = f
+	s.written = 0
+	s.index++
+
+	return s.prune()
+}
+
+func (s *FileSink) prune() error {
+	if s.config.MaxFiles <= 0 {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.config.Directory, "log-*.log"))
+	if err != nil {
+		return fmt.Errorf("Failed to list log files: %w", err)
+	}
+	sort.Strings(files) //Names sort by start time and index
+
+	for len(files) > s.config.MaxFiles {
+		err := os.Remove(files[0])
+		if err != nil {
+			return fmt.Errorf("Failed to remove log file %v: %w", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+//RingSink keeps the most recent entries in memory, for display on screen
+type RingSink struct {
+	mring   sync.Mutex
+	entries []Entry
+	head    int //Index the next entry is written to
+	full    bool
+}
+
+//NewRingSink creates a RingSink of size entries
+func NewRingSink(size int) *RingSink {
+	return &RingSink{entries: make([]Entry, size)}
+}
+
+//Write ..
+func (s *RingSink) Write(e Entry) error {
+	s.mring.Lock()
+	defer s.mring.Unlock()
+
+	s.entries[s.head] = e
+	s.head = (s.head + 1) % len(s.entries)
+	if s.head == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+//Close ..
+func (s *RingSink) Close() error {
+	return nil
+}
+
+//Entries returns up to n of the most recent entries, oldest first, or all kept if n is 0
+func (s *RingSink) Entries(n int) []Entry {
+	s.mring.Lock()
+	defer s.mring.Unlock()
+
+	kept := s.head
+	if s.full {
+		kept = len(s.entries)
+	}
+	if n <= 0 || n > kept {
+		n = kept
+	}
+
+	entries := make([]Entry, 0, n)
+	for i := s.head - n; i < s.head; i++ {
+		entries = append(entries, s.entries[(i+len(s.entries))%len(s.entries)])
+	}
+	return entries
+}
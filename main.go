@@ -1,13 +1,21 @@
 package main // import "github.com/kaelanfouwels/gogles"
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/kaelanfouwels/gogles/alarmman"
+	"github.com/kaelanfouwels/gogles/climan"
+	"github.com/kaelanfouwels/gogles/configman"
 	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
 	"github.com/kaelanfouwels/gogles/mfdman"
 
 	"github.com/kaelanfouwels/gogles/fontman"
@@ -20,99 +28,430 @@ import (
 	"flag"
 )
 
-const _width, _height = 800, 480
-const _glLoopTime = (1 * time.Second) / 60 // 60 Hz
-const _cliLoopTime = (1 * time.Second) / 1 // 1 Hz
+const _glLoopTime = (1 * time.Second) / 60     // 60 Hz
+const _cliLoopTime = (1 * time.Second) / 1     // 1 Hz
+const _alarmLoopTime = (1 * time.Second) / 100 // 100 Hz
+const _alarmDecimation = 10                    // 100 Hz of the 1 kHz io loop, alarm limits are times rather than packet counts
+const _staleData = 100 * time.Millisecond      // Age after which the last DataPacket is no longer current
+
+const _exitError = 1  // Exit status on failure, the valve was closed
+const _exitUnsafe = 2 // Exit status when the valve could not be confirmed closed
+
+//errUnsafe marks a shutdown that could not confirm the valve closed
+var errUnsafe = errors.New("Valve not confirmed closed")
+
+//MFD keyboard bindings, standing in for physical MFD buttons
+var _mfdKeys = map[glfw.Key]mfdman.MFDIndex{
+	glfw.KeyF1: mfdman.L1,
+	glfw.KeyF2: mfdman.L2,
+	glfw.KeyF3: mfdman.L3,
+	glfw.KeyF4: mfdman.L4,
+	glfw.KeyF5: mfdman.R1,
+	glfw.KeyF6: mfdman.R2,
+	glfw.KeyF7: mfdman.R3,
+	glfw.KeyF8: mfdman.R4,
+}
+
+//settings collects repeated -set key=value flags
+type settings []string
+
+func (s *settings) String() string { return strings.Join(*s, " ") }
+func (s *settings) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("Expected key=value, got %v", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
 
+var flagConfig *string
+var flagSet settings
+var flagPrintConfig *bool
 var flagNoGui *bool
+var flagCliStyle *string
+var flagSim *bool
+var flagReplay *string
+var flagReplayADC *string
+var flagReplaySpeed *float64
+var flagReplayStart *time.Duration
+var flagReplayLoop *bool
+var flagRecord *string
+var flagRecordMaxSize *int64
+var flagRecordMaxFiles *int
+var flagMode *string
+var flagTrigger *string
+var flagTriggerSensitivity *float64
+var flagTriggerRefractory *time.Duration
+var flagFlowFilter *string
+var flagLogLevel *string
+var flagLogFormat *string
+var flagLogDir *string
 
 func init() {
 	//GLFW event handling must run on the main OS thread
-	logf("init", "Locking to OS Thread")
+	logman.Infof("init", "Locking to OS Thread")
 	runtime.LockOSThread()
 
 	//Commandline Flags
-	logf("init", "Parsing Flags")
+	logman.Infof("init", "Parsing Flags")
+	defaults := configman.Default()
+	flagConfig = flag.String("config", "", "JSON configuration file, read over the defaults")
+	flag.Var(&flagSet, "set", "override any configuration field as key=value, where key is the dot separated path of JSON names and list indexes such as hardware.flows.0.bus, repeatable and applied before the flags below")
+	flagPrintConfig = flag.Bool("print-config", false, "print the configuration in effect, including flag overrides, and exit")
 	flagNoGui = flag.Bool("no-gui", false, "run application in headless (no GUI) mode")
+	flagCliStyle = flag.String("cli-style", climan.StyleTerminal.String(), "headless monitor style, terminal to redraw the screen or plain to write a line of key=value fields per update")
+	flagSim = flag.Bool("sim", false, "run application against a simulated patient lung instead of sensor hardware")
+	flagReplay = flag.String("replay", "", "run application against a recorded duration,flow csv capture or a -record session file instead of sensor hardware")
+	flagReplayADC = flag.String("replay-adc", "", "recorded duration,val0,val1... csv capture of adc values to replay alongside -replay, in place of those of a session file")
+	flagReplaySpeed = flag.Float64("replay-speed", 1, "replay speed multiplier")
+	flagReplayStart = flag.Duration("replay-start", 0, "position in the capture replay starts from")
+	flagReplayLoop = flag.Bool("replay-loop", false, "restart replay at the end of the capture")
+	flagRecord = flag.String("record", "", "record every data packet to session files in this directory")
+	flagRecordMaxSize = flag.Int64("record-max-size", defaults.Record.MaxSize, "size in MB after which a new session file is started")
+	flagRecordMaxFiles = flag.Int("record-max-files", defaults.Record.MaxFiles, "number of session files kept before the oldest is removed, 0 to keep all")
+	flagMode = flag.String("mode", defaults.Mode.Name, fmt.Sprintf("ventilation mode at start, one of %v, switched while running with the L1 and L2 MFD keys (F1, F2), not available with -no-gui", ioman.ModeNames()))
+	flagTrigger = flag.String("trigger", defaults.Trigger.Source, "patient effort trigger source, flow or pressure")
+	flagTriggerSensitivity = flag.Float64("trigger-sensitivity", defaults.Trigger.Sensitivity, "patient effort in SLM of inspiratory flow, or cmH2O below baseline pressure, that triggers a breath")
+	flagTriggerRefractory = flag.Duration("trigger-refractory", time.Duration(defaults.Trigger.Refractory), "minimum time after a trigger or the start of machine expiration before a breath can be triggered")
+	flagFlowFilter = flag.String("flow-filter", defaults.FlowFilter, "comma separated flow filter chain of mean:<window>, median:<window>, ema:<cutoff hz> and butterworth:<cutoff hz> stages")
+	flagLogLevel = flag.String("log-level", defaults.Log.Level, "lowest level logged, one of debug, info, warn or error")
+	flagLogFormat = flag.String("log-format", defaults.Log.Format, "format of logs written to stderr and files, text or json")
+	flagLogDir = flag.String("log-dir", "", "write logs to rotating files in this directory")
 	flag.Parse()
 }
 
 func main() {
-	err := start()
+	config, err := loadConfig()
+	if err != nil {
+		logman.Errorf("main", "%v", err)
+		os.Exit(1)
+	}
+
+	if *flagPrintConfig {
+		err := config.Write(os.Stdout)
+		if err != nil {
+			logman.Errorf("main", "%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	log, err := config.LogConfig()
+	if err == nil {
+		err = logman.Configure(log)
+	}
 	if err != nil {
-		logf("main", "%v", err)
+		logman.Errorf("main", "%v", err)
 		os.Exit(1)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logman.Warnf("main", "Received %v, shutting down", sig)
+		signal.Stop(signals) //A second signal terminates immediately, should shutdown hang
+		cancel()
+	}()
+
+	err = start(ctx, config)
+	status := 0
+	if err != nil {
+		logman.Errorf("main", "%v", err)
+		status = _exitError
+		if errors.Is(err, errUnsafe) {
+			status = _exitUnsafe
+		}
+	}
+	logman.Infof("main", "Exiting with status %v", status)
+	logman.Close()
+	os.Exit(status)
+}
+
+// loadConfig reads the configuration file if any, and applies the flags set on the command line over it
+func loadConfig() (configman.Config, error) {
+	config := configman.Default()
+	if *flagConfig != "" {
+		var err error
+		config, err = configman.Load(*flagConfig)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	for _, setting := range flagSet {
+		kv := strings.SplitN(setting, "=", 2)
+		err := config.Set(kv[0], kv[1])
+		if err != nil {
+			return config, err
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "record":
+			config.Record.Directory = *flagRecord
+		case "record-max-size":
+			config.Record.MaxSize = *flagRecordMaxSize
+		case "record-max-files":
+			config.Record.MaxFiles = *flagRecordMaxFiles
+		case "mode":
+			config.Mode.Name = *flagMode
+		case "trigger":
+			config.Trigger.Source = *flagTrigger
+		case "trigger-sensitivity":
+			config.Trigger.Sensitivity = *flagTriggerSensitivity
+		case "trigger-refractory":
+			config.Trigger.Refractory = configman.Duration(*flagTriggerRefractory)
+		case "flow-filter":
+			config.FlowFilter = *flagFlowFilter
+		case "log-level":
+			config.Log.Level = *flagLogLevel
+		case "log-format":
+			config.Log.Format = *flagLogFormat
+		case "log-dir":
+			config.Log.Directory = *flagLogDir
+		}
+	})
+
+	err := config.Validate()
+	if err != nil {
+		return config, fmt.Errorf("Invalid config: %w", err)
+	}
+	return config, nil
 }
 
-func start() error {
+// start runs ioman and the user interface until ctx is cancelled or the interface ends, then shuts down in order:
+// the interface, the io loop leaving the valve closed, then recordings and buses
+func start(ctx context.Context, config configman.Config) (err error) {
+
+	logman.Infof("start", "Initializing ioman")
+	iom, err := newIOMan(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		logman.Infof("start", "Destroying ioman")
+		derr := iom.Destroy()
+		if derr != nil && err == nil {
+			err = fmt.Errorf("Failed to destroy ioman: %w", derr)
+		}
+	}()
+
+	if config.Record.Directory != "" {
+		logman.Infof("start", "Recording session to %v", config.Record.Directory)
+		err := iom.Record(config.RecorderConfig())
+		if err != nil {
+			return err
+		}
+	}
+
+	channels, err := config.ChannelMap()
+	if err != nil {
+		return err
+	}
+	err = iom.SetChannelMap(channels)
+	if err != nil {
+		return err
+	}
+
+	filters, err := config.FlowFilters()
+	if err != nil {
+		return err
+	}
+	err = iom.SetFlowFilters(filters)
+	if err != nil {
+		return err
+	}
+
+	trigger, err := config.TriggerConfig()
+	if err != nil {
+		return err
+	}
+	err = iom.SetTrigger(trigger)
+	if err != nil {
+		return err
+	}
+
+	err = iom.SetBreathDetection(config.BreathConfig())
+	if err != nil {
+		return err
+	}
+
+	err = iom.SetHistory(time.Duration(config.History))
+	if err != nil {
+		return err
+	}
+
+	mode, err := ioman.NewMode(config.Mode.Name, config.ModeConfig())
+	if err != nil {
+		return err
+	}
+	iom.SetMode(mode)
 
-	logf("start", "Initializing ioman")
-	ioman, err := ioman.NewIOMan()
+	logman.Infof("start", "Initializing alarmman")
+	alarms, err := alarmman.NewAlarmMan(config.Limits())
 	if err != nil {
 		return err
 	}
-	defer ioman.Destroy()
 
 	chioerr := make(chan error)
-	logf("start", "Starting watchdog goroutine")
+	logman.Infof("start", "Starting watchdog goroutine")
 	go watchdog(chioerr)
 
-	logf("start", "Starting ioman goroutine")
-	go ioman.Start(chioerr)
+	// The io loop outlives the interface, which reads from it, so it is stopped separately from ctx
+	logman.Infof("start", "Starting ioman goroutine")
+	ioctx, iostop := context.WithCancel(context.Background())
+	ioerr := make(chan error, 1)
+	go func() {
+		ioerr <- iom.Start(ioctx, chioerr)
+	}()
+	defer func() {
+		logman.Infof("start", "Stopping ioman")
+		iostop()
+		ierr := <-ioerr
+		close(chioerr)
+		if ierr != nil {
+			if err != nil {
+				logman.Errorf("start", "%v", err)
+			}
+			err = fmt.Errorf("%w: %v", errUnsafe, ierr)
+		}
+	}()
+
+	logman.Infof("start", "Starting alarm goroutine at %v hz", 1/_alarmLoopTime.Seconds())
+	alsub, err := iom.Subscribe(ioman.SubscribeConfig{
+		Stream:     ioman.StreamAll,
+		Decimation: _alarmDecimation,
+		Buffer:     16,
+		Overflow:   ioman.OverflowDropOldest,
+	})
+	if err != nil {
+		return err
+	}
+	altick := time.NewTicker(_alarmLoopTime)
+	defer altick.Stop()
+	go alarmLoop(alsub, altick.C, alarms)
 
 	if !*flagNoGui {
 
-		logf("start", "Handing over to graphics at %v hz", 1/_glLoopTime.Seconds())
+		logman.Infof("start", "Handing over to graphics at %v hz", 1/_glLoopTime.Seconds())
 		gltick := time.NewTicker(_glLoopTime)
 		defer gltick.Stop()
 
-		err := graphics(gltick.C, ioman)
+		err := graphics(ctx, gltick.C, iom, alarms, config.Display, config.ModeConfig())
 		if err != nil {
 			return fmt.Errorf("graphics has exit: %w", err)
 		}
 
 	} else {
-		logf("start", "Running in headless mode, handing over to cli at 1Hz")
+		logman.Infof("start", "Running in headless mode, handing over to cli at 1Hz")
 
 		cltick := time.NewTicker(_cliLoopTime)
 		defer cltick.Stop()
 
-		err := cli(cltick.C, ioman)
+		err := cli(ctx, cltick.C, iom, alarms, time.Duration(config.Hardware.SampleRate))
 		if err != nil {
 			return fmt.Errorf("cli has exit: %w", err)
 		}
 	}
 
-	return fmt.Errorf("graphics exit without error, this is unexpected")
+	return nil
+}
+
+func newIOMan(config configman.Config) (*ioman.IOMan, error) {
+	hardware, err := config.HardwareConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The sim and replay backends have only a proximal flow sensor
+	single := hardware
+	single.Flows = []ioman.FlowSensorConfig{hardware.Proximal()}
+
+	if *flagSim {
+		logman.Infof("start", "Using simulated lung backend")
+		lung := ioman.NewSimLung(config.SimConfig())
+		return ioman.NewIOManWithDevices(lung.Devices(), single)
+	}
+
+	if *flagReplay != "" {
+		logman.Infof("start", "Using replay backend from %v at %vx", *flagReplay, *flagReplaySpeed)
+		replay, err := ioman.NewReplay(ioman.ReplayConfig{
+			FlowFile:  *flagReplay,
+			ADCFile:   *flagReplayADC,
+			Speed:     *flagReplaySpeed,
+			Loop:      *flagReplayLoop,
+			FlowIsAir: hardware.Proximal().IsAir,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if *flagReplayStart > 0 {
+			logman.Infof("start", "Starting replay at %v of %v", *flagReplayStart, replay.Duration())
+			replay.Seek(*flagReplayStart)
+		}
+		return ioman.NewIOManWithDevices(replay.Devices(), single)
+	}
+
+	return ioman.NewIOMan(hardware)
 }
 
 func watchdog(ioman <-chan error) {
-	ticker := time.NewTicker(1000 * time.Millisecond)
-	defer ticker.Stop()
+	for err := range ioman {
+		// Keep displaying the last data, the alarm loop raises a sensor failure once it goes stale
+		logman.Limitf(logman.LevelError, "watchdog", "Ioman has raised fault: %v", err)
+	}
+}
 
-	for range ticker.C {
+// alarmLoop evaluates alarms on every DataPacket of the subscription, and on every tick once it has gone quiet
+func alarmLoop(sub *ioman.Subscription, ticker <-chan time.Time, alarms *alarmman.AlarmMan) {
+	last := ioman.DataPacket{Timestamp: time.Now()}
+	for {
 		select {
-		case err := <-ioman:
-			logf("watchdog", "Ioman has raised fault, exiting: %v", err)
-			os.Exit(1)
-		default:
+		case dp, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			last = dp
+			alarms.Update(dp)
+		case now := <-ticker:
+			if now.Sub(last.Timestamp) > _staleData {
+				dp := last
+				dp.Valid = false
+				dp.Timestamp = now
+				alarms.Update(dp)
+			}
 		}
 	}
 }
-func cli(ticker <-chan time.Time, ioman *ioman.IOMan) error {
 
-	for range ticker {
-		//dp := ioman.GetDataPacket()
-		//logf("cli", "\nHeader: %+v %+v \nFlow: %+v \nADC: %+v \nCalculated: %+v\n\n", dp.Valid, dp.Timestamp, dp.Sensors.Flow, dp.Sensors.ADC, dp.Calculated)
+func cli(ctx context.Context, ticker <-chan time.Time, ioman *ioman.IOMan, alarms *alarmman.AlarmMan, sampleRate time.Duration) error {
+
+	style, err := climan.ParseStyle(*flagCliStyle)
+	if err != nil {
+		return err
+	}
+	config := climan.DefaultConfig()
+	config.Style = style
+	config.SampleRate = sampleRate
+
+	monitor, err := climan.NewMonitor(config, os.Stdout, ioman, alarms)
+	if err != nil {
+		return err
+	}
+	if ring := logman.Ring(); ring != nil {
+		monitor.SetLog(ring)
 	}
 
-	return fmt.Errorf("cli has exit unexpectedly")
+	return monitor.Run(ctx, ticker)
 }
 
-func graphics(ticker <-chan time.Time, ioman *ioman.IOMan) error {
+func graphics(ctx context.Context, ticker <-chan time.Time, iom *ioman.IOMan, alarms *alarmman.AlarmMan, display configman.Display, modes ioman.ModeConfig) error {
 
-	logf("graphics", "Initializing GLFW")
+	logman.Infof("graphics", "Initializing GLFW")
 	if err := glfw.Init(); err != nil {
 		return fmt.Errorf("failed to initialize glfw: %w", err)
 	}
@@ -122,67 +461,126 @@ func graphics(ticker <-chan time.Time, ioman *ioman.IOMan) error {
 	glfw.WindowHint(glfw.ContextVersionMajor, 2)
 	glfw.WindowHint(glfw.ContextVersionMinor, 1)
 
-	logf("graphics", "Requesting Window")
-	window, err := glfw.CreateWindow(_width, _height, "gogles", nil, nil)
+	logman.Infof("graphics", "Requesting Window")
+	window, err := glfw.CreateWindow(display.Width, display.Height, "gogles", nil, nil)
 	if err != nil {
 		return err
 	}
+	defer window.Destroy()
 	window.MakeContextCurrent()
 
 	if err := gl.Init(); err != nil {
 		return err
 	}
+	width, height := float32(display.Width), float32(display.Height)
 
-	logf("graphics", "Initializing texman")
+	logman.Infof("graphics", "Initializing texman")
 	textman, err := textman.NewTextman("./assets")
 	if err != nil {
 		return err
 	}
 	defer textman.Destroy()
 
-	logf("graphics", "Initializing fontman")
+	logman.Infof("graphics", "Initializing fontman")
 	fontman, err := fontman.NewFontman(textman)
 	if err != nil {
 		return err
 	}
 
-	logf("graphics", "Initializing mdfman")
-	mfdman1, err := mfdman.NewMFDman(_width, _height, fontman)
+	logman.Infof("graphics", "Initializing mdfman")
+	mfdman1, err := mfdman.NewMFDman(width, height, fontman)
 	if err != nil {
 		return err
 	}
 
-	mfdman1.SetText(mfdman.L1, "L1", "NONE")
-	mfdman1.SetText(mfdman.L2, "L2", "NONE")
 	mfdman1.SetText(mfdman.L3, "L3", "NONE")
 	mfdman1.SetText(mfdman.L4, "L4", "NONE")
 	mfdman1.SetText(mfdman.R1, "R1", "NONE")
 	mfdman1.SetText(mfdman.R2, "R2", "NONE")
-	mfdman1.SetText(mfdman.R3, "R3", "NONE")
-	mfdman1.SetText(mfdman.R4, "R4", "NONE")
+	mfdman1.SetText(mfdman.R3, "AUDIO", "PAUSE")
+	mfdman1.SetText(mfdman.R4, "ALARM", "ACK")
+	mfdman1.SetHandler(mfdman.R3, alarms.Silence)
+	mfdman1.SetHandler(mfdman.R4, alarms.Acknowledge)
+
+	//L1 steps through the modes, L2 switches to the one shown, so a single press never changes the mode
+	modeNames := ioman.ModeNames()
+	modeIndex := 0
+	for i, name := range modeNames {
+		if strings.EqualFold(name, iom.Mode().Name()) {
+			modeIndex = i
+		}
+	}
+	showMode := func() {
+		pending := !strings.EqualFold(modeNames[modeIndex], iom.Mode().Name())
+		mfdman1.SetText(mfdman.L1, "MODE", strings.ToUpper(modeNames[modeIndex]))
+		mfdman1.SetText(mfdman.L2, "MODE", "SET")
+		mfdman1.SetSelected(mfdman.L1, pending)
+	}
+	showMode()
+	mfdman1.SetHandler(mfdman.L1, func() {
+		modeIndex = (modeIndex + 1) % len(modeNames)
+		showMode()
+	})
+	mfdman1.SetHandler(mfdman.L2, func() {
+		name := modeNames[modeIndex]
+		if !strings.EqualFold(name, iom.Mode().Name()) {
+			mode, err := ioman.NewMode(name, modes)
+			if err != nil {
+				logman.Errorf("graphics", "Failed to switch mode to %v: %v", name, err)
+			} else {
+				iom.SetMode(mode)
+			}
+		}
+		showMode()
+	})
 
-	logf("graphics", "Initializing renderman")
-	renderman, err := renderman.NewRenderman(_width, _height, textman, fontman, mfdman1, ioman)
+	window.SetKeyCallback(func(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+		if action != glfw.Press {
+			return
+		}
+		if mfd, ok := _mfdKeys[key]; ok {
+			mfdman1.Press(mfd)
+		}
+	})
+
+	logman.Infof("graphics", "Initializing renderman")
+	renderman, err := renderman.NewRenderman(width, height, textman, fontman, mfdman1, iom, alarms)
 	if err != nil {
 		return err
 	}
 	defer renderman.Destroy()
+	if ring := logman.Ring(); ring != nil {
+		renderman.SetLog(ring)
+	}
 
-	logf("graphics", "Starting Draw Cycle")
+	logman.Infof("graphics", "Starting Draw Cycle")
 	ticks := 0
-	for range ticker {
+	for {
+		select {
+		case <-ctx.Done():
+			logman.Infof("graphics", "Closing window")
+			return nil
+		case _, ok := <-ticker:
+			if !ok {
+				return fmt.Errorf("graphis has exit unexpectedly")
+			}
+		}
 
 		if window.ShouldClose() {
-			return fmt.Errorf("Window has been closed")
+			logman.Infof("graphics", "Window has been closed")
+			return nil
 		}
 
+		_, audible := alarms.Audible()
+		mfdman1.SetSelected(mfdman.R4, audible)
+
 		err := renderman.Draw()
 		if err != nil {
 			return fmt.Errorf("Draw cycle failed: %w", err)
 		}
 
 		//DEBUG
-		err = fontman.RenderString(fmt.Sprintf("Healthkeeper v0.1: %v", ticks), -_width/2+20, -_height/2+20, 0.10)
+		err = fontman.RenderString(fmt.Sprintf("Healthkeeper v0.1: %v", ticks), -width/2+20, -height/2+20, 0.10)
 		if err != nil {
 			return err
 		}
@@ -192,8 +590,6 @@ func graphics(ticker <-chan time.Time, ioman *ioman.IOMan) error {
 		window.SwapBuffers()
 		glfw.PollEvents()
 	}
-
-	return fmt.Errorf("graphis has exit unexpectedly")
 }
 
 func processLoop(ticker <-chan time.Time, cherr chan<- error) {
@@ -202,8 +598,3 @@ func processLoop(ticker <-chan time.Time, cherr chan<- error) {
 
 	}
 }
-
-func logf(owner string, format string, v ...interface{}) {
-	message := fmt.Sprintf(format, v...)
-	log.Printf("[%v] %v", owner, message)
-}
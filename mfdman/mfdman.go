@@ -41,6 +41,7 @@ type mfd struct {
 	selected bool
 	textA    string
 	textB    string
+	handler  func()
 }
 
 //MFDman ..
@@ -164,3 +165,15 @@ func (m *MFDman) SetSelected(mfd MFDIndex, selected bool) {
 func (m *MFDman) GetSelected(mfd MFDIndex) bool {
 	return m.mfds[mfd].selected
 }
+
+//SetHandler sets the function called when an MFD is pressed
+func (m *MFDman) SetHandler(mfd MFDIndex, handler func()) {
+	m.mfds[mfd].handler = handler
+}
+
+//Press calls the handler of an MFD, if it has one
+func (m *MFDman) Press(mfd MFDIndex) {
+	if m.mfds[mfd].handler != nil {
+		m.mfds[mfd].handler()
+	}
+}
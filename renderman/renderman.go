@@ -1,27 +1,50 @@
 package renderman
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/kaelanfouwels/gogles/alarmman"
 	"github.com/kaelanfouwels/gogles/fontman"
 	gl "github.com/kaelanfouwels/gogles/glow/gl"
 	"github.com/kaelanfouwels/gogles/ioman"
+	"github.com/kaelanfouwels/gogles/logman"
 	"github.com/kaelanfouwels/gogles/mfdman"
 	"github.com/kaelanfouwels/gogles/textman"
 )
 
 const assetsDir string = "assets/"
 
+const readoutX float32 = -260
+const readoutY float32 = 200
+const readoutSpacing float32 = 30
+const readoutScaling float32 = 0.25
+
+const alarmX float32 = 0
+const alarmY float32 = 200
+const alarmSpacing float32 = 25
+const alarmScaling float32 = 0.20
+
+const logX float32 = -380
+const logY float32 = -130
+const logSpacing float32 = 20
+const logScaling float32 = 0.15
+const logLines = 4
+
 //RenderMan ..
 type RenderMan struct {
 	textman *textman.Textman
 	fontman *fontman.Fontman
 	mfdman  *mfdman.MFDman
 	ioman   *ioman.IOMan
+	alarms  *alarmman.AlarmMan
+	log     *logman.RingSink
 	width   float32
 	height  float32
 }
 
 //NewRenderman ..
-func NewRenderman(width float32, height float32, textman *textman.Textman, fontman *fontman.Fontman, mfdman *mfdman.MFDman, ioman *ioman.IOMan) (*RenderMan, error) {
+func NewRenderman(width float32, height float32, textman *textman.Textman, fontman *fontman.Fontman, mfdman *mfdman.MFDman, ioman *ioman.IOMan, alarms *alarmman.AlarmMan) (*RenderMan, error) {
 
 	rm := RenderMan{
 		width:   width,
@@ -30,6 +53,7 @@ func NewRenderman(width float32, height float32, textman *textman.Textman, fontm
 		fontman: fontman,
 		mfdman:  mfdman,
 		ioman:   ioman,
+		alarms:  alarms,
 	}
 
 	rm.initialize()
@@ -37,9 +61,17 @@ func NewRenderman(width float32, height float32, textman *textman.Textman, fontm
 	return &rm, nil
 }
 
-//Destroy ..
-func (r *RenderMan) Destroy() {
+//SetLog shows the most recent entries of log on screen
+func (r *RenderMan) SetLog(log *logman.RingSink) {
+	r.log = log
+}
 
+//Destroy releases the managers drawn from, after which Draw must not be called.
+//RenderMan holds no GL objects of its own, its textures belong to textman and are deleted by it.
+func (r *RenderMan) Destroy() {
+	r.ioman = nil
+	r.alarms = nil
+	r.log = nil
 }
 
 func (r *RenderMan) initialize() {
@@ -69,6 +101,14 @@ func (r *RenderMan) Draw() error {
 	if err != nil {
 		return err
 	}
+	err = r.drawAlarms()
+	if err != nil {
+		return err
+	}
+	err = r.drawLog()
+	if err != nil {
+		return err
+	}
 	err = r.mfdman.Draw()
 	if err != nil {
 		return err
@@ -123,5 +163,86 @@ func (r *RenderMan) drawBackground() error {
 
 func (r *RenderMan) drawForeground() error {
 
+	dp := r.ioman.GetDataPacket()
+
+	lines := []string{
+		fmt.Sprintf("%v", dp.State),
+		fmt.Sprintf("Flow %.1f SLM", dp.Sensors.Flow.Val),
+		fmt.Sprintf("Paw  %v cmH2O", measurement(dp.Sensors.AirwayPressure)),
+		fmt.Sprintf("O2   %v %%", measurement(dp.Sensors.Oxygen)),
+		fmt.Sprintf("Sup  %v kPa", measurement(dp.Sensors.SupplyPressure)),
+	}
+
+	y := readoutY
+	for _, l := range lines {
+		err := r.fontman.RenderString(l, readoutX, y, readoutScaling)
+		if err != nil {
+			return err
+		}
+		y -= readoutSpacing
+	}
+
+	return nil
+}
+
+func measurement(m ioman.Measurement) string {
+	if !m.Valid {
+		return "---"
+	}
+	return fmt.Sprintf("%.1f", m.Val)
+}
+
+func (r *RenderMan) drawAlarms() error {
+
+	alarms := r.alarms.Alarms()
+	defer gl.Color3f(1, 1, 1)
+
+	y := alarmY
+	for _, a := range alarms {
+		marker := "!"
+		switch a.Priority {
+		case alarmman.PriorityHigh:
+			gl.Color3f(1, 0, 0)
+			marker = "!!!"
+		case alarmman.PriorityMedium:
+			gl.Color3f(1, 1, 0)
+			marker = "!!"
+		default:
+			gl.Color3f(0, 1, 1)
+		}
+
+		text := fmt.Sprintf("%v %v: %v", marker, a.ID, a.Message)
+		if a.Latched {
+			text = fmt.Sprintf("%v %v", marker, a.ID)
+		}
+		if a.Acknowledged {
+			text += " (ACK)"
+		}
+
+		err := r.fontman.RenderString(text, alarmX, y, alarmScaling)
+		if err != nil {
+			return err
+		}
+		y -= alarmSpacing
+	}
+
+	return nil
+}
+
+func (r *RenderMan) drawLog() error {
+	if r.log == nil {
+		return nil
+	}
+
+	y := logY
+	for _, e := range r.log.Entries(logLines) {
+		text := fmt.Sprintf("%v %v [%v] %v", e.Time.Format("15:04:05"), strings.ToUpper(e.Level.String()), e.Owner, e.Message)
+		err := r.fontman.RenderString(text, logX, y, logScaling)
+		if err != nil {
+			return err
+		}
+		y -= logSpacing
+	}
+
 	return nil
 }
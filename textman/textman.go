@@ -65,10 +65,11 @@ func (t *Textman) GetText(textName string) (Texture, error) {
 	return Texture{}, fmt.Errorf("Texture %s not present in texture cache", textName)
 }
 
-//Destroy ..
+//Destroy deletes every texture. Must be called while the GL context is current.
 func (t *Textman) Destroy() {
-	for _, v := range t.textCache {
+	for k, v := range t.textCache {
 		gl.DeleteTextures(1, &v.ID)
+		delete(t.textCache, k)
 	}
 }
 